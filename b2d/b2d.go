@@ -13,8 +13,11 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/docker/machine/libmachine/log"
 )
@@ -31,6 +34,9 @@ var (
 )
 
 var (
+	// ErrUnknownVersion is returned when a release version can't be downloaded.
+	ErrUnknownVersion = errors.New("unknown release version")
+
 	errGitHubAPIResponse = errors.New(`Error getting a version tag from the Github API response.
 You may be getting rate limited by Github.`)
 )
@@ -78,6 +84,10 @@ type releaseGetter interface {
 	getReleaseTag(apiURL string) (string, error)
 	// GetReleaseURL gets the latest release download URL from the given URL.
 	GetReleaseURL(apiURL string) (string, error)
+	// GetChecksum gets the SHA-256 of the product at the given download URL.
+	GetChecksum(downloadURL string) (string, error)
+	// GetVersionURL gets the download URL of the given release version.
+	GetVersionURL(version string) (string, error)
 }
 
 // b2dReleaseGetter implements the releaseGetter interface for getting the release of Boot2Docker.
@@ -161,6 +171,29 @@ Consider specifying another storage driver (e.g. 'overlay') using '--engine-stor
 	return url, nil
 }
 
+// GetChecksum gets the SHA-256 of a GitHub release ISO from a checksum asset published
+// next to it, either a sha256sum.txt covering every asset or <iso>.sha256. Other URLs
+// have no known checksum.
+func (b *b2dReleaseGetter) GetChecksum(downloadURL string) (string, error) {
+	if !releaseDownloadURL.MatchString(downloadURL) {
+		return "", ErrNoChecksum
+	}
+
+	filename := path.Base(downloadURL)
+	for _, asset := range []string{releaseChecksumAsset, filename + checksumSuffix} {
+		sum, err := fetchChecksum(strings.TrimSuffix(downloadURL, filename)+asset, filename)
+		if err != ErrNoChecksum {
+			return sum, err
+		}
+	}
+	return "", ErrNoChecksum
+}
+
+// GetVersionURL isn't supported for GitHub, only cached versions can be pinned.
+func (*b2dReleaseGetter) GetVersionURL(version string) (string, error) {
+	return "", ErrUnknownVersion
+}
+
 // iso is an ISO volume.
 type iso interface {
 	// path returns the path of the ISO.
@@ -227,6 +260,8 @@ type B2dUtils struct {
 	iso
 	storePath    string
 	ImgCachePath string
+	// FetchTimeout limits how long DownloadISO may take, zero means no limit
+	FetchTimeout time.Duration
 }
 
 func NewB2dUtils(storePath string) *B2dUtils {
@@ -244,6 +279,19 @@ func NewB2dUtils(storePath string) *B2dUtils {
 	}
 }
 
+// Version returns the version of the cached ISO.
+func (b *B2dUtils) Version() (string, error) {
+	return b.version()
+}
+
+// NewB2dUtilsFromIndex is like NewB2dUtils, but gets releases from the image index at indexURL
+// instead of GitHub.
+func NewB2dUtilsFromIndex(storePath string, indexURL string) *B2dUtils {
+	b := NewB2dUtils(storePath)
+	b.releaseGetter = &indexReleaseGetter{isoFilename: defaultISOFilename, indexURL: indexURL}
+	return b
+}
+
 func (b *B2dUtils) IsLatest() bool {
 	localVer, err := b.version()
 	if err != nil {
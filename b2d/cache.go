@@ -0,0 +1,271 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	manifestFilename     = "manifest.json"
+	manifestLockFilename = "manifest.lock"
+)
+
+// CacheEntry records which machines were created from a cached ISO version.
+type CacheEntry struct {
+	Machines []string  `json:"machines"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Manifest maps cached ISO versions to the machines referencing them.
+type Manifest struct {
+	Versions map[string]*CacheEntry `json:"versions"`
+}
+
+// VersionedISOPath returns where the ISO for version is kept in the cache.
+func (b *B2dUtils) VersionedISOPath(version string) string {
+	ext := filepath.Ext(defaultISOFilename)
+	return filepath.Join(b.ImgCachePath, strings.TrimSuffix(defaultISOFilename, ext)+"-"+version+ext)
+}
+
+// StoreVersion keeps the default cached ISO under its version, so it survives the default
+// ISO being replaced by a newer release, and returns the version.
+func (b *B2dUtils) StoreVersion() (string, error) {
+	ver, err := b.version()
+	if err != nil {
+		return "", err
+	}
+	if ver == "" {
+		return "", fmt.Errorf("no version found in %s", b.path())
+	}
+
+	versioned := b.VersionedISOPath(ver)
+	if _, err := os.Stat(versioned); err == nil {
+		return ver, nil
+	}
+
+	log.Debugf("Caching %s as %s", b.path(), versioned)
+	// downloads replace the default ISO by renaming over it, so a hard link is safe
+	if err := os.Link(b.path(), versioned); err != nil {
+		return "", err
+	}
+
+	sum, err := ReadChecksum(b.path())
+	if err == ErrNoChecksum {
+		return ver, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return ver, WriteChecksum(versioned, sum)
+}
+
+func (b *B2dUtils) manifestPath() string {
+	return filepath.Join(b.ImgCachePath, manifestFilename)
+}
+
+// ReadManifest returns the cache manifest, which is empty if none was written yet.
+func (b *B2dUtils) ReadManifest() (*Manifest, error) {
+	m := &Manifest{Versions: map[string]*CacheEntry{}}
+
+	data, err := ioutil.ReadFile(b.manifestPath())
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Versions == nil {
+		m.Versions = map[string]*CacheEntry{}
+	}
+
+	return m, nil
+}
+
+func (b *B2dUtils) writeManifest(m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmpfile, err := ioutil.TempFile(b.ImgCachePath, manifestFilename+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write(data); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile.Name(), b.manifestPath())
+}
+
+// lockManifest takes an exclusive lock on the manifest, so several docker-machine
+// processes can update it at once, and returns a function releasing it.
+func (b *B2dUtils) lockManifest() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(b.ImgCachePath, manifestLockFilename), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// AddReference records that machineName was created from version.
+func (b *B2dUtils) AddReference(version string, machineName string) error {
+	unlock, err := b.lockManifest()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m, err := b.ReadManifest()
+	if err != nil {
+		return err
+	}
+
+	entry, ok := m.Versions[version]
+	if !ok {
+		entry = &CacheEntry{}
+		m.Versions[version] = entry
+	}
+	entry.LastUsed = time.Now()
+
+	for _, name := range entry.Machines {
+		if name == machineName {
+			return b.writeManifest(m)
+		}
+	}
+	entry.Machines = append(entry.Machines, machineName)
+	sort.Strings(entry.Machines)
+
+	return b.writeManifest(m)
+}
+
+// RemoveReference forgets machineName, whichever version it was created from.
+func (b *B2dUtils) RemoveReference(machineName string) error {
+	if _, err := os.Stat(b.manifestPath()); os.IsNotExist(err) {
+		return nil
+	}
+
+	unlock, err := b.lockManifest()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m, err := b.ReadManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range m.Versions {
+		var machines []string
+		for _, name := range entry.Machines {
+			if name != machineName {
+				machines = append(machines, name)
+			}
+		}
+		entry.Machines = machines
+	}
+
+	return b.writeManifest(m)
+}
+
+// Prune removes cached ISO versions no machine references that were last used more than
+// maxAge ago, and returns the removed versions. The default ISO is left alone.
+func (b *B2dUtils) Prune(maxAge time.Duration) ([]string, error) {
+	if _, err := os.Stat(b.ImgCachePath); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	unlock, err := b.lockManifest()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	m, err := b.ReadManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := b.VersionedISOPath("*")
+	isos, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimSuffix(pattern, "*"+filepath.Ext(pattern))
+	cutoff := time.Now().Add(-maxAge)
+
+	var pruned []string
+	for _, iso := range isos {
+		ver := strings.TrimSuffix(strings.TrimPrefix(iso, prefix), filepath.Ext(iso))
+
+		lastUsed := time.Time{}
+		if entry, ok := m.Versions[ver]; ok {
+			if len(entry.Machines) > 0 {
+				log.Debugf("Keeping %s, used by %s", ver, strings.Join(entry.Machines, ", "))
+				continue
+			}
+			lastUsed = entry.LastUsed
+		}
+		if lastUsed.IsZero() {
+			info, err := os.Stat(iso)
+			if err != nil {
+				return pruned, err
+			}
+			lastUsed = info.ModTime()
+		}
+		if lastUsed.After(cutoff) {
+			log.Debugf("Keeping %s, last used %s", ver, lastUsed)
+			continue
+		}
+
+		log.Infof("Removing cached Boot2Docker %s", ver)
+		if err := os.Remove(iso); err != nil {
+			return pruned, err
+		}
+		if err := os.Remove(ChecksumPath(iso)); err != nil && !os.IsNotExist(err) {
+			return pruned, err
+		}
+		delete(m.Versions, ver)
+		pruned = append(pruned, ver)
+	}
+
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+
+	return pruned, b.writeManifest(m)
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCache returns B2dUtils for a new store with an empty ISO cache
+func testCache(t *testing.T) *B2dUtils {
+	storepath, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewB2dUtils(storepath)
+	if err := os.Mkdir(b.ImgCachePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestConcurrentReferences(t *testing.T) {
+	b := testCache(t)
+	defer os.RemoveAll(b.storePath)
+
+	// each as if from its own docker-machine process
+	const machines = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, machines)
+	for i := 0; i < machines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- NewB2dUtils(b.storePath).AddReference("v19.03.5", fmt.Sprintf("machine%02d", i))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := b.ReadManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(m.Versions["v19.03.5"].Machines); got != machines {
+		t.Errorf("manifest has %d machines, want %d: %v", got, machines, m.Versions["v19.03.5"].Machines)
+	}
+
+	for i := 0; i < machines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := NewB2dUtils(b.storePath).RemoveReference(fmt.Sprintf("machine%02d", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if m, err = b.ReadManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Versions["v19.03.5"].Machines; len(got) != 0 {
+		t.Errorf("machines left after removing them all: %v", got)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	b := testCache(t)
+	defer os.RemoveAll(b.storePath)
+
+	for _, ver := range []string{"v18.09.0", "v19.03.5", "v19.03.12"} {
+		if err := ioutil.WriteFile(b.VersionedISOPath(ver), []byte(ver), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.AddReference("v19.03.5", "dev"); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	if err := os.Chtimes(b.VersionedISOPath("v18.09.0"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := b.Prune(30 * 24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0] != "v18.09.0" {
+		t.Errorf("Prune() = %v, want [v18.09.0]", pruned)
+	}
+	for _, ver := range []string{"v19.03.5", "v19.03.12"} {
+		if _, err := os.Stat(b.VersionedISOPath(ver)); err != nil {
+			t.Errorf("%s was removed: %v", ver, err)
+		}
+	}
+
+	if pruned, err := NewB2dUtils(b.storePath + "-missing").Prune(0); err != nil || pruned != nil {
+		t.Errorf("Prune() without a cache = %v, %v", pruned, err)
+	}
+}
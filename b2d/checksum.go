@@ -0,0 +1,133 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	checksumSuffix       = ".sha256"
+	releaseChecksumAsset = "sha256sum.txt"
+)
+
+var (
+	// ErrNoChecksum is returned when a release has no checksum to verify against.
+	ErrNoChecksum = errors.New("no checksum available")
+
+	sha256Regex        = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+	releaseDownloadURL = regexp.MustCompile("^https?://[^/]+/[^/]+/[^/]+/releases/download/[^/]+/[^/]+$")
+)
+
+// ChecksumPath returns where the checksum of a cached ISO is recorded.
+func ChecksumPath(isoPath string) string {
+	return isoPath + checksumSuffix
+}
+
+// ValidSHA256 reports whether sum looks like a hex SHA-256.
+func ValidSHA256(sum string) bool {
+	return sha256Regex.MatchString(sum)
+}
+
+// SHA256File returns the hex SHA-256 of the file at filePath.
+func SHA256File(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifySHA256 checks the file at filePath against the expected hex SHA-256.
+func VerifySHA256(filePath string, expected string) error {
+	actual, err := SHA256File(filePath)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", filePath, expected, actual)
+	}
+
+	return nil
+}
+
+// ReadChecksum returns the checksum recorded for the ISO at isoPath, or ErrNoChecksum.
+func ReadChecksum(isoPath string) (string, error) {
+	data, err := ioutil.ReadFile(ChecksumPath(isoPath))
+	if os.IsNotExist(err) {
+		return "", ErrNoChecksum
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return parseChecksum(strings.NewReader(string(data)), path.Base(isoPath))
+}
+
+// WriteChecksum records the checksum of the ISO at isoPath in sha256sum format.
+func WriteChecksum(isoPath string, sum string) error {
+	return ioutil.WriteFile(ChecksumPath(isoPath), []byte(sum+"  "+path.Base(isoPath)+"\n"), 0644)
+}
+
+// parseChecksum reads sha256sum output, or a bare checksum, and returns the sum for filename.
+func parseChecksum(r io.Reader, filename string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !ValidSHA256(fields[0]) {
+			continue
+		}
+		if len(fields) == 1 || strings.TrimPrefix(fields[1], "*") == filename {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no checksum for %s found", filename)
+}
+
+// fetchChecksum downloads a checksum file and returns the sum for filename.
+func fetchChecksum(checksumURL string, filename string) (string, error) {
+	client := getClient()
+	req, err := getRequest(checksumURL)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotFound {
+		return "", ErrNoChecksum
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get %s: %s", checksumURL, rsp.Status)
+	}
+
+	return parseChecksum(rsp.Body, filename)
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testSum      = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	otherTestSum = "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+)
+
+func TestParseChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"bare", testSum + "\n", testSum, false},
+		{"sha256sum", otherTestSum + "  other.iso\n" + testSum + "  boot2docker.iso\n", testSum, false},
+		{"binary mode", strings.ToUpper(testSum) + " *boot2docker.iso\n", testSum, false},
+		{"other file only", testSum + "  other.iso\n", "", true},
+		{"not a checksum", "<html>Not Found</html>\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sum, err := parseChecksum(strings.NewReader(tt.input), "boot2docker.iso")
+			if sum != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("parseChecksum() = %q, %v, want %q, error %t", sum, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// releaseServer serves a GitHub style release download directory with the given assets
+func releaseServer(assets map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := assets[filepath.Base(r.URL.Path)]
+		if !ok || !strings.HasPrefix(r.URL.Path, "/boot2docker/boot2docker/releases/download/v19.03.5/") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+}
+
+func TestGetChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		assets  map[string]string
+		want    string
+		wantErr error
+	}{
+		{"sha256sum.txt", map[string]string{"sha256sum.txt": testSum + "  boot2docker.iso\n"}, testSum, nil},
+		{"iso.sha256", map[string]string{"boot2docker.iso.sha256": testSum + "\n"}, testSum, nil},
+		{"sha256sum.txt wins", map[string]string{
+			"sha256sum.txt":          testSum + "  boot2docker.iso\n",
+			"boot2docker.iso.sha256": otherTestSum + "\n",
+		}, testSum, nil},
+		{"none published", map[string]string{}, "", ErrNoChecksum},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := releaseServer(tt.assets)
+			defer server.Close()
+
+			getter := &b2dReleaseGetter{isoFilename: defaultISOFilename}
+			sum, err := getter.GetChecksum(server.URL + "/boot2docker/boot2docker/releases/download/v19.03.5/boot2docker.iso")
+			if sum != tt.want || err != tt.wantErr {
+				t.Errorf("GetChecksum() = %q, %v, want %q, %v", sum, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	getter := &b2dReleaseGetter{isoFilename: defaultISOFilename}
+	if _, err := getter.GetChecksum("https://example.com/boot2docker.iso"); err != ErrNoChecksum {
+		t.Errorf("got %v for a URL that isn't a release", err)
+	}
+}
+
+func TestFetchChecksumServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	if _, err := fetchChecksum(server.URL+"/sha256sum.txt", "boot2docker.iso"); err == nil || err == ErrNoChecksum {
+		t.Errorf("fetchChecksum() = %v, want a server error", err)
+	}
+}
+
+func TestChecksumFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	isoPath := filepath.Join(dir, "boot2docker.iso")
+	if err := ioutil.WriteFile(isoPath, []byte("not really an ISO"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadChecksum(isoPath); err != ErrNoChecksum {
+		t.Errorf("ReadChecksum() = %v before one was written", err)
+	}
+
+	sum, err := SHA256File(isoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteChecksum(isoPath, sum); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := ReadChecksum(isoPath); err != nil || read != sum {
+		t.Errorf("ReadChecksum() = %s, %v, want %s", read, err, sum)
+	}
+
+	if err := VerifySHA256(isoPath, strings.ToUpper(sum)); err != nil {
+		t.Errorf("VerifySHA256() = %v", err)
+	}
+	if err := VerifySHA256(isoPath, testSum); err == nil {
+		t.Error("VerifySHA256() accepted the wrong checksum")
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	partialSuffix       = ".part"
+	validatorSuffix     = ".validator"
+	maxDownloadAttempts = 5
+	progressStep        = 10               // percent
+	progressStepUnknown = 10 * 1024 * 1024 // bytes, when the size isn't known
+)
+
+// permanentError is a download failure retrying won't fix.
+type permanentError struct {
+	error
+}
+
+// progressWriter logs download progress through libmachine's log.
+type progressWriter struct {
+	name     string
+	written  int64
+	total    int64
+	reported int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+
+	if p.total > 0 {
+		percent := p.written * 100 / p.total
+		if percent >= p.reported+progressStep || (percent == 100 && p.reported < 100) {
+			p.reported = percent - percent%progressStep
+			log.Infof("Downloading %s: %d%%", p.name, percent)
+		}
+	} else if p.written >= p.reported+progressStepUnknown {
+		p.reported = p.written - p.written%progressStepUnknown
+		log.Infof("Downloading %s: %d MB", p.name, p.written/(1024*1024))
+	}
+
+	return len(b), nil
+}
+
+// parseContentRange returns the start and total size from a "bytes start-end/total"
+// or "bytes */total" Content-Range, total being -1 if unknown.
+func parseContentRange(contentRange string) (int64, int64, error) {
+	spec := strings.TrimPrefix(contentRange, "bytes ")
+	slash := strings.Index(spec, "/")
+	if spec == contentRange || slash < 0 {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", contentRange)
+	}
+
+	total := int64(-1)
+	if spec[slash+1:] != "*" {
+		t, err := strconv.ParseInt(spec[slash+1:], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q", contentRange)
+		}
+		total = t
+	}
+
+	if spec[:slash] == "*" {
+		return 0, total, nil
+	}
+	start, err := strconv.ParseInt(strings.SplitN(spec[:slash], "-", 2)[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", contentRange)
+	}
+
+	return start, total, nil
+}
+
+// responseValidator returns the strong ETag, or else the Last-Modified date, of rsp for
+// If-Range.
+func responseValidator(rsp *http.Response) string {
+	if etag := rsp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return rsp.Header.Get("Last-Modified")
+}
+
+// readValidator returns the validator saved with a partial download, if any.
+func readValidator(part string) string {
+	data, err := ioutil.ReadFile(part + validatorSuffix)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// downloadAttempt downloads isoURL into part, resuming from whatever part already has.
+// Resuming sends If-Range with the validator saved when the download started, so a file
+// changed in between is sent whole instead of appended to the old one.
+func downloadAttempt(ctx context.Context, isoURL string, part string) error {
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+	validator := readValidator(part)
+	if offset > 0 && validator == "" {
+		log.Debugf("Can't check %s is unchanged, restarting its download", isoURL)
+		offset = 0
+	}
+
+	req, err := getRequest(isoURL)
+	if err != nil {
+		return permanentError{err}
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		log.Debugf("Resuming download of %s at %d bytes", isoURL, offset)
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		req.Header.Set("If-Range", validator)
+	}
+
+	rsp, err := getClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	total := int64(-1)
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		// no resume support, nothing to resume or the file changed
+		if offset > 0 {
+			log.Debugf("Server sent all of %s, restarting its download", isoURL)
+		}
+		offset = 0
+		flags |= os.O_TRUNC
+		if rsp.ContentLength >= 0 {
+			total = rsp.ContentLength
+		}
+		if err := ioutil.WriteFile(part+validatorSuffix, []byte(responseValidator(rsp)+"\n"), 0644); err != nil {
+			return permanentError{err}
+		}
+	case http.StatusPartialContent:
+		start, t, err := parseContentRange(rsp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != offset {
+			return fmt.Errorf("asked to resume at %d, got %d", offset, start)
+		}
+		flags |= os.O_APPEND
+		total = t
+	case http.StatusRequestedRangeNotSatisfiable:
+		_, t, err := parseContentRange(rsp.Header.Get("Content-Range"))
+		if err == nil && t == offset {
+			// already complete
+			return nil
+		}
+		// the partial download doesn't fit what's there now, start over
+		if err := os.Remove(part); err != nil {
+			return permanentError{err}
+		}
+		_ = os.Remove(part + validatorSuffix)
+		return fmt.Errorf("partial download of %s is stale", isoURL)
+	default:
+		err := fmt.Errorf("failed to download %s: %s", isoURL, rsp.Status)
+		if rsp.StatusCode < http.StatusInternalServerError {
+			return permanentError{err}
+		}
+		return err
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	progress := &progressWriter{name: filepath.Base(isoURL), written: offset, total: total}
+	if total > 0 {
+		// don't repeat what was reported before resuming
+		progress.reported = offset * 100 / total
+		progress.reported -= progress.reported % progressStep
+	}
+	_, copyErr := io.Copy(io.MultiWriter(f, progress), rsp.Body)
+	if err := f.Close(); err != nil {
+		return permanentError{err}
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+
+	if total >= 0 && progress.written != total {
+		return fmt.Errorf("download of %s ended at %d of %d bytes", isoURL, progress.written, total)
+	}
+
+	return nil
+}
+
+// copyLocalISO copies a local ISO to dest through a temporary file.
+func copyLocalISO(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := io.Copy(tmpfile, in); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile.Name(), dest)
+}
+
+// DownloadISO downloads isoURL to dir/file. The download goes to a partial file which is
+// resumed with HTTP range requests if the connection drops, and is only renamed into place
+// once complete. It gives up after FetchTimeout, if that is set.
+func (b *B2dUtils) DownloadISO(dir, file, isoURL string) error {
+	dest := filepath.Join(dir, file)
+
+	u, err := url.Parse(isoURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "file" || u.Scheme == "" {
+		log.Infof("Copying %s to %s...", u.Path, dest)
+		return copyLocalISO(u.Path, dest)
+	}
+
+	ctx := context.Background()
+	if b.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.FetchTimeout)
+		defer cancel()
+	}
+
+	log.Infof("Downloading %s to %s...", isoURL, dest)
+	part := dest + partialSuffix
+	for attempt := 1; ; attempt++ {
+		err = downloadAttempt(ctx, isoURL, part)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("download of %s timed out after %s", isoURL, b.FetchTimeout)
+		}
+		if perr, ok := err.(permanentError); ok {
+			return perr.error
+		}
+		if attempt == maxDownloadAttempts {
+			return err
+		}
+
+		log.Warnf("Download of %s interrupted, retrying: %s", isoURL, err)
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("download of %s timed out after %s", isoURL, b.FetchTimeout)
+		}
+	}
+
+	_ = os.Remove(part + validatorSuffix)
+	return os.Rename(part, dest)
+}
@@ -0,0 +1,234 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header    string
+		wantStart int64
+		wantTotal int64
+		wantErr   bool
+	}{
+		{"bytes 100-199/200", 100, 200, false},
+		{"bytes 100-199/*", 100, -1, false},
+		{"bytes */200", 0, 200, false},
+		{"100-199/200", 0, 0, true},
+		{"bytes 100-199", 0, 0, true},
+		{"bytes x-199/200", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		start, total, err := parseContentRange(tt.header)
+		if start != tt.wantStart || total != tt.wantTotal || (err != nil) != tt.wantErr {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v", tt.header, start, total, err)
+		}
+	}
+}
+
+// flakyServer serves the ISO from isos, the current one being the last, with ETags and
+// range support. The first request's connection is dropped halfway through the body.
+type flakyServer struct {
+	isos     [][]byte
+	requests []*http.Request
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests = append(s.requests, r)
+	iso := s.isos[len(s.isos)-1]
+	etag := `"` + strconv.Itoa(len(s.isos)) + `"`
+
+	if len(s.requests) == 1 {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(iso)))
+		_, _ = w.Write(iso[:len(iso)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "boot2docker.iso", time.Time{}, bytes.NewReader(iso))
+}
+
+func testDownload(t *testing.T, server *flakyServer) []byte {
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewB2dUtils(dir)
+	if err := b.DownloadISO(dir, "boot2docker.iso", ts.URL+"/boot2docker.iso"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, leftover := range []string{"boot2docker.iso" + partialSuffix, "boot2docker.iso" + partialSuffix + validatorSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, leftover)); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", leftover)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "boot2docker.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDownloadISOResumes(t *testing.T) {
+	iso := bytes.Repeat([]byte("boot2docker"), 1000)
+	server := &flakyServer{isos: [][]byte{iso}}
+
+	if data := testDownload(t, server); !bytes.Equal(data, iso) {
+		t.Errorf("downloaded %d bytes, want the %d byte ISO", len(data), len(iso))
+	}
+
+	if len(server.requests) != 2 {
+		t.Fatalf("made %d requests, want 2", len(server.requests))
+	}
+	resumed := server.requests[1]
+	if got := resumed.Header.Get("Range"); got != "bytes="+strconv.Itoa(len(iso)/2)+"-" {
+		t.Errorf("resumed with Range %q", got)
+	}
+	if got := resumed.Header.Get("If-Range"); got != `"1"` {
+		t.Errorf("resumed with If-Range %q", got)
+	}
+}
+
+func TestDownloadISORestartsChangedFile(t *testing.T) {
+	old := bytes.Repeat([]byte("old"), 1000)
+	changed := bytes.Repeat([]byte("new"), 1200)
+	server := &flakyServer{isos: [][]byte{old}}
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the first attempt is dropped, then the ISO is replaced before the next one
+	part := filepath.Join(dir, "boot2docker.iso"+partialSuffix)
+	if err := downloadAttempt(context.Background(), ts.URL+"/boot2docker.iso", part); err == nil {
+		t.Fatal("the dropped connection wasn't noticed")
+	}
+	server.isos = append(server.isos, changed)
+	if err := downloadAttempt(context.Background(), ts.URL+"/boot2docker.iso", part); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, changed) {
+		t.Errorf("downloaded %d bytes, want the %d byte changed ISO", len(data), len(changed))
+	}
+}
+
+func TestDownloadISOWithoutValidator(t *testing.T) {
+	iso := bytes.Repeat([]byte("boot2docker"), 1000)
+	var requests []*http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		_, _ = w.Write(iso)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a partial download from before validators were saved can't be resumed safely
+	part := filepath.Join(dir, "boot2docker.iso"+partialSuffix)
+	if err := ioutil.WriteFile(part, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := downloadAttempt(context.Background(), ts.URL+"/boot2docker.iso", part); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 || requests[0].Header.Get("Range") != "" {
+		t.Errorf("resumed a download without a validator")
+	}
+	if data, _ := ioutil.ReadFile(part); !bytes.Equal(data, iso) {
+		t.Errorf("downloaded %d bytes, want the %d byte ISO", len(data), len(iso))
+	}
+}
+
+func TestDownloadISOTimeout(t *testing.T) {
+	iso := bytes.Repeat([]byte("boot2docker"), 1000)
+	var requests []*http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		w.Header().Set("ETag", `"1"`)
+		if len(requests) > 1 {
+			http.ServeContent(w, r, "boot2docker.iso", time.Time{}, bytes.NewReader(iso))
+			return
+		}
+
+		// send half the ISO, then stall until the client gives up
+		w.Header().Set("Content-Length", strconv.Itoa(len(iso)))
+		_, _ = w.Write(iso[:len(iso)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewB2dUtils(dir)
+	b.FetchTimeout = 200 * time.Millisecond
+	started := time.Now()
+	if err := b.DownloadISO(dir, "boot2docker.iso", ts.URL+"/boot2docker.iso"); err == nil {
+		t.Fatal("a stalled download didn't time out")
+	}
+	if elapsed := time.Since(started); elapsed > b.FetchTimeout+2*time.Second {
+		t.Errorf("gave up after %s, FetchTimeout is %s", elapsed, b.FetchTimeout)
+	}
+
+	part := filepath.Join(dir, "boot2docker.iso"+partialSuffix)
+	if data, err := ioutil.ReadFile(part); err != nil || !bytes.Equal(data, iso[:len(iso)/2]) {
+		t.Fatalf("partial download has %d bytes (%v), want %d", len(data), err, len(iso)/2)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "boot2docker.iso")); !os.IsNotExist(err) {
+		t.Error("the partial download was renamed into place")
+	}
+
+	// the next download picks up where the stalled one stopped
+	b.FetchTimeout = 0
+	if err := b.DownloadISO(dir, "boot2docker.iso", ts.URL+"/boot2docker.iso"); err != nil {
+		t.Fatal(err)
+	}
+	if got := requests[len(requests)-1].Header.Get("Range"); got != "bytes="+strconv.Itoa(len(iso)/2)+"-" {
+		t.Errorf("resumed with Range %q", got)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "boot2docker.iso")); !bytes.Equal(data, iso) {
+		t.Errorf("downloaded %d bytes, want the %d byte ISO", len(data), len(iso))
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/versioncmp"
+)
+
+var errEmptyIndex = errors.New("image index lists no releases")
+
+// indexRelease is a release listed in an image index.
+type indexRelease struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256"`
+}
+
+// releaseIndex is a JSON image index, as served by a mirror:
+//
+//	{
+//	    "latest": "v19.03.5",
+//	    "releases": [
+//	        {"version": "v19.03.5", "url": "v19.03.5/boot2docker.iso", "sha256": "..."}
+//	    ]
+//	}
+//
+// Relative release URLs are resolved against the index URL. Without "latest", the
+// highest version is the latest.
+type releaseIndex struct {
+	Latest   string         `json:"latest"`
+	Releases []indexRelease `json:"releases"`
+}
+
+// indexReleaseGetter implements the releaseGetter interface for releases listed in an
+// image index at an HTTP(S) or file:// URL.
+type indexReleaseGetter struct {
+	isoFilename string
+	indexURL    string
+	index       *releaseIndex
+}
+
+func (g *indexReleaseGetter) Filename() string {
+	if g == nil {
+		return ""
+	}
+	return g.isoFilename
+}
+
+func openIndex(indexURL *url.URL) (io.ReadCloser, error) {
+	if indexURL.Scheme == "file" {
+		return os.Open(indexURL.Path)
+	}
+
+	client := getClient()
+	req, err := getRequest(indexURL.String())
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		rsp.Body.Close()
+		return nil, fmt.Errorf("failed to get image index %s: %s", indexURL, rsp.Status)
+	}
+
+	return rsp.Body, nil
+}
+
+// load fetches the index once and resolves its release URLs.
+func (g *indexReleaseGetter) load() (*releaseIndex, error) {
+	if g.index != nil {
+		return g.index, nil
+	}
+
+	base, err := url.Parse(g.indexURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" && base.Scheme != "file" {
+		return nil, fmt.Errorf("unsupported image index URL %s", g.indexURL)
+	}
+
+	body, err := openIndex(base)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	index := &releaseIndex{}
+	if err := json.NewDecoder(body).Decode(index); err != nil {
+		return nil, fmt.Errorf("failed to parse image index %s: %s", g.indexURL, err)
+	}
+	if len(index.Releases) == 0 {
+		return nil, errEmptyIndex
+	}
+
+	for i, release := range index.Releases {
+		if release.Version == "" || release.URL == "" {
+			return nil, fmt.Errorf("image index release %d needs a version and a url", i)
+		}
+		if release.SHA256 != "" && !ValidSHA256(release.SHA256) {
+			return nil, fmt.Errorf("image index release %s has an invalid sha256", release.Version)
+		}
+		ref, err := url.Parse(release.URL)
+		if err != nil {
+			return nil, err
+		}
+		index.Releases[i].URL = base.ResolveReference(ref).String()
+	}
+
+	g.index = index
+	return index, nil
+}
+
+// latest returns the release the index names as latest, or the highest version.
+func (g *indexReleaseGetter) latest() (indexRelease, error) {
+	index, err := g.load()
+	if err != nil {
+		return indexRelease{}, err
+	}
+
+	if index.Latest != "" {
+		for _, release := range index.Releases {
+			if release.Version == index.Latest {
+				return release, nil
+			}
+		}
+		return indexRelease{}, fmt.Errorf("image index latest release %s is not listed", index.Latest)
+	}
+
+	latest := index.Releases[0]
+	for _, release := range index.Releases[1:] {
+		if versioncmp.GreaterThan(strings.TrimPrefix(release.Version, "v"), strings.TrimPrefix(latest.Version, "v")) {
+			latest = release
+		}
+	}
+	return latest, nil
+}
+
+// getReleaseTag gets the latest version in the index, apiURL is ignored.
+func (g *indexReleaseGetter) getReleaseTag(apiURL string) (string, error) {
+	release, err := g.latest()
+	if err != nil {
+		return "", err
+	}
+	return release.Version, nil
+}
+
+// GetReleaseURL gets the download URL of the latest release in the index if apiURL is
+// empty, otherwise apiURL is a direct download.
+func (g *indexReleaseGetter) GetReleaseURL(apiURL string) (string, error) {
+	if apiURL != "" {
+		return apiURL, nil
+	}
+
+	release, err := g.latest()
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("Latest release in %s is %s", g.indexURL, release.Version)
+	return release.URL, nil
+}
+
+// GetVersionURL gets the download URL the index lists for version.
+func (g *indexReleaseGetter) GetVersionURL(version string) (string, error) {
+	index, err := g.load()
+	if err != nil {
+		return "", err
+	}
+
+	for _, release := range index.Releases {
+		if release.Version == version {
+			return release.URL, nil
+		}
+	}
+	return "", ErrUnknownVersion
+}
+
+// GetChecksum gets the SHA-256 the index lists for downloadURL.
+func (g *indexReleaseGetter) GetChecksum(downloadURL string) (string, error) {
+	index, err := g.load()
+	if err != nil {
+		return "", err
+	}
+
+	for _, release := range index.Releases {
+		if release.URL == downloadURL && release.SHA256 != "" {
+			return strings.ToLower(release.SHA256), nil
+		}
+	}
+	return "", ErrNoChecksum
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// indexServer serves an image index at /mirror/index.json
+func indexServer(index string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mirror/index.json" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(index))
+	}))
+}
+
+const testIndex = `{
+    "releases": [
+        {"version": "v19.03.5", "url": "v19.03.5/boot2docker.iso", "sha256": "` + testSum + `"},
+        {"version": "v18.09.9", "url": "https://example.com/v18.09.9/boot2docker.iso"}
+    ]
+}`
+
+func TestIndexReleaseGetter(t *testing.T) {
+	server := indexServer(testIndex)
+	defer server.Close()
+
+	getter := &indexReleaseGetter{isoFilename: defaultISOFilename, indexURL: server.URL + "/mirror/index.json"}
+
+	latest, err := getter.GetReleaseURL("")
+	if err != nil || latest != server.URL+"/mirror/v19.03.5/boot2docker.iso" {
+		t.Errorf("GetReleaseURL() = %s, %v", latest, err)
+	}
+	if tag, err := getter.getReleaseTag(""); err != nil || tag != "v19.03.5" {
+		t.Errorf("getReleaseTag() = %s, %v", tag, err)
+	}
+
+	versionURL, err := getter.GetVersionURL("v18.09.9")
+	if err != nil || versionURL != "https://example.com/v18.09.9/boot2docker.iso" {
+		t.Errorf("GetVersionURL() = %s, %v", versionURL, err)
+	}
+	if _, err := getter.GetVersionURL("v17.06.0"); err != ErrUnknownVersion {
+		t.Errorf("GetVersionURL() of a version not listed = %v", err)
+	}
+
+	if sum, err := getter.GetChecksum(latest); err != nil || sum != testSum {
+		t.Errorf("GetChecksum() = %s, %v", sum, err)
+	}
+	if _, err := getter.GetChecksum(versionURL); err != ErrNoChecksum {
+		t.Errorf("GetChecksum() of a release without a checksum = %v", err)
+	}
+}
+
+func TestIndexLatest(t *testing.T) {
+	tests := []struct {
+		name    string
+		index   string
+		want    string
+		wantErr bool
+	}{
+		{"named latest", `{"latest": "v18.09.9", "releases": [{"version": "v19.03.5", "url": "a.iso"}, {"version": "v18.09.9", "url": "b.iso"}]}`, "v18.09.9", false},
+		{"highest version", `{"releases": [{"version": "v18.09.9", "url": "a.iso"}, {"version": "v19.03.5", "url": "b.iso"}]}`, "v19.03.5", false},
+		{"latest not listed", `{"latest": "v20.10.0", "releases": [{"version": "v19.03.5", "url": "a.iso"}]}`, "", true},
+		{"empty", `{"releases": []}`, "", true},
+		{"missing url", `{"releases": [{"version": "v19.03.5"}]}`, "", true},
+		{"bad checksum", `{"releases": [{"version": "v19.03.5", "url": "a.iso", "sha256": "abc"}]}`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := indexServer(tt.index)
+			defer server.Close()
+
+			getter := &indexReleaseGetter{isoFilename: defaultISOFilename, indexURL: server.URL + "/mirror/index.json"}
+			tag, err := getter.getReleaseTag("")
+			if tag != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("getReleaseTag() = %q, %v, want %q, error %t", tag, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
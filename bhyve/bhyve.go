@@ -6,18 +6,21 @@ package bhyve
 
 import (
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/engine"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
 	"github.com/docker/machine/libmachine/state"
+	"gitlab.mouf.net/swills/docker-machine-driver-bhyve/b2d"
 )
 
 const (
@@ -34,30 +37,101 @@ const (
 	isoFilename           = "boot2docker.iso"
 	diskname              = "guest.img"
 	defaultBhyveVMName    = ""
+	defaultDNSDomain      = "docker-machine.local"
+	defaultSubnet6        = "fd00:99::1/64"
+	firstExtraSlot        = 6
+	maxSlot               = 31
+	ipv6Tries             = 5
 )
 
+var b2dVersionRegex = regexp.MustCompile(`^v\d+\.\d+\.\d+$`)
+
 type Driver struct {
 	*drivers.BaseDriver
-	EnginePort     int
-	DiskSize       int64
-	MemSize        int64
-	CPUcount       int
-	NetDev         string
-	MACAddress     string
-	Bridge         string
-	DHCPRange      string
-	NMDMDev        string
-	Boot2DockerURL string
-	Subnet         string
-	BhyveVMName    string
+	EnginePort      int
+	DiskSize        int64
+	MemSize         int64
+	CPUcount        int
+	NetDev          string
+	MACAddress      string
+	Bridge          string
+	DHCPRange       string
+	NMDMDev         string
+	Boot2DockerURL  string
+	Subnet          string
+	BhyveVMName     string
+	StaticIP        string
+	EnableDNS       bool
+	DNSDomain       string
+	EnableIPv6      bool
+	Subnet6         string
+	PreferIPv6      bool
+	NICs            []NIC
+	NetworkBackend  string
+	ValeSwitch      string
+	Shares          []Share
+	ShareMode       string
+	B2DVersion      string
+	Offline         bool
+	ISOSHA256       string
+	SkipChecksum    bool
+	ImageIndexURL   string
+	FetchTimeout    int
+	Image           string
+	Bootsync        string
+	Bootlocal       string
+	Profile         string
+	CACerts         []string
+	RegistryMirrors []string
+	HTTPProxy       string
+	HTTPSProxy      string
+	NoProxy         string
+	Privilege       string
+	DryRun          bool `json:"-"`
 }
 
 func (d *Driver) Create() error {
-	if err := copyIsoToMachineDir(d.StorePath, d.Boot2DockerURL, d.MachineName); err != nil {
-		return err
+	setPrivilege(d.Privilege)
+
+	return d.withDryRun("create", d.create)
+}
+
+func (d *Driver) create() error {
+	if d.Image != "" {
+		err := runner.do("download "+d.Image+" to "+d.ResolveStorePath(diskname), func() error {
+			return copyCloudImage(d.StorePath, d.Image, d.ResolveStorePath(diskname), d.DiskSize,
+				time.Duration(d.FetchTimeout)*time.Second)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = runner.do("write "+d.ResolveStorePath(seedFilename), func() error {
+			return generateSeedImage(d.GetSSHKeyPath(), d.ResolveStorePath(seedFilename), d.MachineName,
+				d.GetSSHUsername(), d.proxySettings(), d.CACerts)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		err := runner.do("copy boot2docker.iso to "+d.ResolveStorePath(""), func() error {
+			isosum, err := copyIsoToMachineDir(d.StorePath, d.isoOptions(), d.MachineName)
+			d.ISOSHA256 = isosum
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = runner.do("write "+d.ResolveStorePath(diskname), func() error {
+			return generateRawDiskImage(d.GetSSHKeyPath(), d.ResolveStorePath(diskname), d.DiskSize, d.userdataOptions())
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	if err := generateRawDiskImage(d.GetSSHKeyPath(), d.ResolveStorePath(diskname), d.DiskSize); err != nil {
+	if err := writeDHCPHost(d.dhcpDir(), d.MachineName, d.MACAddress, d.StaticIP); err != nil {
 		return err
 	}
 
@@ -66,6 +140,15 @@ func (d *Driver) Create() error {
 		return err
 	}
 
+	if d.Image == "" {
+		err := runner.do("install the userdata in "+d.MachineName+" over SSH", func() error {
+			return installUserdata(d, d.userdataOptions())
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -116,6 +199,162 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "URL for boot2docker.iso",
 			EnvVar: "BHYVE_BOOT2DOCKERURL",
 		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-image",
+			Usage:  "URL or path of a raw cloud image to boot with cloud-init instead of boot2docker",
+			EnvVar: "BHYVE_IMAGE",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-bootsync",
+			Usage:  "Script to install as boot2docker's bootsync.sh, run before docker starts",
+			EnvVar: "BHYVE_BOOTSYNC",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-bootlocal",
+			Usage:  "Script to install as boot2docker's bootlocal.sh, run after boot",
+			EnvVar: "BHYVE_BOOTLOCAL",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-profile",
+			Usage:  "File to add to boot2docker's profile, e.g. to set EXTRA_ARGS",
+			EnvVar: "BHYVE_PROFILE",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "bhyve-ca-cert",
+			Usage:  "CA certificate, or directory of .pem and .crt files, for the guest to trust",
+			EnvVar: "BHYVE_CA_CERT",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "bhyve-registry-mirror",
+			Usage:  "Registry mirror URL for the guest's Docker daemon",
+			EnvVar: "BHYVE_REGISTRY_MIRROR",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-http-proxy",
+			Usage:  "HTTP proxy for the guest, defaults to the host's HTTP_PROXY",
+			EnvVar: "BHYVE_HTTP_PROXY",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-https-proxy",
+			Usage:  "HTTPS proxy for the guest, defaults to the host's HTTPS_PROXY",
+			EnvVar: "BHYVE_HTTPS_PROXY",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-no-proxy",
+			Usage:  "Hosts the guest should reach directly, defaults to the host's NO_PROXY",
+			EnvVar: "BHYVE_NO_PROXY",
+		},
+		mcnflag.BoolFlag{
+			Name:   "bhyve-no-host-proxy",
+			Usage:  "Don't pass the host's proxy environment to the guest",
+			EnvVar: "BHYVE_NO_HOST_PROXY",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-privilege",
+			Usage:  "How to run commands as root: auto, none (already root), sudo or doas",
+			Value:  privilegeAuto,
+			EnvVar: "BHYVE_PRIVILEGE",
+		},
+		mcnflag.BoolFlag{
+			Name:   "bhyve-dry-run",
+			Usage:  "Print the commands create would run, in order, without running them",
+			EnvVar: "BHYVE_DRY_RUN",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-image-index-url",
+			Usage:  "URL of a JSON image index to get boot2docker releases from instead of GitHub",
+			EnvVar: "BHYVE_IMAGE_INDEX_URL",
+		},
+		mcnflag.IntFlag{
+			Name:   "bhyve-download-timeout",
+			Usage:  "Give up downloading boot2docker.iso after this many seconds, 0 for no limit",
+			EnvVar: "BHYVE_DOWNLOAD_TIMEOUT",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-boot2docker-version",
+			Usage:  "Use this boot2docker version from the ISO cache, e.g. v19.03.5",
+			EnvVar: "BHYVE_BOOT2DOCKER_VERSION",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-boot2docker-sha256",
+			Usage:  "Expected SHA-256 of boot2docker.iso",
+			EnvVar: "BHYVE_BOOT2DOCKER_SHA256",
+		},
+		mcnflag.BoolFlag{
+			Name:   "bhyve-skip-checksum",
+			Usage:  "Use a boot2docker.iso with no published or given SHA-256 without verifying it",
+			EnvVar: "BHYVE_SKIP_CHECKSUM",
+		},
+		mcnflag.BoolFlag{
+			Name:   "bhyve-offline",
+			Usage:  "Use the cached boot2docker.iso without checking for updates",
+			EnvVar: "BHYVE_OFFLINE",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-ip",
+			Usage:  "Static IP address to reserve for the machine",
+			EnvVar: "BHYVE_IP",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-mac",
+			Usage:  "MAC address for the machine, derived from the machine name by default",
+			EnvVar: "BHYVE_MAC",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "bhyve-nic",
+			Usage:  "Additional NIC as bridge=<bridge> or vale=<switch>[,mac=<mac>][,model=virtio-net|e1000], may be repeated",
+			EnvVar: "BHYVE_NIC",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-network-backend",
+			Usage:  "Attach the machine to a tap on the bridge or to a VALE switch (bridge or vale)",
+			EnvVar: "BHYVE_NETWORK_BACKEND",
+			Value:  networkBackendBridge,
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-vale-switch",
+			Usage:  "Name of VALE switch",
+			EnvVar: "BHYVE_VALE_SWITCH",
+			Value:  defaultValeSwitch,
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "bhyve-share",
+			Usage:  "Share a host directory as hostpath:tag[:ro], mounted at the same path in the guest, may be repeated",
+			EnvVar: "BHYVE_SHARE",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-share-mode",
+			Usage:  "How to share host directories, 9p or nfs for guests without 9p support",
+			EnvVar: "BHYVE_SHARE_MODE",
+			Value:  shareMode9P,
+		},
+		mcnflag.BoolFlag{
+			Name:   "bhyve-dns",
+			Usage:  "Serve DNS for machines on the bridge",
+			EnvVar: "BHYVE_DNS",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-dns-domain",
+			Usage:  "DNS domain for machine names",
+			EnvVar: "BHYVE_DNS_DOMAIN",
+			Value:  defaultDNSDomain,
+		},
+		mcnflag.BoolFlag{
+			Name:   "bhyve-ipv6",
+			Usage:  "Enable IPv6 on the bridge",
+			EnvVar: "BHYVE_IPV6",
+		},
+		mcnflag.StringFlag{
+			Name:   "bhyve-subnet6",
+			Usage:  "IPv6 subnet to use",
+			EnvVar: "BHYVE_SUBNET6",
+			Value:  defaultSubnet6,
+		},
+		mcnflag.BoolFlag{
+			Name:   "bhyve-prefer-ipv6",
+			Usage:  "Use the machine's IPv6 address for SSH and the Docker URL",
+			EnvVar: "BHYVE_PREFER_IPV6",
+		},
 	}
 }
 
@@ -136,7 +375,7 @@ func (d *Driver) GetIP() (string, error) {
 	}
 
 	log.Debugf("getting IP from DHCP lease")
-	ip, err := getIPfromDHCPLease(filepath.Join(d.StorePath, "bhyve.leases"), d.MACAddress)
+	ip, err := d.lookupIP()
 	if err != nil {
 		return "", err
 	}
@@ -144,6 +383,27 @@ func (d *Driver) GetIP() (string, error) {
 	return ip, nil
 }
 
+// lookupIP returns the machine's IPv4 address or, with --bhyve-prefer-ipv6, its IPv6
+// address if it has one yet, falling back to IPv4 so the machine can still be reached
+func (d *Driver) lookupIP() (string, error) {
+	ip, err := getIPfromDHCPLease(filepath.Join(dhcpRunDir(d.dhcpDir()), dhcpLeaseFilename), d.MACAddress, false)
+	if err != nil || !d.PreferIPv6 {
+		return ip, err
+	}
+
+	for tries := 0; tries < ipv6Tries; tries++ {
+		ip6, err := getIPv6(d.dhcpDir(), d.MACAddress, d.Subnet6)
+		if err == nil {
+			return ip6, nil
+		}
+		log.Debugf("No IPv6 address yet %d/%d: %s", tries+1, ipv6Tries, err)
+		time.Sleep(time.Second)
+	}
+
+	log.Warnf("Couldn't find an IPv6 address for %s, using %s", d.MachineName, ip)
+	return ip, nil
+}
+
 func (d *Driver) GetSSHHostname() (string, error) {
 	return d.GetIP()
 }
@@ -161,10 +421,16 @@ func (d *Driver) GetURL() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("tcp://%s:2376", ip), nil
+	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, "2376")), nil
 }
 
 func (d *Driver) Kill() error {
+	setPrivilege(d.Privilege)
+
+	return d.withDryRun("kill", d.kill)
+}
+
+func (d *Driver) kill() error {
 	if err := destroyVM(d.BhyveVMName); err != nil {
 		return err
 	}
@@ -175,6 +441,16 @@ func (d *Driver) Kill() error {
 		}
 	}
 
+	for i := range d.NICs {
+		if d.NICs[i].NetDev == "" {
+			continue
+		}
+		if err := destroyTap(d.NICs[i].NetDev); err != nil {
+			return err
+		}
+		d.NICs[i].NetDev = ""
+	}
+
 	if err := killConsoleLogger(d.ResolveStorePath("nmdm.pid")); err != nil {
 		return err
 	}
@@ -185,12 +461,22 @@ func (d *Driver) Kill() error {
 }
 
 func (d *Driver) PreCreateCheck() error {
-	err := checkRequireKmods()
+	setPrivilege(d.Privilege)
+
+	// a dry run carries on to show what create would do
+	if err := d.withDryRun("the pre-create check", d.preCreateCheck); err != errDryRun {
+		return err
+	}
+	return nil
+}
+
+func (d *Driver) preCreateCheck() error {
+	p, err := d.preflight()
 	if err != nil {
 		return err
 	}
 
-	err = checkRequiredCommands()
+	err = p.run()
 	if err != nil {
 		return err
 	}
@@ -207,33 +493,118 @@ func (d *Driver) PreCreateCheck() error {
 		return err
 	}
 
-	err = setupnet(d.Bridge, d.Subnet)
+	err = privileged("setup-net", d.hostInterface(), d.Subnet, d.valeSwitch())
 	if err != nil {
 		return err
 	}
 
-	err = startDHCPServer(d.StorePath, d.Bridge, d.DHCPRange)
+	for _, nic := range d.NICs {
+		if nic.Bridge == "" {
+			continue
+		}
+		err = privileged("ensure-bridge", nic.Bridge)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.EnableIPv6 {
+		err = ensureIP6ForwardingEnabled()
+		if err != nil {
+			return err
+		}
+
+		err = privileged("setup-net6", d.hostInterface(), d.Subnet6)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = startDHCPServer(d.StorePath, d.dhcpDir(), d.hostInterface(), d.DHCPRange, d.dnsDomain(), d.EnableIPv6)
 	if err != nil {
 		return err
 	}
+
+	if d.EnableDNS {
+		resolverconffile, err := writeResolverConf(d.dhcpDir(), d.DNSDomain, d.Subnet)
+		if err != nil {
+			return err
+		}
+		log.Infof("To resolve %s.%s from this host, copy %s to /var/unbound/conf.d/ and restart local_unbound",
+			d.MachineName, d.DNSDomain, resolverconffile)
+	}
 	return nil
 }
 
 func (d *Driver) Remove() error {
+	setPrivilege(d.Privilege)
+
+	return d.withDryRun("remove", d.remove)
+}
+
+func (d *Driver) remove() error {
 	err := d.Kill()
 	if err != nil {
 		log.Debugf("Failed to kill %s, perhaps already dead?", d.MachineName)
 	}
 
-	err = os.RemoveAll(d.ResolveStorePath(diskname))
+	for _, filename := range []string{diskname, seedFilename} {
+		path := d.ResolveStorePath(filename)
+		err = runner.do("remove "+path, func() error {
+			return os.RemoveAll(path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = removeDHCPHost(d.dhcpDir(), d.MachineName)
+	if err != nil {
+		return err
+	}
+
+	err = runner.do("remove "+d.MachineName+" from the ISO cache manifest", func() error {
+		return b2d.NewB2dUtils(d.StorePath).RemoveReference(d.MachineName)
+	})
+	if err != nil {
+		return err
+	}
+
+	if d.ShareMode == shareModeNFS {
+		err = privileged("unexport-shares", d.MachineName)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.stopDHCPServerIfUnused()
 	if err != nil {
 		return err
 	}
 
+	if d.NetworkBackend == networkBackendVale {
+		inuse, err := valeSwitchInUse(d.StorePath, d.MachineName, d.ValeSwitch)
+		if err != nil {
+			return err
+		}
+		if !inuse {
+			err = privileged("destroy-vale-host-port", d.ValeSwitch, d.hostInterface())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
 func (d *Driver) Restart() error {
+	setPrivilege(d.Privilege)
+
+	return d.withDryRun("restart", d.restart)
+}
+
+func (d *Driver) restart() error {
 	s, err := d.GetState()
 	if err != nil {
 		return err
@@ -252,29 +623,229 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.DiskSize = int64(flags.Int("bhyve-disk-size")) * 1024 * 1024
 	d.CPUcount = int(flags.Int("bhyve-cpus"))
 	d.MemSize = int64(flags.Int("bhyve-mem-size"))
-	d.MACAddress = generateMACAddress()
 	d.SSHUser = "docker"
 	d.Bridge = string(flags.String("bhyve-bridge"))
 	d.Subnet = string(flags.String("bhyve-subnet"))
 	d.DHCPRange = string(flags.String("bhyve-dhcprange"))
 	d.Boot2DockerURL = flags.String("bhyve-boot2docker-url")
+	d.ImageIndexURL = flags.String("bhyve-image-index-url")
+	d.FetchTimeout = flags.Int("bhyve-download-timeout")
+	d.Image = flags.String("bhyve-image")
+	d.Bootsync = flags.String("bhyve-bootsync")
+	d.Bootlocal = flags.String("bhyve-bootlocal")
+	d.Profile = flags.String("bhyve-profile")
+	d.CACerts = flags.StringSlice("bhyve-ca-cert")
+	d.RegistryMirrors = flags.StringSlice("bhyve-registry-mirror")
+	d.HTTPProxy = flags.String("bhyve-http-proxy")
+	d.HTTPSProxy = flags.String("bhyve-https-proxy")
+	d.NoProxy = flags.String("bhyve-no-proxy")
+	if !flags.Bool("bhyve-no-host-proxy") {
+		if d.HTTPProxy == "" {
+			d.HTTPProxy = hostProxyEnv("HTTP_PROXY")
+		}
+		if d.HTTPSProxy == "" {
+			d.HTTPSProxy = hostProxyEnv("HTTPS_PROXY")
+		}
+		if d.NoProxy == "" {
+			d.NoProxy = hostProxyEnv("NO_PROXY")
+		}
+	}
+	d.DryRun = flags.Bool("bhyve-dry-run")
+	d.Privilege = flags.String("bhyve-privilege")
+	if err := validatePrivilege(d.Privilege); err != nil {
+		return err
+	}
+	d.B2DVersion = flags.String("bhyve-boot2docker-version")
+	d.Offline = flags.Bool("bhyve-offline")
+	d.ISOSHA256 = strings.ToLower(flags.String("bhyve-boot2docker-sha256"))
+	d.SkipChecksum = flags.Bool("bhyve-skip-checksum")
+	d.StaticIP = flags.String("bhyve-ip")
+	d.EnableDNS = flags.Bool("bhyve-dns")
+	d.DNSDomain = flags.String("bhyve-dns-domain")
+	d.EnableIPv6 = flags.Bool("bhyve-ipv6")
+	d.Subnet6 = flags.String("bhyve-subnet6")
+	d.PreferIPv6 = flags.Bool("bhyve-prefer-ipv6")
+	d.NetworkBackend = flags.String("bhyve-network-backend")
+	d.ValeSwitch = flags.String("bhyve-vale-switch")
+
+	switch d.NetworkBackend {
+	case networkBackendBridge:
+	case networkBackendVale:
+		if err := validateValeSwitch(d.ValeSwitch); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown network backend %s, use bridge or vale", d.NetworkBackend)
+	}
+
+	inuse, err := macAddressesInUse(d.StorePath, d.MachineName)
+	if err != nil {
+		return err
+	}
+
+	if mac := flags.String("bhyve-mac"); mac != "" {
+		d.MACAddress, err = checkMACAddress(inuse, d.MachineName, mac)
+	} else {
+		d.MACAddress, err = generateMACAddress(inuse, d.StorePath, d.MachineName, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	nicspecs := flags.StringSlice("bhyve-nic")
+	sharespecs := flags.StringSlice("bhyve-share")
+	if len(nicspecs)+len(sharespecs) > maxSlot-firstExtraSlot+1 {
+		return fmt.Errorf("at most %d additional NICs and shares are supported", maxSlot-firstExtraSlot+1)
+	}
+	d.NICs = nil
+	for i, spec := range nicspecs {
+		nic, err := parseNICSpec(spec)
+		if err != nil {
+			return err
+		}
+
+		if nic.MACAddress != "" {
+			nic.MACAddress, err = checkMACAddress(inuse, d.MachineName, nic.MACAddress)
+		} else {
+			nic.MACAddress, err = generateMACAddress(inuse, d.StorePath, d.MachineName, "nic"+strconv.Itoa(i+1))
+		}
+		if err != nil {
+			return err
+		}
+
+		d.NICs = append(d.NICs, nic)
+	}
+
+	d.ShareMode = flags.String("bhyve-share-mode")
+	if d.ShareMode != shareMode9P && d.ShareMode != shareModeNFS {
+		return fmt.Errorf("unknown share mode %s, use 9p or nfs", d.ShareMode)
+	}
+
+	d.Shares = nil
+	for _, spec := range sharespecs {
+		share, err := parseShareSpec(spec)
+		if err != nil {
+			return err
+		}
+		d.Shares = append(d.Shares, share)
+	}
+
+	if d.Image != "" && (d.Boot2DockerURL != "" || d.ImageIndexURL != "" || d.B2DVersion != "" ||
+		d.Bootsync != "" || d.Bootlocal != "" || d.Profile != "" || len(d.RegistryMirrors) > 0) {
+		return fmt.Errorf("--bhyve-image can't be combined with boot2docker options")
+	}
+
+	for _, path := range []string{d.Bootsync, d.Bootlocal, d.Profile} {
+		if path != "" && !fileExists(path) {
+			return fmt.Errorf("%s not found", path)
+		}
+	}
+
+	if _, err := caCertFiles(d.CACerts); err != nil {
+		return err
+	}
+
+	for _, mirror := range d.RegistryMirrors {
+		if err := validateRegistryMirror(mirror); err != nil {
+			return err
+		}
+	}
+
+	if d.ImageIndexURL != "" && d.Boot2DockerURL != "" {
+		return fmt.Errorf("--bhyve-image-index-url and --bhyve-boot2docker-url are mutually exclusive")
+	}
+
+	if d.B2DVersion != "" {
+		if d.Boot2DockerURL != "" {
+			return fmt.Errorf("--bhyve-boot2docker-version and --bhyve-boot2docker-url are mutually exclusive")
+		}
+		if !b2dVersionRegex.MatchString(d.B2DVersion) {
+			return fmt.Errorf("invalid boot2docker version %s, it should look like v19.03.5", d.B2DVersion)
+		}
+	}
+
+	if d.ISOSHA256 != "" && !b2d.ValidSHA256(d.ISOSHA256) {
+		return fmt.Errorf("invalid SHA-256 %s", d.ISOSHA256)
+	}
+
+	if d.PreferIPv6 && !d.EnableIPv6 {
+		return fmt.Errorf("--bhyve-prefer-ipv6 requires --bhyve-ipv6")
+	}
+
+	if d.EnableIPv6 {
+		ip, _, err := net.ParseCIDR(d.Subnet6)
+		if err != nil {
+			return err
+		}
+		if ip.To4() != nil {
+			return fmt.Errorf("%s is not an IPv6 subnet", d.Subnet6)
+		}
+	}
+
+	if d.StaticIP != "" {
+		if err := validateStaticIP(d.StaticIP, d.Subnet, d.DHCPRange); err != nil {
+			return err
+		}
+	}
+
+	if err := d.checkNetworkSettings(); err != nil {
+		return err
+	}
+
+	if d.HTTPProxy != "" || d.HTTPSProxy != "" {
+		if err := d.setGuestProxy(); err != nil {
+			return err
+		}
+	} else {
+		d.NoProxy = ""
+	}
 
 	return nil
 }
 
 func (d *Driver) Start() error {
+	setPrivilege(d.Privilege)
+
+	return d.withDryRun("start", d.start)
+}
+
+func (d *Driver) start() error {
 	// TODO log bhyve output to this file
 	bhyvelogpath := d.ResolveStorePath("bhyve.log")
 	log.Debugf("bhyvelogpath: %s", bhyvelogpath)
 
-	err := writeDeviceMap(d.ResolveStorePath("/device.map"), d.ResolveStorePath(isoFilename), d.ResolveStorePath(diskname))
+	// dnsmasq may have died since the machine was created
+	err := startDHCPServer(d.StorePath, d.dhcpDir(), d.hostInterface(), d.DHCPRange, d.dnsDomain(), d.EnableIPv6)
 	if err != nil {
 		return err
 	}
 
-	err = runGrub(d.ResolveStorePath("/device.map"), strconv.Itoa(int(d.MemSize)), d.BhyveVMName)
-	if err != nil {
-		return err
+	// cloud images boot with UEFI, boot2docker is loaded by grub-bhyve
+	cdpath := d.ResolveStorePath(seedFilename)
+	if d.Image == "" {
+		cdpath = d.ResolveStorePath(isoFilename)
+
+		// refuse to boot an ISO that doesn't match what was verified at create time
+		if d.ISOSHA256 != "" {
+			err = runner.do("check the SHA-256 of "+cdpath, func() error {
+				return b2d.VerifySHA256(cdpath, d.ISOSHA256)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = runner.do("write "+d.ResolveStorePath("device.map"), func() error {
+			return writeDeviceMap(d.ResolveStorePath("/device.map"), cdpath, d.ResolveStorePath(diskname))
+		})
+		if err != nil {
+			return err
+		}
+
+		err = runGrub(d.ResolveStorePath("/device.map"), strconv.Itoa(int(d.MemSize)), d.BhyveVMName)
+		if err != nil {
+			return err
+		}
 	}
 
 	nmdmdev, err := findNMDMDev()
@@ -283,65 +854,242 @@ func (d *Driver) Start() error {
 	}
 	d.NMDMDev = nmdmdev
 
-	tapdev, err := findtapdev(d.Bridge)
-	if err != nil {
-		return err
+	netdevice := valePort(d.ValeSwitch, d.MachineName)
+	if d.NetworkBackend != networkBackendVale {
+		tapdev, err := findtapdev(d.Bridge)
+		if err != nil {
+			return err
+		}
+		d.NetDev = tapdev
+		netdevice = tapdev
 	}
-	d.NetDev = tapdev
 
-	cdpath := d.ResolveStorePath(isoFilename)
-	cpucount := strconv.Itoa(int(d.CPUcount))
-	ram := strconv.Itoa(int(d.MemSize))
+	config := vmConfig{
+		Name:     d.BhyveVMName,
+		CPUs:     d.CPUcount,
+		MemoryMB: int(d.MemSize),
+		Disk:     d.ResolveStorePath(diskname),
+		CD:       cdpath,
+		UEFI:     d.Image != "",
+		Console:  nmdmdev + "A",
+		NICs:     []vmNIC{{Model: defaultNICModel, Backend: netdevice, MAC: d.MACAddress}},
+	}
 
-	err = startConsoleLogger(d.ResolveStorePath(""), nmdmdev)
+	for i := range d.NICs {
+		if d.NICs[i].Bridge != "" {
+			nictapdev, err := findtapdev(d.NICs[i].Bridge)
+			if err != nil {
+				return err
+			}
+			d.NICs[i].NetDev = nictapdev
+		}
+		config.NICs = append(config.NICs, d.NICs[i].vmNIC(d.MachineName, i))
+	}
+	if d.ShareMode != shareModeNFS {
+		config.Shares = d.Shares
+	}
+
+	err = runner.do("write "+d.ResolveStorePath(vmConfigFilename), func() error {
+		return writeVMConfig(d.ResolveStorePath(vmConfigFilename), config)
+	})
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command("/usr/sbin/daemon", "-t", "XXXXX", "-f", "sudo", "bhyve", "-A", "-H", "-P", "-s",
-		"0:0,hostbridge", "-s", "1:0,lpc", "-s", "2:0,virtio-net,"+tapdev+",mac="+d.MACAddress, "-s", "3:0,virtio-blk,"+
-			d.ResolveStorePath(diskname), "-s", "4:0,virtio-rnd,/dev/random", "-s", "5:0,ahci-cd,"+cdpath, "-l", "com1,"+nmdmdev+"A", "-c", cpucount, "-m", ram+"M",
-		d.BhyveVMName)
-	stderr, err := cmd.StderrPipe()
+	err = startConsoleLogger(d.ResolveStorePath(""), nmdmdev)
 	if err != nil {
 		return err
 	}
 
-	if err := cmd.Start(); err != nil {
+	helperargs, err := helperArgs("start-vm", d.ResolveStorePath(vmConfigFilename))
+	if err != nil {
 		return err
 	}
+	bhyveargs := append([]string{"-t", "XXXXX", "-f"}, helperargs...)
 
-	slurp, _ := ioutil.ReadAll(stderr)
+	_, slurp, err := runner.run("/usr/sbin/daemon", bhyveargs...)
 	log.Debugf("%s\n", slurp)
-
-	if err := cmd.Wait(); err != nil {
+	if err != nil {
 		return err
 	}
 	log.Debugf("bhyve: " + stripCtlAndExtFromBytes(string(slurp)))
 
-	ip, err := waitForIP(d.StorePath, d.MACAddress)
+	ip := ""
+	err = runner.do("wait for "+d.MachineName+" to get an IP address and start SSH", func() error {
+		ip, err = waitForIP(d.lookupIP)
+		if err != nil {
+			return err
+		}
+		d.IPAddress = ip
+
+		// Wait for SSH over NAT to be available before returning to user
+		return drivers.WaitForSSH(d)
+	})
 	if err != nil {
 		return err
 	}
-	d.IPAddress = ip
 
-	// Wait for SSH over NAT to be available before returning to user
-	if err := drivers.WaitForSSH(d); err != nil {
-		return err
+	if d.ShareMode == shareModeNFS && len(d.Shares) > 0 {
+		// the export is limited to the machine's IP, which may have changed
+		exportargs := []string{d.MachineName, ip}
+		for _, share := range d.Shares {
+			if share.ReadOnly {
+				exportargs = append(exportargs, share.HostPath+":ro")
+			} else {
+				exportargs = append(exportargs, share.HostPath)
+			}
+		}
+		if err := privileged("export-shares", exportargs...); err != nil {
+			return err
+		}
+
+		subnet := d.Subnet
+		if net.ParseIP(ip).To4() == nil {
+			subnet = d.Subnet6
+		}
+		hostip, _, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return err
+		}
+		err = runner.do("mount the shares in "+d.MachineName+" over SSH", func() error {
+			return mountNFSShares(d, d.Shares, hostip.String())
+		})
+		if err != nil {
+			return err
+		}
+	} else if len(d.Shares) > 0 {
+		err = runner.do("mount the shares in "+d.MachineName+" over SSH", func() error {
+			return mountShares(d, d.Shares)
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
 func (d *Driver) Stop() error {
-	err := d.Kill()
+	setPrivilege(d.Privilege)
+
+	return d.withDryRun("stop", d.kill)
+}
+
+func (d *Driver) isoOptions() isoOptions {
+	return isoOptions{
+		url:          d.Boot2DockerURL,
+		indexURL:     d.ImageIndexURL,
+		sha256:       d.ISOSHA256,
+		version:      d.B2DVersion,
+		offline:      d.Offline,
+		skipChecksum: d.SkipChecksum,
+		timeout:      time.Duration(d.FetchTimeout) * time.Second,
+	}
+}
+
+func (d *Driver) userdataOptions() userdataOptions {
+	return userdataOptions{
+		bootsync:        d.Bootsync,
+		bootlocal:       d.Bootlocal,
+		profile:         d.Profile,
+		caCerts:         d.CACerts,
+		registryMirrors: d.RegistryMirrors,
+		proxy:           d.proxySettings(),
+	}
+}
+
+func (d *Driver) proxySettings() proxySettings {
+	return proxySettings{
+		httpProxy:  d.HTTPProxy,
+		httpsProxy: d.HTTPSProxy,
+		noProxy:    d.NoProxy,
+	}
+}
+
+// setGuestProxy makes the proxy settings work from the guest, the proxy is reached via
+// the host interface if it's on the host's loopback, and the machine network is direct
+func (d *Driver) setGuestProxy() error {
+	hostip, _, err := net.ParseCIDR(d.Subnet)
+	if err != nil {
+		return err
+	}
+
+	d.HTTPProxy, err = guestProxyURL(d.HTTPProxy, hostip.String())
+	if err != nil {
+		return err
+	}
+	d.HTTPSProxy, err = guestProxyURL(d.HTTPSProxy, hostip.String())
+	if err != nil {
+		return err
+	}
+
+	direct := []string{"localhost", "127.0.0.1"}
+	network, err := networkCIDR(d.Subnet)
 	if err != nil {
 		return err
 	}
+	direct = append(direct, network)
+	if d.EnableIPv6 {
+		network6, err := networkCIDR(d.Subnet6)
+		if err != nil {
+			return err
+		}
+		direct = append(direct, network6)
+	}
+	if d.EnableDNS {
+		direct = append(direct, "."+d.DNSDomain)
+	}
+	d.NoProxy = mergeNoProxy(d.NoProxy, direct...)
 
 	return nil
 }
 
+func (d *Driver) preflight() (preflight, error) {
+	helper, err := helperPath()
+	if err != nil {
+		return preflight{}, err
+	}
+
+	return preflight{
+		runner:     runner,
+		devfsRules: defaultDevfsRules,
+		dmesgBoot:  defaultDmesgBoot,
+		firmware:   defaultFirmware,
+		helper:     helper,
+		privilege:  d.Privilege,
+		storePath:  d.StorePath,
+		diskSize:   d.DiskSize,
+		vale:       d.NetworkBackend == networkBackendVale,
+		image:      d.Image != "",
+		nfs:        d.ShareMode == shareModeNFS,
+	}, nil
+}
+
+// hostInterface returns the host side of the machine's network, which has the subnet
+// address and is where dnsmasq listens
+func (d *Driver) hostInterface() string {
+	if d.NetworkBackend == networkBackendVale {
+		return valeHostPort(d.ValeSwitch)
+	}
+	return d.Bridge
+}
+
+// valeSwitch returns the VALE switch the machine is attached to, or "" for a bridge
+func (d *Driver) valeSwitch() string {
+	if d.NetworkBackend == networkBackendVale {
+		return d.ValeSwitch
+	}
+	return ""
+}
+
+// dnsDomain returns the domain dnsmasq should serve, or "" if DNS is disabled
+func (d *Driver) dnsDomain() string {
+	if !d.EnableDNS {
+		return ""
+	}
+	return d.DNSDomain
+}
+
 //noinspection GoUnusedExportedFunction
 func NewDriver(hostName, storePath string) *Driver {
 	return &Driver{
@@ -359,5 +1107,10 @@ func NewDriver(hostName, storePath string) *Driver {
 		Boot2DockerURL: defaultBoot2DockerURL,
 		Subnet:         defaultSubnet,
 		BhyveVMName:    defaultBhyveVMName,
+		DNSDomain:      defaultDNSDomain,
+		Subnet6:        defaultSubnet6,
+		NetworkBackend: networkBackendBridge,
+		ValeSwitch:     defaultValeSwitch,
+		ShareMode:      shareMode9P,
 	}
 }
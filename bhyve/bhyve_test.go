@@ -0,0 +1,35 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/libmachine/mcnflag"
+)
+
+// TestCreateFlagsEnvVars checks every flag can be set from a BHYVE_ environment variable
+func TestCreateFlagsEnvVars(t *testing.T) {
+	for _, flag := range NewDriver("dev", "/store").GetCreateFlags() {
+		var envvar string
+		switch f := flag.(type) {
+		case mcnflag.StringFlag:
+			envvar = f.EnvVar
+		case mcnflag.StringSliceFlag:
+			envvar = f.EnvVar
+		case mcnflag.IntFlag:
+			envvar = f.EnvVar
+		case mcnflag.BoolFlag:
+			envvar = f.EnvVar
+		default:
+			t.Errorf("%s is an unexpected %T", flag.String(), flag)
+			continue
+		}
+		if !strings.HasPrefix(envvar, "BHYVE_") {
+			t.Errorf("%s has EnvVar %q", flag.String(), envvar)
+		}
+	}
+}
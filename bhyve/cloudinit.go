@@ -0,0 +1,186 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/ssh"
+	"gitlab.mouf.net/swills/docker-machine-driver-bhyve/b2d"
+	"gitlab.mouf.net/swills/docker-machine-driver-bhyve/iso9660"
+)
+
+const (
+	seedFilename    = "seed.iso"
+	seedVolumeID    = "cidata"
+	seedCertsDir    = "ca-certificates"
+	defaultFirmware = "/usr/local/share/uefi-firmware/BHYVE_UEFI.fd"
+)
+
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// renderMetaData returns the NoCloud meta-data for a machine
+func renderMetaData(machinename string) string {
+	return "instance-id: " + machinename + "\nlocal-hostname: " + machinename + "\n"
+}
+
+// seedCertsScript installs the CA certificates on the seed ISO on boot, before
+// provisioning installs Docker, for Debian and Red Hat style distributions
+const seedCertsScript = `seed=/run/bhyve-seed
+mkdir -p $seed
+mount -t iso9660 -o ro /dev/disk/by-label/cidata $seed || mount -t iso9660 -o ro /dev/disk/by-label/CIDATA $seed || exit 0
+if command -v update-ca-certificates >/dev/null; then
+	cp $seed/` + seedCertsDir + `/*.crt /usr/local/share/ca-certificates/
+	update-ca-certificates
+elif command -v update-ca-trust >/dev/null; then
+	cp $seed/` + seedCertsDir + `/*.crt /etc/pki/ca-trust/source/anchors/
+	update-ca-trust
+fi
+umount $seed
+`
+
+// renderUserData returns the NoCloud user-data creating sshuser with passwordless sudo,
+// which is what libmachine's provisioners expect, setting up the proxy and installing
+// the CA certificates on the seed ISO if there are any
+func renderUserData(machinename string, sshuser string, pubkey string, proxy proxySettings, certs bool) string {
+	var b strings.Builder
+
+	b.WriteString("#cloud-config\n")
+	b.WriteString("hostname: " + machinename + "\n")
+	b.WriteString("users:\n")
+	b.WriteString("  - name: " + sshuser + "\n")
+	b.WriteString("    shell: /bin/sh\n")
+	b.WriteString("    sudo: ALL=(ALL) NOPASSWD:ALL\n")
+	b.WriteString("    ssh_authorized_keys:\n")
+	b.WriteString("      - " + strings.TrimSpace(pubkey) + "\n")
+
+	if certs {
+		b.WriteString("bootcmd:\n")
+		b.WriteString("  - |\n")
+		b.WriteString(indent(seedCertsScript, "    "))
+	}
+
+	if !proxy.empty() {
+		b.WriteString("write_files:\n")
+		b.WriteString("  - path: /etc/environment\n")
+		b.WriteString("    append: true\n")
+		b.WriteString("    content: |\n")
+		b.WriteString(indent(proxy.renderEnvironment(), "      "))
+		b.WriteString("  - path: /etc/systemd/system/docker.service.d/http-proxy.conf\n")
+		b.WriteString("    content: |\n")
+		b.WriteString(indent(proxy.renderSystemdDropIn(), "      "))
+		b.WriteString("apt:\n")
+		if proxy.httpProxy != "" {
+			b.WriteString("  http_proxy: " + strconv.Quote(proxy.httpProxy) + "\n")
+		}
+		if proxy.httpsProxy != "" {
+			b.WriteString("  https_proxy: " + strconv.Quote(proxy.httpsProxy) + "\n")
+		}
+	}
+
+	return b.String()
+}
+
+func indent(s string, prefix string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if line != "" {
+			b.WriteString(prefix + line)
+		}
+	}
+	return b.String()
+}
+
+// generateSeedImage creates the SSH key and the NoCloud seed ISO injecting it, along with
+// the CA certificates
+func generateSeedImage(keypath string, seedpath string, machinename string, sshuser string, proxy proxySettings, caCerts []string) error {
+	certs, err := caCertFiles(caCerts)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Creating SSH key...")
+	if err := ssh.GenerateSSHKey(keypath); err != nil {
+		return err
+	}
+
+	pubkey, err := ioutil.ReadFile(keypath + ".pub")
+	if err != nil {
+		return err
+	}
+
+	seed := iso9660.NewWriter(seedVolumeID)
+	if err := seed.AddFile("meta-data", []byte(renderMetaData(machinename)), 0644); err != nil {
+		return err
+	}
+	userdata := renderUserData(machinename, sshuser, string(pubkey), proxy, len(certs) > 0)
+	if err := seed.AddFile("user-data", []byte(userdata), 0644); err != nil {
+		return err
+	}
+	for i, cert := range certs {
+		data, err := ioutil.ReadFile(cert)
+		if err != nil {
+			return err
+		}
+		// update-ca-certificates only picks up .crt files, names are numbered to avoid clashes
+		name := fmt.Sprintf("%s/%02d-%s.crt", seedCertsDir, i, strings.TrimSuffix(filepath.Base(cert), filepath.Ext(cert)))
+		if err := seed.AddFile(name, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return seed.WriteFile(seedpath)
+}
+
+// copyCloudImage fetches a raw cloud image to diskpath and grows it to size bytes
+func copyCloudImage(storepath string, imageURL string, diskpath string, size int64, timeout time.Duration) error {
+	if fileExists(diskpath) {
+		return nil
+	}
+
+	if !strings.Contains(imageURL, "://") {
+		abspath, err := filepath.Abs(imageURL)
+		if err != nil {
+			return err
+		}
+		imageURL = "file://" + abspath
+	}
+
+	b2dinstance := b2d.NewB2dUtils(storepath)
+	b2dinstance.FetchTimeout = timeout
+	if err := b2dinstance.DownloadISO(filepath.Dir(diskpath), filepath.Base(diskpath), imageURL); err != nil {
+		return err
+	}
+
+	f, err := os.Open(diskpath)
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, len(qcow2Magic))
+	_, err = f.ReadAt(magic, 0)
+	f.Close()
+	if err == nil && bytes.Equal(magic, qcow2Magic) {
+		os.Remove(diskpath)
+		return fmt.Errorf("%s is a qcow2 image, convert it with: qemu-img convert -O raw <image> <image>.raw", imageURL)
+	}
+
+	info, err := os.Stat(diskpath)
+	if err != nil {
+		return err
+	}
+	if info.Size() < size {
+		return os.Truncate(diskpath, size)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.mouf.net/swills/docker-machine-driver-bhyve/iso9660"
+)
+
+func TestGenerateSeedImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certdir := filepath.Join(dir, "certs")
+	if err := os.Mkdir(certdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"corp.pem": "corp", "lab.crt": "lab", "notes.txt": "not a cert"} {
+		if err := ioutil.WriteFile(filepath.Join(certdir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seedpath := filepath.Join(dir, seedFilename)
+	err = generateSeedImage(filepath.Join(dir, "id_rsa"), seedpath, "dev", "docker", proxySettings{}, []string{certdir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(seedpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files, err := iso9660.ReadFiles(f, iso9660.Joliet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"meta-data":                   renderMetaData("dev"),
+		seedCertsDir + "/00-corp.crt": "corp",
+		seedCertsDir + "/01-lab.crt":  "lab",
+	}
+	for name, data := range want {
+		if string(files[name].Data) != data {
+			t.Errorf("%s = %q, want %q", name, files[name].Data, data)
+		}
+	}
+	if len(files) != len(want)+1 {
+		t.Errorf("seed has %d files, want %d", len(files), len(want)+1)
+	}
+
+	userdata := string(files["user-data"].Data)
+	if !strings.Contains(userdata, "bootcmd:\n  - |\n    seed=/run/bhyve-seed\n") {
+		t.Errorf("user-data doesn't install the certificates:\n%s", userdata)
+	}
+}
+
+func TestRenderUserData(t *testing.T) {
+	userdata := renderUserData("dev", "docker", "ssh-rsa AAAA\n", proxySettings{}, false)
+	if !strings.HasPrefix(userdata, "#cloud-config\n") || !strings.Contains(userdata, "      - ssh-rsa AAAA\n") {
+		t.Errorf("unexpected user-data:\n%s", userdata)
+	}
+	for _, notwant := range []string{"bootcmd", "write_files", "apt:"} {
+		if strings.Contains(userdata, notwant) {
+			t.Errorf("user-data without certificates or a proxy has %s:\n%s", notwant, userdata)
+		}
+	}
+}
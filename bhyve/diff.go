@@ -0,0 +1,123 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// unifiedDiff returns a unified diff between two versions of a file, or "" if they match.
+// The files changed are small config files, so a quadratic LCS is fine.
+func unifiedDiff(filename string, from string, to string) string {
+	if from == to {
+		return ""
+	}
+	a, b := splitLines(from), splitLines(to)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+		ai   int
+		bi   int
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i], i, j})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			lines = append(lines, line{'+', b[j], i, j})
+			j++
+		default:
+			lines = append(lines, line{'-', a[i], i, j})
+			i++
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString("--- " + filename + "\n+++ " + filename + "\n")
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+
+		// extend the hunk while changes are at most twice the context apart, so their
+		// contexts don't overlap or touch
+		first := start - diffContext
+		if first < 0 {
+			first = 0
+		}
+		end := start
+		for k := start; k < len(lines) && k <= end+2*diffContext+1; k++ {
+			if lines[k].op != ' ' {
+				end = k
+			}
+		}
+		last := end + diffContext
+		if last >= len(lines) {
+			last = len(lines) - 1
+		}
+
+		var acount, bcount int
+		for _, l := range lines[first : last+1] {
+			if l.op != '+' {
+				acount++
+			}
+			if l.op != '-' {
+				bcount++
+			}
+		}
+		astart, bstart := lines[first].ai+1, lines[first].bi+1
+		if acount == 0 {
+			astart--
+		}
+		if bcount == 0 {
+			bstart--
+		}
+		out.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", astart, acount, bstart, bcount))
+		for _, l := range lines[first : last+1] {
+			text := l.text
+			if !strings.HasSuffix(text, "\n") {
+				text += "\n"
+			}
+			out.WriteString(string(l.op) + text)
+		}
+		start = last + 1
+	}
+
+	return out.String()
+}
@@ -0,0 +1,492 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+const (
+	dhcpConfFilename  = "dnsmasq.conf"
+	dhcpPidFilename   = "dnsmasq.pid"
+	dhcpLeaseFilename = "bhyve.leases"
+	dhcpHostsDirname  = "dnsmasq.d"
+	dhcpDirname       = "dhcp"
+)
+
+// dhcpDir returns the directory of the dnsmasq serving the machine's network. There is
+// one dnsmasq per host interface, so machines on different bridges or VALE switches
+// don't overwrite each other's DHCP config.
+func (d *Driver) dhcpDir() string {
+	return filepath.Join(d.StorePath, dhcpDirname, d.hostInterface())
+}
+
+// dhcpRunDir returns where the helper has the dnsmasq for dhcpdir write its pid and
+// leases. dhcpdir is named after the network's interface.
+func dhcpRunDir(dhcpdir string) string {
+	return filepath.Join(helperRunDir, strconv.Itoa(os.Getuid()), filepath.Base(dhcpdir))
+}
+
+// checkNetworkSettings makes sure the machine agrees with the other machines on its
+// network about the settings their shared dnsmasq is started with
+func (d *Driver) checkNetworkSettings() error {
+	machines, err := storedMachines(d.StorePath, d.MachineName)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range machines {
+		other := m.Driver
+		if other.hostInterface() != d.hostInterface() {
+			// the host has an address on each network, they can't overlap
+			if subnetsOverlap(other.Subnet, d.Subnet) {
+				return fmt.Errorf("%s on %s already uses subnet %s, use another --bhyve-subnet and --bhyve-dhcprange",
+					m.Name, other.hostInterface(), other.Subnet)
+			}
+			if d.EnableIPv6 && other.EnableIPv6 && subnetsOverlap(other.Subnet6, d.Subnet6) {
+				return fmt.Errorf("%s on %s already uses IPv6 subnet %s, use another --bhyve-subnet6",
+					m.Name, other.hostInterface(), other.Subnet6)
+			}
+			continue
+		}
+
+		var setting, value string
+		switch {
+		case other.Subnet != d.Subnet:
+			setting, value = "subnet", other.Subnet
+		case other.DHCPRange != d.DHCPRange:
+			setting, value = "DHCP range", other.DHCPRange
+		case other.dnsDomain() != d.dnsDomain():
+			setting, value = "DNS domain", other.dnsDomain()
+		case other.EnableIPv6 != d.EnableIPv6:
+			setting, value = "IPv6", strconv.FormatBool(other.EnableIPv6)
+		case other.EnableIPv6 && other.Subnet6 != d.Subnet6:
+			setting, value = "IPv6 subnet", other.Subnet6
+		default:
+			continue
+		}
+		if value == "" {
+			value = "none"
+		}
+		return fmt.Errorf("%s on %s uses %s %s, machines on the same network must use the same settings",
+			m.Name, d.hostInterface(), setting, value)
+	}
+
+	return nil
+}
+
+// subnetsOverlap reports whether either CIDR contains the other's network address.
+// Invalid CIDRs don't overlap anything, setting up the network rejects them.
+func subnetsOverlap(a string, b string) bool {
+	_, neta, err := net.ParseCIDR(a)
+	if err != nil {
+		return false
+	}
+	_, netb, err := net.ParseCIDR(b)
+	if err != nil {
+		return false
+	}
+	return neta.Contains(netb.IP) || netb.Contains(neta.IP)
+}
+
+// renderDHCPConf returns the base dnsmasq config. Per-machine host entries live in
+// hostsdir, which is passed to dhcp-hostsfile rather than conf-dir because dnsmasq
+// re-reads hosts files on SIGHUP but only reads its config at startup. If dnsdomain
+// is set, machines are also named <machine>.<dnsdomain>. DNS is always served on the
+// bridge, forwarding to the host's resolvers, as those may only listen on localhost.
+// If ipv6 is set, router advertisements and DHCPv6 are served for the bridge's prefix,
+// with SLAAC allowed for guests such as boot2docker without a DHCPv6 client.
+func renderDHCPConf(bridge string, dhcprange string, hostsdir string, dnsdomain string, ipv6 bool) string {
+	var b strings.Builder
+
+	b.WriteString("domain-needed\nbogus-priv\n")
+	b.WriteString("except-interface=lo0\nbind-interfaces\nlocal-service\ndhcp-authoritative\n\n")
+	b.WriteString("interface=" + bridge + "\n")
+	b.WriteString("dhcp-range=" + dhcprange + "\n")
+	b.WriteString("dhcp-hostsfile=" + hostsdir + "\n")
+
+	if ipv6 {
+		b.WriteString("\nenable-ra\n")
+		b.WriteString("dhcp-range=::100,::1ff,constructor:" + bridge + ",slaac,64,12h\n")
+	}
+
+	if dnsdomain != "" {
+		b.WriteString("\ndomain=" + dnsdomain + "\n")
+		b.WriteString("local=/" + dnsdomain + "/\n")
+		b.WriteString("expand-hosts\n")
+	}
+
+	return b.String()
+}
+
+// renderResolverConf returns a local_unbound snippet forwarding dnsdomain to dnsmasq on the bridge
+func renderResolverConf(dnsdomain string, bridgeip string) string {
+	var b strings.Builder
+
+	b.WriteString("server:\n")
+	b.WriteString("\tdomain-insecure: \"" + dnsdomain + "\"\n")
+	b.WriteString("\tprivate-domain: \"" + dnsdomain + "\"\n\n")
+	b.WriteString("forward-zone:\n")
+	b.WriteString("\tname: \"" + dnsdomain + "\"\n")
+	b.WriteString("\tforward-addr: " + bridgeip + "\n")
+
+	return b.String()
+}
+
+// renderDHCPHost returns a dhcp-hostsfile entry for a machine, ip may be empty
+func renderDHCPHost(macaddress string, ip string, hostname string) string {
+	fields := []string{macaddress}
+	if ip != "" {
+		fields = append(fields, ip)
+	}
+	fields = append(fields, hostname)
+
+	return strings.Join(fields, ",") + "\n"
+}
+
+// ensureDir creates dir and its parents if it doesn't exist yet
+func ensureDir(dir string) error {
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return nil
+	}
+	return runner.do("create "+dir, func() error {
+		return os.MkdirAll(dir, 0755)
+	})
+}
+
+// writeIfChanged writes content to filename, reporting whether the file was changed
+func writeIfChanged(filename string, content string) (bool, error) {
+	existing, err := ioutil.ReadFile(filename)
+	if err == nil && bytes.Equal(existing, []byte(content)) {
+		return false, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	return true, runner.do("write "+filename, func() error {
+		return ioutil.WriteFile(filename, []byte(content), 0644)
+	})
+}
+
+func writeDHCPConf(dhcpdir string, bridge string, dhcprange string, dnsdomain string, ipv6 bool) (bool, error) {
+	log.Debugf("Writing DHCP server config")
+
+	hostsdir := filepath.Join(dhcpdir, dhcpHostsDirname)
+	if err := ensureDir(hostsdir); err != nil {
+		return false, err
+	}
+
+	return writeIfChanged(filepath.Join(dhcpdir, dhcpConfFilename), renderDHCPConf(bridge, dhcprange, hostsdir, dnsdomain, ipv6))
+}
+
+// writeResolverConf writes the host side resolver snippet for dnsdomain, returning its path
+func writeResolverConf(dhcpdir string, dnsdomain string, subnet string) (string, error) {
+	bridgeip, _, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", err
+	}
+
+	resolverconffile := filepath.Join(dhcpdir, dnsdomain+".unbound.conf")
+	_, err = writeIfChanged(resolverconffile, renderResolverConf(dnsdomain, bridgeip.String()))
+	if err != nil {
+		return "", err
+	}
+
+	return resolverconffile, nil
+}
+
+func writeDHCPHost(dhcpdir string, machinename string, macaddress string, ip string) error {
+	log.Debugf("Writing DHCP host entry for %s", machinename)
+
+	hostsdir := filepath.Join(dhcpdir, dhcpHostsDirname)
+	if err := ensureDir(hostsdir); err != nil {
+		return err
+	}
+
+	if ip != "" {
+		if err := checkReservationUnused(hostsdir, machinename, ip); err != nil {
+			return err
+		}
+	}
+
+	changed, err := writeIfChanged(filepath.Join(hostsdir, machinename), renderDHCPHost(macaddress, ip, machinename))
+	if err != nil || !changed {
+		return err
+	}
+
+	return reloadDHCPServer(dhcpdir)
+}
+
+func removeDHCPHost(dhcpdir string, machinename string) error {
+	log.Debugf("Removing DHCP host entry for %s", machinename)
+
+	hostfile := filepath.Join(dhcpdir, dhcpHostsDirname, machinename)
+	if _, err := os.Stat(hostfile); os.IsNotExist(err) {
+		return nil
+	}
+
+	err := runner.do("remove "+hostfile, func() error {
+		return os.Remove(hostfile)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return reloadDHCPServer(dhcpdir)
+}
+
+// checkReservationUnused makes sure no other machine has ip reserved
+func checkReservationUnused(hostsdir string, machinename string, ip string) error {
+	files, err := ioutil.ReadDir(hostsdir)
+	if os.IsNotExist(err) {
+		// only in a dry run, which doesn't create it
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || f.Name() == machinename {
+			continue
+		}
+		entry, err := ioutil.ReadFile(filepath.Join(hostsdir, f.Name()))
+		if err != nil {
+			return err
+		}
+		for _, field := range strings.Split(strings.TrimSpace(string(entry)), ",") {
+			if field == ip {
+				return fmt.Errorf("IP address %s is already reserved by %s", ip, f.Name())
+			}
+		}
+	}
+
+	return nil
+}
+
+func readDHCPPid(dhcpdir string) (int, error) {
+	dhcppid, err := ioutil.ReadFile(filepath.Join(dhcpdir, dhcpPidFilename))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(dhcppid)))
+}
+
+// dhcpServerPid returns the pid of our running dnsmasq, or 0 if there isn't one. A pid
+// file left behind by a killed dnsmasq, or naming a pid since reused, is ignored, the
+// next dnsmasq started replaces it.
+func dhcpServerPid(dhcpdir string) (int, error) {
+	pid, err := readDHCPPid(dhcpRunDir(dhcpdir))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		log.Debugf("Failed to parse dnsmasq pid: %s", err)
+		return 0, nil
+	}
+
+	if !processIs(pid, "dnsmasq") {
+		log.Debugf("Ignoring stale dnsmasq pid file")
+		return 0, nil
+	}
+	return pid, nil
+}
+
+func dhcpServerStatus(dhcpdir string) (state.State, error) {
+	pid, err := dhcpServerPid(dhcpdir)
+	if err != nil {
+		return state.Error, err
+	}
+
+	if pid == 0 {
+		return state.Stopped, nil
+	}
+
+	return state.Running, nil
+}
+
+// reloadDHCPServer asks a running dnsmasq to re-read the per-machine host entries
+func reloadDHCPServer(dhcpdir string) error {
+	pid, err := dhcpServerPid(dhcpdir)
+	if err != nil || pid == 0 {
+		// not running, it will pick the entries up when started
+		return err
+	}
+
+	log.Debugf("Reloading DHCP Server")
+	return privileged("signal-dhcp", filepath.Base(dhcpdir), "HUP")
+}
+
+func stopDHCPServer(dhcpdir string) error {
+	pid, err := dhcpServerPid(dhcpdir)
+	if err != nil || pid == 0 {
+		return err
+	}
+
+	log.Debugf("Stopping DHCP Server")
+	err = privileged("signal-dhcp", filepath.Base(dhcpdir), "TERM")
+	if err != nil {
+		log.Debugf("Failed to kill dnsmasq, perhaps already dead?")
+	}
+
+	// wait for it to release the DHCP port
+	return runner.do("wait for dnsmasq to exit", func() error {
+		for tries := 0; tries < retrycount && processes.alive(pid); tries++ {
+			time.Sleep(sleeptime * time.Millisecond)
+		}
+		return nil
+	})
+}
+
+// dhcpServerUsers returns the machines other than the driver's own using its network's
+// dnsmasq. Machines are found by their config, as those created before the driver kept
+// host entries don't have one, and by host entry, for any still being created.
+func (d *Driver) dhcpServerUsers() ([]string, error) {
+	users := map[string]bool{}
+
+	machines, err := storedMachines(d.StorePath, d.MachineName)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range machines {
+		if m.Driver.hostInterface() == d.hostInterface() {
+			users[m.Name] = true
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(d.dhcpDir(), dhcpHostsDirname))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Name() != d.MachineName {
+			users[f.Name()] = true
+		}
+	}
+
+	var names []string
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// stopDHCPServerIfUnused stops the network's dnsmasq once no other machine uses it
+func (d *Driver) stopDHCPServerIfUnused() error {
+	users, err := d.dhcpServerUsers()
+	if err != nil {
+		return err
+	}
+
+	if len(users) > 0 {
+		log.Debugf("DHCP server on %s still used by %s", d.hostInterface(), strings.Join(users, ", "))
+		return nil
+	}
+
+	log.Debugf("No machines left using the DHCP server on %s", d.hostInterface())
+	return stopDHCPServer(d.dhcpDir())
+}
+
+// DHCPStatus writes whether the dnsmasq for each network in the store is running, and
+// the machines using it.
+func DHCPStatus(out io.Writer, storepath string) error {
+	dirs, err := ioutil.ReadDir(filepath.Join(storepath, dhcpDirname))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		d := NewDriver("", storepath)
+		d.Bridge = dir.Name()
+		status, err := dhcpServerStatus(d.dhcpDir())
+		if err != nil {
+			return err
+		}
+		users, err := d.dhcpServerUsers()
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			users = []string{"none"}
+		}
+		fmt.Fprintf(out, "%s: %s, used by %s\n", dir.Name(), status, strings.Join(users, ", "))
+	}
+
+	return nil
+}
+
+// checkLegacyDHCPServer checks for the single dnsmasq earlier versions of the driver ran
+// from the top of the store, which would stop the per-network one binding to its
+// interface. Its pid file is the user's, so the helper won't signal it.
+func checkLegacyDHCPServer(storepath string) error {
+	pid, err := readDHCPPid(storepath)
+	if err != nil || !processIs(pid, "dnsmasq") {
+		return nil
+	}
+
+	return fmt.Errorf("the DHCP server from an earlier version of the driver is still running, stop it with: "+
+		"kill %d && rm %s", pid, filepath.Join(storepath, dhcpPidFilename))
+}
+
+func startDHCPServer(storepath string, dhcpdir string, bridge string, dhcprange string, dnsdomain string, ipv6 bool) error {
+	log.Debugf("Starting DHCP Server")
+
+	if err := checkLegacyDHCPServer(storepath); err != nil {
+		return err
+	}
+
+	changed, err := writeDHCPConf(dhcpdir, bridge, dhcprange, dnsdomain, ipv6)
+	if err != nil {
+		return err
+	}
+
+	status, err := dhcpServerStatus(dhcpdir)
+	if err != nil {
+		return err
+	}
+
+	if status == state.Running && changed {
+		// dnsmasq only reads its config at startup
+		log.Debugf("DHCP server config changed, restarting")
+		if err := stopDHCPServer(dhcpdir); err != nil {
+			return err
+		}
+		status = state.Stopped
+	}
+
+	if status != state.Running {
+		err := privileged("start-dhcp", dhcpdir, bridge)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderDHCPConf(t *testing.T) {
+	tests := []struct {
+		name      string
+		dnsdomain string
+		ipv6      bool
+		want      []string
+		wantNot   []string
+	}{
+		{
+			name:    "dhcp only",
+			want:    []string{"bogus-priv\n", "interface=bridge0\n", "dhcp-range=192.168.99.100,192.168.99.254\n", "dhcp-hostsfile=/store/dnsmasq.d\n"},
+			wantNot: []string{"port=0", "no-resolv", "domain=", "enable-ra"},
+		},
+		{
+			name:      "dns",
+			dnsdomain: "docker-machine.local",
+			want:      []string{"bogus-priv\n", "domain=docker-machine.local\n", "local=/docker-machine.local/\n", "expand-hosts\n"},
+			wantNot:   []string{"port=0", "no-resolv", "enable-ra"},
+		},
+		{
+			name:    "ipv6",
+			ipv6:    true,
+			want:    []string{"enable-ra\n", "dhcp-range=::100,::1ff,constructor:bridge0,slaac,64,12h\n"},
+			wantNot: []string{"domain="},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := renderDHCPConf("bridge0", defaultHostOnlyCIDR, "/store/dnsmasq.d", tt.dnsdomain, tt.ipv6)
+			for _, want := range tt.want {
+				if !strings.Contains(conf, want) {
+					t.Errorf("config doesn't contain %q:\n%s", want, conf)
+				}
+			}
+			for _, notwant := range tt.wantNot {
+				if strings.Contains(conf, notwant) {
+					t.Errorf("config contains %q:\n%s", notwant, conf)
+				}
+			}
+			_, network, _ := net.ParseCIDR(defaultSubnet)
+			if err := validateDHCPConf(conf, "bridge0", "/store/dnsmasq.d", []*net.IPNet{network}); err != nil {
+				t.Errorf("the helper refuses the config: %s", err)
+			}
+		})
+	}
+}
+
+func TestRenderDHCPHost(t *testing.T) {
+	if got := renderDHCPHost("58:9c:fc:00:00:01", "", "dev"); got != "58:9c:fc:00:00:01,dev\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := renderDHCPHost("58:9c:fc:00:00:01", "192.168.99.10", "dev"); got != "58:9c:fc:00:00:01,192.168.99.10,dev\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWriteDHCPHostReservation(t *testing.T) {
+	dhcpdir, err := ioutil.TempDir("", "dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dhcpdir)
+
+	if err := writeDHCPHost(dhcpdir, "one", "58:9c:fc:00:00:01", "192.168.99.10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeDHCPHost(dhcpdir, "two", "58:9c:fc:00:00:02", "192.168.99.10"); err == nil {
+		t.Error("reserved an address already reserved by another machine")
+	}
+	if err := writeDHCPHost(dhcpdir, "one", "58:9c:fc:00:00:01", "192.168.99.10"); err != nil {
+		t.Errorf("rewriting a machine's own reservation failed: %s", err)
+	}
+
+	if err := removeDHCPHost(dhcpdir, "one"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dhcpdir, dhcpHostsDirname, "one")); !os.IsNotExist(err) {
+		t.Errorf("host entry not removed: %v", err)
+	}
+}
+
+// writeStoredMachine writes a machine's config.json as docker-machine would
+func writeStoredMachine(t *testing.T, storepath string, name string, driver string) {
+	dir := filepath.Join(storepath, "machines", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := `{"Name": "` + name + `", "DriverName": "bhyve", "Driver": ` + driver + `}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckNetworkSettings(t *testing.T) {
+	storepath, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storepath)
+
+	writeStoredMachine(t, storepath, "bridged",
+		`{"Bridge": "bridge0", "Subnet": "192.168.99.1/24", "DHCPRange": "192.168.99.100,192.168.99.254"}`)
+	writeStoredMachine(t, storepath, "switched",
+		`{"Bridge": "bridge0", "NetworkBackend": "vale", "ValeSwitch": "vale0", "Subnet": "10.0.0.1/24", "DHCPRange": "10.0.0.100,10.0.0.200"}`)
+	writeStoredMachine(t, storepath, "switched6",
+		`{"Bridge": "bridge0", "NetworkBackend": "vale", "ValeSwitch": "vale2", "Subnet": "10.0.2.1/24", "DHCPRange": "10.0.2.100,10.0.2.200", "EnableIPv6": true, "Subnet6": "fd00:aa::1/48"}`)
+
+	tests := []struct {
+		name    string
+		change  func(d *Driver)
+		wantErr bool
+	}{
+		{"same settings", func(d *Driver) {}, false},
+		{"other range", func(d *Driver) { d.DHCPRange = "192.168.99.50,192.168.99.60" }, true},
+		{"dns", func(d *Driver) { d.EnableDNS = true }, true},
+		{"ipv6", func(d *Driver) { d.EnableIPv6 = true }, true},
+		{"other bridge", func(d *Driver) {
+			d.Bridge = "bridge1"
+			d.Subnet = "192.168.98.1/24"
+			d.DHCPRange = "192.168.98.100,192.168.98.254"
+		}, false},
+		{"same subnet on other bridge", func(d *Driver) { d.Bridge = "bridge1" }, true},
+		{"subnet inside another on other bridge", func(d *Driver) {
+			d.Bridge = "bridge1"
+			d.Subnet = "192.168.99.129/25"
+			d.DHCPRange = "192.168.99.200,192.168.99.250"
+		}, true},
+		{"subnet around another on other bridge", func(d *Driver) {
+			d.Bridge = "bridge1"
+			d.Subnet = "192.168.0.1/16"
+			d.DHCPRange = "192.168.1.100,192.168.1.254"
+		}, true},
+		{"same subnet written differently on other bridge", func(d *Driver) {
+			d.Bridge = "bridge1"
+			d.Subnet = "192.168.99.2/24"
+		}, true},
+		{"other vale switch", func(d *Driver) {
+			d.NetworkBackend = networkBackendVale
+			d.ValeSwitch = "vale1"
+			d.Subnet = "10.0.1.1/24"
+			d.DHCPRange = "10.0.1.100,10.0.1.200"
+		}, false},
+		{"ipv6 subnet inside another on other vale switch", func(d *Driver) {
+			d.NetworkBackend = networkBackendVale
+			d.ValeSwitch = "vale1"
+			d.Subnet = "10.0.1.1/24"
+			d.DHCPRange = "10.0.1.100,10.0.1.200"
+			d.EnableIPv6 = true
+			d.Subnet6 = "fd00:aa:0:1::1/64"
+		}, true},
+		{"other ipv6 subnet on other vale switch", func(d *Driver) {
+			d.NetworkBackend = networkBackendVale
+			d.ValeSwitch = "vale1"
+			d.Subnet = "10.0.1.1/24"
+			d.DHCPRange = "10.0.1.100,10.0.1.200"
+			d.EnableIPv6 = true
+			d.Subnet6 = "fd00:bb::1/64"
+		}, false},
+		{"same vale switch", func(d *Driver) {
+			d.NetworkBackend = networkBackendVale
+			d.ValeSwitch = "vale0"
+			d.Subnet = "10.0.0.1/24"
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDriver("new", storepath)
+			tt.change(d)
+			err := d.checkNetworkSettings()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkNetworkSettings() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDHCPDirPerNetwork(t *testing.T) {
+	bridged := NewDriver("bridged", "/store")
+	switched := NewDriver("switched", "/store")
+	switched.NetworkBackend = networkBackendVale
+
+	if bridged.dhcpDir() == switched.dhcpDir() {
+		t.Errorf("bridge and VALE machines share %s", bridged.dhcpDir())
+	}
+	if bridged.dhcpDir() != NewDriver("other", "/store").dhcpDir() {
+		t.Error("machines on the same bridge don't share a DHCP server")
+	}
+}
+
+func TestCheckLegacyDHCPServer(t *testing.T) {
+	storepath, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storepath)
+	defer withProcesses(fakeProcesses{100: "dnsmasq"})()
+
+	if err := checkLegacyDHCPServer(storepath); err != nil {
+		t.Errorf("checkLegacyDHCPServer() = %v without a legacy server", err)
+	}
+
+	pidfile := filepath.Join(storepath, dhcpPidFilename)
+	if err := ioutil.WriteFile(pidfile, []byte("200\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLegacyDHCPServer(storepath); err != nil {
+		t.Errorf("checkLegacyDHCPServer() = %v for a stale pid file", err)
+	}
+
+	if err := ioutil.WriteFile(pidfile, []byte("100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLegacyDHCPServer(storepath); err == nil || !strings.Contains(err.Error(), "kill 100") {
+		t.Errorf("checkLegacyDHCPServer() = %v, want how to stop it", err)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultRCConf   = "/etc/rc.conf"
+	defaultSudoers  = "/usr/local/etc/sudoers.d/docker-machine-driver-bhyve"
+	defaultDoasConf = "/usr/local/etc/doas.conf"
+	devfsRuleNMDM   = "add path 'nmdm*' mode 0660"
+	defaultRuleset  = "system"
+	requiredKldList = "vmm nmdm ng_ether"
+)
+
+var devfsSectionRegex = regexp.MustCompile(`^\[([^=\]]+)=(\d+)\]`)
+
+// doctorFix is a change to a host config file. check, if set, validates the new
+// contents before they're installed.
+type doctorFix struct {
+	filename string
+	mode     string
+	from     string
+	to       string
+	check    func(r commandRunner, content string) error
+}
+
+// rcVar returns the value of the last assignment to name in an rc.conf
+func rcVar(rcconf string, name string) string {
+	value := ""
+	for _, line := range strings.Split(rcconf, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, name+"=") {
+			value = strings.Trim(strings.TrimPrefix(line, name+"="), `"'`)
+		}
+	}
+	return value
+}
+
+// setRCVar replaces the last assignment to name in an rc.conf, or appends one
+func setRCVar(rcconf string, name string, value string) string {
+	lines := strings.Split(strings.TrimSuffix(rcconf, "\n"), "\n")
+	assignment := name + `="` + value + `"`
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), name+"=") {
+			lines[i] = assignment
+			return strings.Join(lines, "\n") + "\n"
+		}
+	}
+	if rcconf == "" {
+		return assignment + "\n"
+	}
+	return strings.Join(lines, "\n") + "\n" + assignment + "\n"
+}
+
+// fixRCConf adds the driver's kernel modules to kld_list and sets a devfs ruleset
+func fixRCConf(rcconf string, ruleset string) string {
+	kldlist := strings.Fields(rcVar(rcconf, "kld_list"))
+	changed := false
+	for _, kmod := range strings.Fields(requiredKldList) {
+		found := false
+		for _, loaded := range kldlist {
+			if loaded == kmod {
+				found = true
+			}
+		}
+		if !found {
+			kldlist = append(kldlist, kmod)
+			changed = true
+		}
+	}
+	if changed {
+		rcconf = setRCVar(rcconf, "kld_list", strings.Join(kldlist, " "))
+	}
+
+	if rcVar(rcconf, "devfs_system_ruleset") == "" {
+		rcconf = setRCVar(rcconf, "devfs_system_ruleset", ruleset)
+	}
+	return rcconf
+}
+
+// fixDevfsRules adds the nmdm rule to ruleset, adding the ruleset if needed
+func fixDevfsRules(rules string, ruleset string) string {
+	if devfsAllowsNMDM(rules, ruleset, 0) {
+		return rules
+	}
+
+	lines := strings.Split(strings.TrimSuffix(rules, "\n"), "\n")
+	number := 10
+	used := map[int]bool{}
+	for i, line := range lines {
+		m := devfsSectionRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		if m[1] == ruleset {
+			lines = append(lines[:i+1], append([]string{devfsRuleNMDM}, lines[i+1:]...)...)
+			return strings.Join(lines, "\n") + "\n"
+		}
+		n, _ := strconv.Atoi(m[2])
+		used[n] = true
+	}
+	for used[number] {
+		number++
+	}
+
+	section := fmt.Sprintf("[%s=%d]\n%s\n", ruleset, number, devfsRuleNMDM)
+	if strings.TrimSpace(rules) == "" {
+		return section
+	}
+	return strings.TrimSuffix(rules, "\n") + "\n\n" + section
+}
+
+// sudoersEntry returns the sudoers line letting username run the helper as root
+func sudoersEntry(username string, helper string) string {
+	return username + " ALL=(root) NOPASSWD: " + helper + " " + helperSubcommand + " *"
+}
+
+// renderSudoers returns a sudoers fragment allowing only the helper
+func renderSudoers(username string, helper string) string {
+	return "# Written by docker-machine-driver-bhyve doctor\n" + sudoersEntry(username, helper) + "\n"
+}
+
+// checkSudoers has visudo check a sudoers fragment, as a broken one in sudoers.d
+// stops sudo working at all
+func checkSudoers(r commandRunner, content string) error {
+	tmpfile, err := ioutil.TempFile("", "sudoers")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.WriteString(content); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	if _, err := r.output("visudo", "-cf", tmpfile.Name()); err != nil {
+		return fmt.Errorf("visudo rejected the sudoers entry: %s", err)
+	}
+	return nil
+}
+
+// doasEntry returns the doas.conf rule letting username run the driver as root, doas
+// can't limit the arguments to a prefix so CheckDoas and the helper do the checking
+func doasEntry(username string, helper string) string {
+	return "permit nopass " + username + " as root cmd " + helper
+}
+
+// fixDoasConf appends the rule for username to a doas.conf, unless it's already there
+func fixDoasConf(doasconf string, username string, helper string) string {
+	entry := doasEntry(username, helper)
+	for _, line := range strings.Split(doasconf, "\n") {
+		if strings.TrimSpace(line) == entry {
+			return doasconf
+		}
+	}
+	if strings.TrimSpace(doasconf) == "" {
+		return entry + "\n"
+	}
+	return strings.TrimSuffix(doasconf, "\n") + "\n" + entry + "\n"
+}
+
+func readConfig(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// doctorFixes returns the changes to make for the failed checks
+func doctorFixes(p preflight, rcconffile string, sudoersfile string, doasconffile string,
+	failed map[string]bool) ([]doctorFix, error) {
+	var fixes []doctorFix
+
+	if e := p.escalation(); failed["privilege"] && e != privilegeNone {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		if e == privilegeDoas {
+			from, err := readConfig(doasconffile)
+			if err != nil {
+				return nil, err
+			}
+			fixes = append(fixes, doctorFix{doasconffile, "0644", from, fixDoasConf(from, u.Username, p.helper), nil})
+		} else {
+			from, err := readConfig(sudoersfile)
+			if err != nil {
+				return nil, err
+			}
+			fixes = append(fixes, doctorFix{sudoersfile, "0440", from, renderSudoers(u.Username, p.helper), checkSudoers})
+		}
+	}
+
+	rcconf, err := readConfig(rcconffile)
+	if err != nil {
+		return nil, err
+	}
+	ruleset := rcVar(rcconf, "devfs_system_ruleset")
+	if ruleset == "" {
+		ruleset = defaultRuleset
+	}
+
+	if failed["devfs"] {
+		from, err := readConfig(p.devfsRules)
+		if err != nil {
+			return nil, err
+		}
+		fixes = append(fixes, doctorFix{p.devfsRules, "0644", from, fixDevfsRules(from, ruleset), nil})
+	}
+
+	if failed["kmods"] || failed["devfs"] {
+		fixes = append(fixes, doctorFix{rcconffile, "0644", rcconf, fixRCConf(rcconf, ruleset), nil})
+	}
+
+	return fixes, nil
+}
+
+// Doctor checks the host is set up for the driver, printing the result of each check to out.
+// privilege is how to get root, as for --bhyve-privilege. With fix, it shows the changes
+// to the sudoers or doas.conf, devfs.rules and rc.conf files that would fix the problems,
+// and makes them once confirmed on in.
+func Doctor(out io.Writer, in io.Reader, storagePath string, privilege string, fix bool) error {
+	if err := validatePrivilege(privilege); err != nil {
+		return err
+	}
+	setPrivilege(privilege)
+
+	helper, err := helperPath()
+	if err != nil {
+		return err
+	}
+
+	p := preflight{
+		runner:     runner,
+		devfsRules: defaultDevfsRules,
+		dmesgBoot:  defaultDmesgBoot,
+		firmware:   defaultFirmware,
+		helper:     helper,
+		privilege:  privilege,
+		storePath:  storagePath,
+		diskSize:   defaultDiskSize * 1024 * 1024,
+	}
+
+	privilegename := "password-less " + p.escalation() + " for the helper"
+	if p.escalation() == privilegeNone {
+		privilegename = "running as root"
+	}
+
+	checks := []struct {
+		key   string
+		name  string
+		check func() []preflightFailure
+	}{
+		{"commands", "required commands", p.checkCommands},
+		{"privilege", privilegename, p.checkPrivilege},
+		{"kmods", "kernel modules", p.checkKmods},
+		{"cpu", "hardware virtualization", p.checkVirtualization},
+		{"devfs", "devfs rules for nmdm", p.checkDevfs},
+		{"fdescfs", "fdescfs on /dev/fd", p.checkFdescfs},
+		{"disk", "free space in " + storagePath, p.checkDiskSpace},
+	}
+
+	failed := map[string]bool{}
+	for _, c := range checks {
+		failures := c.check()
+		if len(failures) == 0 {
+			fmt.Fprintf(out, "[ OK ] %s\n", c.name)
+			continue
+		}
+		failed[c.key] = true
+		fmt.Fprintf(out, "[FAIL] %s\n", c.name)
+		for _, f := range failures {
+			fmt.Fprintf(out, "       %s\n", f.problem)
+			for _, line := range strings.Split(f.hint, "\n") {
+				fmt.Fprintf(out, "         %s\n", line)
+			}
+		}
+	}
+
+	if len(failed) == 0 {
+		fmt.Fprintln(out, "The host is ready for docker-machine-driver-bhyve")
+		return nil
+	}
+	if !fix {
+		return fmt.Errorf("%d check(s) failed, run with --fix to fix the host config", len(failed))
+	}
+
+	fixes, err := doctorFixes(p, defaultRCConf, defaultSudoers, defaultDoasConf, failed)
+	if err != nil {
+		return err
+	}
+
+	var changes []doctorFix
+	for _, f := range fixes {
+		if diff := unifiedDiff(f.filename, f.from, f.to); diff != "" {
+			fmt.Fprint(out, "\n"+diff)
+			changes = append(changes, f)
+		}
+	}
+	if len(changes) == 0 {
+		return fmt.Errorf("%d check(s) failed which --fix can't fix", len(failed))
+	}
+
+	for _, f := range changes {
+		if f.check == nil {
+			continue
+		}
+		if err := f.check(p.runner, f.to); err != nil {
+			return fmt.Errorf("not writing %s: %s", f.filename, err)
+		}
+	}
+
+	if in != nil {
+		fmt.Fprint(out, "\nApply these changes? [y/N] ")
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return fmt.Errorf("no changes made")
+		}
+	}
+
+	for _, f := range changes {
+		if err := installAsRoot(f.filename, f.to, f.mode); err != nil {
+			return fmt.Errorf("failed to write %s: %s", f.filename, err)
+		}
+		fmt.Fprintf(out, "Wrote %s\n", f.filename)
+	}
+
+	if failed["kmods"] {
+		fmt.Fprintln(out, "Load the kernel modules now with: kldload "+requiredKldList)
+	}
+	if failed["devfs"] {
+		fmt.Fprintln(out, "Apply the devfs rules now with: service devfs restart")
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetRCVar(t *testing.T) {
+	tests := []struct {
+		name   string
+		rcconf string
+		want   string
+	}{
+		{"empty", "", `kld_list="vmm"` + "\n"},
+		{"appends", "hostname=\"box\"\n", "hostname=\"box\"\n" + `kld_list="vmm"` + "\n"},
+		{"missing trailing newline", "hostname=\"box\"", "hostname=\"box\"\n" + `kld_list="vmm"` + "\n"},
+		{"replaces", "kld_list=\"nmdm\"\nhostname=\"box\"\n", `kld_list="vmm"` + "\nhostname=\"box\"\n"},
+		{"replaces the last", "kld_list=\"nmdm\"\nkld_list=\"if_bridge\"\n", "kld_list=\"nmdm\"\n" + `kld_list="vmm"` + "\n"},
+		{"replaces indented", "  kld_list='nmdm'\n", `kld_list="vmm"` + "\n"},
+		{"leaves comments", "#kld_list=\"nmdm\"\n# kld_list=\"nmdm\"\n",
+			"#kld_list=\"nmdm\"\n# kld_list=\"nmdm\"\n" + `kld_list="vmm"` + "\n"},
+		{"leaves other variables", "kld_list_extra=\"nmdm\"\n", "kld_list_extra=\"nmdm\"\n" + `kld_list="vmm"` + "\n"},
+		{"no change needed", `kld_list="vmm"` + "\n", `kld_list="vmm"` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := setRCVar(tt.rcconf, "kld_list", "vmm"); got != tt.want {
+				t.Errorf("setRCVar() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFixRCConf(t *testing.T) {
+	tests := []struct {
+		name    string
+		rcconf  string
+		ruleset string
+		want    string
+	}{
+		{"empty", "", "system", "kld_list=\"vmm nmdm ng_ether\"\ndevfs_system_ruleset=\"system\"\n"},
+		{"adds to kld_list", "kld_list=\"if_bridge vmm\"\ndevfs_system_ruleset=\"system\"\n", "system",
+			"kld_list=\"if_bridge vmm nmdm ng_ether\"\ndevfs_system_ruleset=\"system\"\n"},
+		{"commented kld_list", "#kld_list=\"vmm nmdm ng_ether\"\ndevfs_system_ruleset=\"jails\"\n", "jails",
+			"#kld_list=\"vmm nmdm ng_ether\"\ndevfs_system_ruleset=\"jails\"\nkld_list=\"vmm nmdm ng_ether\"\n"},
+		{"missing trailing newline", "hostname=\"box\"", "system",
+			"hostname=\"box\"\nkld_list=\"vmm nmdm ng_ether\"\ndevfs_system_ruleset=\"system\"\n"},
+		{"no change needed", "kld_list=\"ng_ether nmdm vmm\"\ndevfs_system_ruleset=\"jails\"", "system",
+			"kld_list=\"ng_ether nmdm vmm\"\ndevfs_system_ruleset=\"jails\""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fixRCConf(tt.rcconf, tt.ruleset); got != tt.want {
+				t.Errorf("fixRCConf() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFixDoasConf(t *testing.T) {
+	entry := doasEntry("me", testHelper)
+	if entry != "permit nopass me as root cmd "+testHelper {
+		t.Errorf("doasEntry() = %q", entry)
+	}
+
+	tests := []struct {
+		name     string
+		doasconf string
+		want     string
+	}{
+		{"empty", "", entry + "\n"},
+		{"blank", "\n\n", entry + "\n"},
+		{"appends", "permit :wheel\n", "permit :wheel\n" + entry + "\n"},
+		{"missing trailing newline", "permit :wheel", "permit :wheel\n" + entry + "\n"},
+		{"commented entry", "# " + entry + "\n", "# " + entry + "\n" + entry + "\n"},
+		{"no change needed", "permit :wheel\n  " + entry + "\npermit nopass root\n",
+			"permit :wheel\n  " + entry + "\npermit nopass root\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fixDoasConf(tt.doasconf, "me", testHelper); got != tt.want {
+				t.Errorf("fixDoasConf() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderSudoers(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		want     string
+	}{
+		{"user", "me", "me ALL=(root) NOPASSWD: " + testHelper + " " + helperSubcommand + " *"},
+		{"dotted user", "first.last", "first.last ALL=(root) NOPASSWD: " + testHelper + " " + helperSubcommand + " *"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renderSudoers(tt.username, testHelper)
+			if !strings.HasSuffix(got, "\n") {
+				t.Errorf("renderSudoers() = %q doesn't end in a newline", got)
+			}
+			var rules []string
+			for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+				if !strings.HasPrefix(line, "#") {
+					rules = append(rules, line)
+				}
+			}
+			if len(rules) != 1 || rules[0] != tt.want {
+				t.Errorf("renderSudoers() rules = %q, want only %q", rules, tt.want)
+			}
+		})
+	}
+}
+
+// visudoHost answers visudo -cf from the file it's given, rejecting lines that look like
+// neither a comment nor a rule
+type visudoHost struct {
+	fakeHost
+	checked []string
+}
+
+func (h *visudoHost) output(name string, args ...string) ([]byte, error) {
+	if name != "visudo" || len(args) != 2 || args[0] != "-cf" {
+		return h.fakeHost.output(name, args...)
+	}
+	data, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return nil, err
+	}
+	h.checked = append(h.checked, args[1])
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if !strings.HasPrefix(line, "#") && !strings.Contains(line, " ALL=(root) ") {
+			return nil, errors.New("exit status 1")
+		}
+	}
+	return []byte(args[1] + ": parsed OK\n"), nil
+}
+
+func TestCheckSudoers(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"rendered", renderSudoers("me", testHelper), false},
+		{"broken", "me ALL=(root NOPASSWD\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := &visudoHost{fakeHost: healthyHost()}
+			err := checkSudoers(host, tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkSudoers() = %v, wantErr %t", err, tt.wantErr)
+			}
+			if len(host.checked) != 1 {
+				t.Fatalf("visudo checked %d files", len(host.checked))
+			}
+			if _, err := os.Stat(host.checked[0]); !os.IsNotExist(err) {
+				t.Errorf("%s left behind", host.checked[0])
+			}
+		})
+	}
+}
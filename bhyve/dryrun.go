@@ -0,0 +1,52 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// errDryRun stops docker-machine carrying on as if a dry run had done something
+var errDryRun = errors.New("dry run, nothing was changed")
+
+// dryRun reports whether to only show what would be done. --bhyve-dry-run isn't saved with
+// the machine, so BHYVE_DRY_RUN is also checked for start and rm.
+func (d *Driver) dryRun() bool {
+	env, _ := strconv.ParseBool(os.Getenv("BHYVE_DRY_RUN"))
+	return d.DryRun || env
+}
+
+// withDryRun runs f, or for a dry run, records what f does instead and prints the
+// commands and changes in order, returning errDryRun
+func (d *Driver) withDryRun(op string, f func() error) error {
+	if _, recording := runner.(*recordingRunner); recording || !d.dryRun() {
+		return f()
+	}
+
+	rec := &recordingRunner{queries: runner}
+	// grub-bhyve is retried until it shows it's loaded the kernel
+	if grub, err := helperArgs("grub"); err == nil {
+		rec.reply(strings.Join(grub, " "), "GNU GRUB")
+	}
+
+	saved := runner
+	runner = rec
+	err := f()
+	runner = saved
+
+	log.Infof("Dry run of %s for %s, it would:", op, d.MachineName)
+	for _, line := range rec.recorded {
+		log.Infof("  %s", line)
+	}
+	if err != nil {
+		return err
+	}
+	return errDryRun
+}
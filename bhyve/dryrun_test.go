@@ -0,0 +1,166 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDriver returns a boot2docker machine in a new store, and a runner recording what
+// the driver does with it
+func testDriver(t *testing.T) (*Driver, *recordingRunner) {
+	storepath := testStore(t, "dev")
+	d := NewDriver("dev", storepath)
+	d.MACAddress = "58:9c:fc:00:00:01"
+
+	rec := &recordingRunner{}
+	if grub, err := helperArgs("grub"); err == nil {
+		rec.reply(strings.Join(grub, " "), "GNU GRUB")
+	}
+	if tap, err := helperArgs("create-tap"); err == nil {
+		rec.reply(strings.Join(tap, " "), "tap0\n")
+	}
+	return d, rec
+}
+
+// checkOrder checks each of want is in a line of recorded, in the order given
+func checkOrder(t *testing.T, recorded []string, want ...string) {
+	i := 0
+	for _, line := range recorded {
+		if i < len(want) && strings.Contains(line, want[i]) {
+			i++
+		}
+	}
+	if i < len(want) {
+		t.Errorf("%q is missing or out of order in:\n%s", want[i], strings.Join(recorded, "\n"))
+	}
+}
+
+func TestCreateOrder(t *testing.T) {
+	defer withRunDir(t)()
+	defer withProcesses(fakeProcesses{})()
+	d, rec := testDriver(t)
+	defer os.RemoveAll(d.StorePath)
+	defer withRunner(rec)()
+
+	// the ISO and DHCP config are only recorded, not really written
+	d.ISOSHA256 = strings.Repeat("0", 64)
+	d.StaticIP = "192.168.99.150"
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	checkOrder(t, rec.recorded,
+		"# copy boot2docker.iso to "+d.ResolveStorePath(""),
+		"# write "+d.ResolveStorePath(diskname),
+		"# create "+filepath.Join(d.dhcpDir(), dhcpHostsDirname),
+		"# write "+filepath.Join(d.dhcpDir(), dhcpHostsDirname, "dev"),
+		"# write "+filepath.Join(d.dhcpDir(), dhcpConfFilename),
+		helperSubcommand+" start-dhcp "+d.dhcpDir()+" bridge0",
+		"# check the SHA-256 of "+d.ResolveStorePath(isoFilename),
+		"# write "+d.ResolveStorePath("device.map"),
+		helperSubcommand+" grub "+d.ResolveStorePath("device.map"),
+		helperSubcommand+" nmdm-users /dev/nmdm0A",
+		helperSubcommand+" create-tap bridge0",
+		"# write "+d.ResolveStorePath(vmConfigFilename),
+		"/usr/sbin/daemon -f -p "+d.ResolveStorePath("nmdm.pid"),
+		helperSubcommand+" start-vm "+d.ResolveStorePath(vmConfigFilename),
+		"# wait for dev to get an IP address",
+		"# install the userdata in dev",
+	)
+	if _, err := os.Stat(d.dhcpDir()); !os.IsNotExist(err) {
+		t.Errorf("%s was created", d.dhcpDir())
+	}
+}
+
+func TestStartOrder(t *testing.T) {
+	defer withRunDir(t)()
+	defer withProcesses(fakeProcesses{})()
+	d, rec := testDriver(t)
+	defer os.RemoveAll(d.StorePath)
+	defer withRunner(rec)()
+
+	d.NICs = []NIC{{Bridge: "bridge1", MACAddress: "58:9c:fc:00:00:02"}}
+	d.ShareMode = shareModeNFS
+	d.Shares = []Share{{HostPath: "/home/me/src", Tag: "src"}}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	checkOrder(t, rec.recorded,
+		helperSubcommand+" start-dhcp "+d.dhcpDir()+" bridge0",
+		helperSubcommand+" grub "+d.ResolveStorePath("device.map"),
+		helperSubcommand+" create-tap bridge0",
+		helperSubcommand+" create-tap bridge1",
+		"# write "+d.ResolveStorePath(vmConfigFilename),
+		helperSubcommand+" start-vm "+d.ResolveStorePath(vmConfigFilename),
+		"# wait for dev to get an IP address",
+		helperSubcommand+" export-shares dev",
+		"# mount the shares in dev",
+	)
+	if strings.Contains(strings.Join(rec.recorded, "\n"), "# install the userdata") {
+		t.Error("start installed the userdata, which only create does")
+	}
+}
+
+func TestRemoveOrder(t *testing.T) {
+	defer withRunDir(t)()
+	defer withProcesses(fakeProcesses{100: "dnsmasq"})()
+	d, rec := testDriver(t)
+	defer os.RemoveAll(d.StorePath)
+
+	if err := writeDHCPHost(d.dhcpDir(), d.MachineName, d.MACAddress, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dhcpRunDir(d.dhcpDir()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dhcpRunDir(d.dhcpDir()), dhcpPidFilename), []byte("100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(d.ResolveStorePath("nmdm.pid"), []byte("101"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer withRunner(rec)()
+
+	d.NetDev = "tap0"
+	d.ShareMode = shareModeNFS
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	checkOrder(t, rec.recorded,
+		helperSubcommand+" destroy-tap tap0",
+		"# kill the console logger",
+		"# remove "+d.ResolveStorePath(diskname),
+		"# remove "+d.ResolveStorePath(seedFilename),
+		"# remove "+filepath.Join(d.dhcpDir(), dhcpHostsDirname, "dev"),
+		"# remove dev from the ISO cache manifest",
+		helperSubcommand+" unexport-shares dev",
+		helperSubcommand+" signal-dhcp bridge0 TERM",
+		"# wait for dnsmasq to exit",
+	)
+}
+
+func TestStopDryRun(t *testing.T) {
+	defer withRunDir(t)()
+	d, _ := testDriver(t)
+	defer os.RemoveAll(d.StorePath)
+
+	// a dry run records the commands, nothing here gets run
+	defer withRunner(fakeHost{})()
+	d.DryRun = true
+	d.NetDev = "tap0"
+	if err := ioutil.WriteFile(d.ResolveStorePath("nmdm.pid"), []byte("101"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, op := range map[string]func() error{"kill": d.Kill, "stop": d.Stop, "restart": d.Restart} {
+		if err := op(); err != errDryRun {
+			t.Errorf("%s = %v, want a dry run", name, err)
+		}
+	}
+}
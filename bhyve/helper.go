@@ -0,0 +1,884 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// The driver runs as the user, and everything needing root goes through the helper, a
+// subcommand of the driver binary run via a single sudoers entry. The helper only does a
+// fixed set of operations and validates their arguments, so the user can't use it to run
+// arbitrary commands as root, or to hand bhyve or grub-bhyve files they don't own.
+const helperSubcommand = "helper"
+
+var (
+	vmNameRegex      = regexp.MustCompile(`^docker-machine-[a-zA-Z0-9_.-]+$`)
+	machineNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	ifaceRegex       = regexp.MustCompile(`^[a-z][a-z0-9_]{0,14}$`)
+	tapRegex         = regexp.MustCompile(`^tap[0-9]+$`)
+	nmdmRegex        = regexp.MustCompile(`^/dev/nmdm[0-9]+A$`)
+	macRegex         = regexp.MustCompile(`^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$`)
+	valePortRegex    = regexp.MustCompile(`^vale[a-zA-Z0-9_]+:[a-zA-Z0-9_]+$`)
+)
+
+// helperRunDir holds what the helper keeps for each user, such as dnsmasq's pid and
+// lease files, and who created each VM, tap, interface and VALE switch
+var helperRunDir = "/var/run/docker-machine-bhyve"
+
+const (
+	claimVM    = "vm"
+	claimTap   = "tap"
+	claimIface = "iface"
+	claimVale  = "vale"
+)
+
+// helperSysctls are the sysctls the helper will enable
+var helperSysctls = map[string]bool{
+	"net.inet.ip.forwarding":   true,
+	"net.inet6.ip6.forwarding": true,
+}
+
+// dnsmasqOptions are the config options renderDHCPConf writes, the helper refuses
+// anything else, such as dhcp-script, which would run as root
+var dnsmasqOptions = map[string]bool{
+	"domain-needed": true, "bogus-priv": true, "except-interface": true,
+	"bind-interfaces": true, "local-service": true, "dhcp-authoritative": true, "interface": true,
+	"dhcp-range": true, "dhcp-hostsfile": true, "enable-ra": true, "domain": true, "local": true,
+	"expand-hosts": true,
+}
+
+// helperOp is an operation the helper does, args is the exact number of arguments or
+// -1 for at least one
+type helperOp struct {
+	args int
+	run  func(u helperUser, args []string) error
+}
+
+var helperOps = map[string]helperOp{
+	"check":                  {0, helperCheck},
+	"sysctl-enable":          {1, helperSysctlEnable},
+	"setup-net":              {3, helperSetupNet},
+	"setup-net6":             {2, helperSetupNet6},
+	"ensure-bridge":          {1, helperEnsureBridge},
+	"create-tap":             {1, helperCreateTap},
+	"destroy-tap":            {1, helperDestroyTap},
+	"destroy-vale-host-port": {2, helperDestroyValeHostPort},
+	"nmdm-users":             {1, helperNMDMUsers},
+	"grub":                   {3, helperGrub},
+	"start-vm":               {1, helperStartVM},
+	"destroy-vm":             {1, helperDestroyVM},
+	"start-dhcp":             {2, helperStartDHCP},
+	"signal-dhcp":            {2, helperSignalDHCP},
+	"export-shares":          {-1, helperExportShares},
+	"unexport-shares":        {1, helperUnexportShares},
+}
+
+// helperUser is the user the helper was run for
+type helperUser struct {
+	uid int
+	gid int
+}
+
+// currentHelperUser returns the user who ran the helper through sudo or doas, or root
+// if it was run directly
+func currentHelperUser() (helperUser, error) {
+	if os.Geteuid() != 0 {
+		return helperUser{}, errors.New("the helper must be run as root")
+	}
+
+	u := helperUser{}
+	if uid := os.Getenv("SUDO_UID"); uid != "" {
+		var err error
+		if u.uid, err = strconv.Atoi(uid); err != nil {
+			return helperUser{}, err
+		}
+		if u.gid, err = strconv.Atoi(os.Getenv("SUDO_GID")); err != nil {
+			return helperUser{}, err
+		}
+	} else if name := os.Getenv("DOAS_USER"); name != "" {
+		doasuser, err := user.Lookup(name)
+		if err != nil {
+			return helperUser{}, err
+		}
+		if u.uid, err = strconv.Atoi(doasuser.Uid); err != nil {
+			return helperUser{}, err
+		}
+		if u.gid, err = strconv.Atoi(doasuser.Gid); err != nil {
+			return helperUser{}, err
+		}
+	}
+	return u, nil
+}
+
+// owns checks path is a regular file, or a directory if dir is set, belonging to the user.
+// Symlinks are refused. This is only for paths handed on by name, files the helper gives
+// to bhyve or grub-bhyve are opened with open instead, so they can't be swapped after the
+// check.
+func (u helperUser) owns(path string, dir bool) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%s is not an absolute path", path)
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	return u.checkOwner(path, info, dir)
+}
+
+// open opens path, refusing symlinks, and checks what was opened is a regular file, or a
+// directory if dir is set, belonging to the user
+func (u helperUser) open(path string, flag int, dir bool) (*os.File, error) {
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("%s is not an absolute path", path)
+	}
+
+	// O_NONBLOCK so a fifo can't hang the helper before it's checked
+	f, err := os.OpenFile(path, flag|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		err = u.checkOwner(path, info, dir)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (u helperUser) checkOwner(path string, info os.FileInfo, dir bool) error {
+	if dir && !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	if !dir && !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("can't get the owner of %s", path)
+	}
+	if u.uid != 0 && int(st.Uid) != u.uid {
+		return fmt.Errorf("%s doesn't belong to uid %d", path, u.uid)
+	}
+	return nil
+}
+
+// fdPath returns the path a child opens f by, and keeps f open across exec. It needs
+// fdescfs mounted on /dev/fd, which preflight checks.
+func fdPath(f *os.File) (string, error) {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0)
+	if errno != 0 {
+		return "", errno
+	}
+	return "/dev/fd/" + strconv.Itoa(int(f.Fd())), nil
+}
+
+// runDir returns the user's directory under helperRunDir, creating it and the
+// subdirectories in names. They belong to root and the user's group, so the user can
+// read what the helper and dnsmasq write there but can't replace it.
+func (u helperUser) runDir(names ...string) (string, error) {
+	if err := ensureRootDir(helperRunDir, 0, 0755); err != nil {
+		return "", err
+	}
+	dir := helperRunDir
+	for _, name := range append([]string{strconv.Itoa(u.uid)}, names...) {
+		dir = filepath.Join(dir, name)
+		if err := ensureRootDir(dir, u.gid, 0750); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// ensureRootDir creates dir if needed, and makes sure it's a directory belonging to root
+// and gid with mode perm
+func ensureRootDir(dir string, gid int, perm os.FileMode) error {
+	if err := os.Mkdir(dir, perm); err != nil && !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || st.Uid != 0 {
+		return fmt.Errorf("%s is not a directory belonging to root", dir)
+	}
+	if int(st.Gid) != gid {
+		if err := os.Chown(dir, 0, gid); err != nil {
+			return err
+		}
+	}
+	if info.Mode().Perm() != perm {
+		return os.Chmod(dir, perm)
+	}
+	return nil
+}
+
+// claim records the user as the owner of the VM, tap, interface or VALE switch name, kind
+// says which. Something in use can only be claimed by the user already recorded as its owner.
+func (u helperUser) claim(kind string, name string, inuse bool) error {
+	dir := filepath.Join(helperRunDir, kind)
+	if err := ensureRootDir(helperRunDir, 0, 0755); err != nil {
+		return err
+	}
+	if err := ensureRootDir(dir, 0, 0755); err != nil {
+		return err
+	}
+
+	if inuse {
+		if err := u.checkClaim(kind, name); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), []byte(strconv.Itoa(u.uid)+"\n"), 0644)
+}
+
+// claimed reports whether anyone has claimed name
+func claimed(kind string, name string) bool {
+	return fileExists(filepath.Join(helperRunDir, kind, name))
+}
+
+// checkClaim checks the user is the recorded owner of the VM, tap, interface or VALE switch name
+func (u helperUser) checkClaim(kind string, name string) error {
+	if u.uid == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(helperRunDir, kind, name))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s %s wasn't created by the driver", kind, name)
+	}
+	if err != nil {
+		return err
+	}
+	if owner, err := strconv.Atoi(strings.TrimSpace(string(data))); err != nil || owner != u.uid {
+		return fmt.Errorf("%s %s doesn't belong to uid %d", kind, name, u.uid)
+	}
+	return nil
+}
+
+func validateIface(name string) error {
+	if !ifaceRegex.MatchString(name) {
+		return fmt.Errorf("invalid interface name %s", name)
+	}
+	return nil
+}
+
+// checkIface checks name is a bridge or VALE host port the user had the helper create
+func (u helperUser) checkIface(name string) error {
+	if err := validateIface(name); err != nil {
+		return err
+	}
+	return u.checkClaim(claimIface, name)
+}
+
+// claimIface claims the interface name before the helper creates it, or checks the user
+// created it if it already exists
+func (u helperUser) claimIface(name string) error {
+	if err := validateIface(name); err != nil {
+		return err
+	}
+	_, err := net.InterfaceByName(name)
+	return u.claim(claimIface, name, err == nil)
+}
+
+// ifaceNetworks returns the networks of the addresses on the interface name
+func ifaceNetworks(name string) ([]*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		if _, network, err := net.ParseCIDR(addr.String()); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
+
+// networkContaining returns the network in networks containing ip, or nil
+func networkContaining(networks []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return network
+		}
+	}
+	return nil
+}
+
+// userIfaces returns the interfaces claimed by the user, or every claimed one for root
+func (u helperUser) userIfaces() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(helperRunDir, claimIface))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ifaces []string
+	for _, f := range files {
+		if u.checkClaim(claimIface, f.Name()) == nil {
+			ifaces = append(ifaces, f.Name())
+		}
+	}
+	return ifaces, nil
+}
+
+// Helper runs one privileged operation, args are the operation name and its arguments.
+func Helper(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no helper operation given")
+	}
+
+	op, ok := helperOps[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown helper operation %s", args[0])
+	}
+	if (op.args >= 0 && len(args)-1 != op.args) || (op.args < 0 && len(args) < 2) {
+		return fmt.Errorf("wrong number of arguments for %s", args[0])
+	}
+
+	u, err := currentHelperUser()
+	if err != nil {
+		return err
+	}
+
+	return op.run(u, args[1:])
+}
+
+// helperCheck does nothing, running it checks the helper can be run as root
+func helperCheck(u helperUser, args []string) error {
+	return nil
+}
+
+func helperSysctlEnable(u helperUser, args []string) error {
+	if !helperSysctls[args[0]] {
+		return fmt.Errorf("sysctl %s is not allowed", args[0])
+	}
+	return easyCmd("sysctl", args[0]+"=1")
+}
+
+func helperSetupNet(u helperUser, args []string) error {
+	if _, _, err := net.ParseCIDR(args[1]); err != nil {
+		return err
+	}
+	if args[2] != "" {
+		if err := validateValeSwitch(args[2]); err != nil {
+			return err
+		}
+		if err := u.claim(claimVale, args[2], claimed(claimVale, args[2])); err != nil {
+			return err
+		}
+	}
+	if err := u.claimIface(args[0]); err != nil {
+		return err
+	}
+	return setupnet(args[0], args[1], args[2])
+}
+
+func helperSetupNet6(u helperUser, args []string) error {
+	if err := u.checkIface(args[0]); err != nil {
+		return err
+	}
+	if _, _, err := net.ParseCIDR(args[1]); err != nil {
+		return err
+	}
+	return setupnet6(args[0], args[1])
+}
+
+func helperEnsureBridge(u helperUser, args []string) error {
+	if err := u.claimIface(args[0]); err != nil {
+		return err
+	}
+	return ensureBridge(args[0])
+}
+
+func helperCreateTap(u helperUser, args []string) error {
+	if err := u.checkIface(args[0]); err != nil {
+		return err
+	}
+	tapdev, err := createTap(args[0])
+	if err != nil {
+		return err
+	}
+	if err := u.claim(claimTap, tapdev, false); err != nil {
+		return err
+	}
+	fmt.Println(tapdev)
+	return nil
+}
+
+func helperDestroyTap(u helperUser, args []string) error {
+	if !tapRegex.MatchString(args[0]) {
+		return fmt.Errorf("%s is not a tap interface", args[0])
+	}
+	if err := u.checkClaim(claimTap, args[0]); err != nil {
+		return err
+	}
+	return easyCmd("ifconfig", args[0], "destroy")
+}
+
+func helperDestroyValeHostPort(u helperUser, args []string) error {
+	if err := validateValeSwitch(args[0]); err != nil {
+		return err
+	}
+	if err := u.checkClaim(claimVale, args[0]); err != nil {
+		return err
+	}
+	if err := u.checkIface(args[1]); err != nil {
+		return err
+	}
+	return destroyValeHostPort(args[0], args[1])
+}
+
+func helperNMDMUsers(u helperUser, args []string) error {
+	if !nmdmRegex.MatchString(args[0]) {
+		return fmt.Errorf("%s is not an nmdm device", args[0])
+	}
+	out, err := runner.output("fuser", args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	return nil
+}
+
+func helperGrub(u helperUser, args []string) error {
+	devmap, memsize, vmname := args[0], args[1], args[2]
+	if mem, err := strconv.Atoi(memsize); err != nil || mem <= 0 {
+		return fmt.Errorf("invalid memory size %s", memsize)
+	}
+	if !vmNameRegex.MatchString(vmname) {
+		return fmt.Errorf("invalid VM name %s", vmname)
+	}
+
+	f, err := u.open(devmap, os.O_RDONLY, false)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	// grub-bhyve opens the disks in the device map as root, so it's given the ones
+	// checked here through /dev/fd, in a device map the user can't change
+	files, rootmap, err := openDeviceMap(u, string(data))
+	for _, f := range files {
+		defer f.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	tmpmap, err := writeRootTempFile("device.map", []byte(rootmap))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpmap)
+
+	if err := u.claim(claimVM, vmname, vmExists(vmname)); err != nil {
+		return err
+	}
+
+	out, err := bootGrub(tmpmap, memsize, vmname)
+	fmt.Print(string(out))
+	return err
+}
+
+// openDeviceMap opens the disk and CD in a grub device map, returning them and the
+// device map naming them by /dev/fd path
+func openDeviceMap(u helperUser, devmap string) ([]*os.File, string, error) {
+	var files []*os.File
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(devmap), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || (fields[0] != "(hd0)" && fields[0] != "(cd0)") {
+			return files, "", fmt.Errorf("invalid device map line %q", line)
+		}
+
+		flag := os.O_RDWR
+		if fields[0] == "(cd0)" {
+			flag = os.O_RDONLY
+		}
+		f, err := u.open(fields[1], flag, false)
+		if err != nil {
+			return files, "", err
+		}
+		files = append(files, f)
+
+		path, err := fdPath(f)
+		if err != nil {
+			return files, "", err
+		}
+		b.WriteString(fields[0] + " " + path + "\n")
+	}
+	return files, b.String(), nil
+}
+
+// writeRootTempFile writes data to a new temporary file only root can change, and
+// returns its name
+func writeRootTempFile(pattern string, data []byte) (string, error) {
+	f, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func vmExists(vmname string) bool {
+	return fileExists("/dev/vmm/" + vmname)
+}
+
+func helperStartVM(u helperUser, args []string) error {
+	f, err := u.open(args[0], os.O_RDONLY, false)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	var config vmConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if err := config.checkNICs(u); err != nil {
+		return err
+	}
+	files, err := config.openFiles(u)
+	if err != nil {
+		return err
+	}
+	if err := u.claim(claimVM, config.Name, vmExists(config.Name)); err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return err
+	}
+
+	// replace the helper, daemon(8) is waiting on this process. files stay open in bhyve.
+	argv := append([]string{"bhyve"}, config.bhyveArgs()...)
+	err = syscall.Exec("/usr/sbin/bhyve", argv, []string{"PATH=/sbin:/bin:/usr/sbin:/usr/bin"})
+	for _, f := range files {
+		f.Close()
+	}
+	return err
+}
+
+func helperDestroyVM(u helperUser, args []string) error {
+	if !vmNameRegex.MatchString(args[0]) {
+		return fmt.Errorf("invalid VM name %s", args[0])
+	}
+	if err := u.checkClaim(claimVM, args[0]); err != nil {
+		return err
+	}
+	return easyCmd("bhyvectl", "--destroy", "--vm="+args[0])
+}
+
+// validateDHCPConf checks a dnsmasq config only has the options the driver writes,
+// for the given interface and hosts directory, and only hands out addresses in networks
+func validateDHCPConf(conf string, bridge string, hostsdir string, networks []*net.IPNet) error {
+	scanner := bufio.NewScanner(strings.NewReader(conf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if !dnsmasqOptions[kv[0]] {
+			return fmt.Errorf("dnsmasq option %s is not allowed", kv[0])
+		}
+
+		switch kv[0] {
+		case "interface", "dhcp-hostsfile", "dhcp-range":
+			if len(kv) != 2 {
+				return fmt.Errorf("dnsmasq option %s needs a value", kv[0])
+			}
+		}
+		switch kv[0] {
+		case "interface":
+			if kv[1] != bridge {
+				return fmt.Errorf("dnsmasq interface %s doesn't match %s", kv[1], bridge)
+			}
+		case "dhcp-hostsfile":
+			if kv[1] != hostsdir {
+				return fmt.Errorf("dnsmasq hosts %s aren't in %s", kv[1], hostsdir)
+			}
+		case "dhcp-range":
+			if err := validateDHCPRange(kv[1], bridge, networks); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// validateDHCPRange checks a dnsmasq dhcp-range is either an IPv4 range inside one of
+// networks, or an IPv6 range constructed from the prefix on bridge
+func validateDHCPRange(dhcprange string, bridge string, networks []*net.IPNet) error {
+	fields := strings.Split(dhcprange, ",")
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid DHCP range %s", dhcprange)
+	}
+	constructed := false
+	for _, field := range fields[2:] {
+		if field == "constructor:"+bridge {
+			constructed = true
+		} else if strings.Contains(field, ":") {
+			return fmt.Errorf("dnsmasq dhcp-range option %s is not allowed", field)
+		}
+	}
+	if constructed {
+		return nil
+	}
+
+	start, end, err := parseDHCPRange(dhcprange)
+	if err != nil {
+		return err
+	}
+	network := networkContaining(networks, start)
+	if network == nil || !network.Contains(end) {
+		return fmt.Errorf("dnsmasq dhcp-range %s is not in a subnet of %s", dhcprange, bridge)
+	}
+	return nil
+}
+
+func helperStartDHCP(u helperUser, args []string) error {
+	dhcpdir, bridge := args[0], args[1]
+	if err := u.owns(dhcpdir, true); err != nil {
+		return err
+	}
+	if err := u.checkIface(bridge); err != nil {
+		return err
+	}
+	networks, err := ifaceNetworks(bridge)
+	if err != nil {
+		return err
+	}
+
+	f, err := u.open(filepath.Join(dhcpdir, dhcpConfFilename), os.O_RDONLY, false)
+	if err != nil {
+		return err
+	}
+	conf, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := validateDHCPConf(string(conf), bridge, filepath.Join(dhcpdir, dhcpHostsDirname), networks); err != nil {
+		return err
+	}
+
+	// dnsmasq writes its pid and leases as root, so they go where the user can't put
+	// a symlink in their place
+	rundir, err := u.runDir(bridge)
+	if err != nil {
+		return err
+	}
+
+	// give dnsmasq the config that was checked, which the user can't change
+	tmpconf, err := writeRootTempFile(dhcpConfFilename, conf)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpconf)
+
+	return easyCmd("dnsmasq", "-i", bridge, "-C", tmpconf, "-x", filepath.Join(rundir, dhcpPidFilename),
+		"-l", filepath.Join(rundir, dhcpLeaseFilename))
+}
+
+// helperSignalDHCP signals the user's dnsmasq on an interface
+func helperSignalDHCP(u helperUser, args []string) error {
+	if err := validateIface(args[0]); err != nil {
+		return err
+	}
+
+	var sig syscall.Signal
+	switch args[1] {
+	case "HUP":
+		sig = syscall.SIGHUP
+	case "TERM":
+		sig = syscall.SIGTERM
+	default:
+		return fmt.Errorf("signal %s is not allowed", args[1])
+	}
+
+	rundir, err := u.runDir(args[0])
+	if err != nil {
+		return err
+	}
+	pid, err := readDHCPPid(rundir)
+	if err != nil {
+		return err
+	}
+	if !processIs(pid, "dnsmasq") {
+		return fmt.Errorf("pid %d is not dnsmasq", pid)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+func helperExportShares(u helperUser, args []string) error {
+	machinename, ip, specs := args[0], args[1], args[2:]
+	if !machineNameRegex.MatchString(machinename) {
+		return fmt.Errorf("invalid machine name %s", machinename)
+	}
+	if err := u.checkExportIP(machinename, net.ParseIP(ip)); err != nil {
+		return err
+	}
+
+	// mountd reads the exports by name, so unlike the files given to bhyve the shares
+	// can be swapped after this check. Everything is mapped to the user though, so a
+	// swapped share only gives the guest what the user could already get at.
+	var shares []Share
+	for _, spec := range specs {
+		share := Share{HostPath: strings.TrimSuffix(spec, ":ro"), ReadOnly: strings.HasSuffix(spec, ":ro")}
+		if err := u.owns(share.HostPath, true); err != nil {
+			return err
+		}
+		if strings.ContainsAny(share.HostPath, " \t\n") {
+			return fmt.Errorf("can't export %s, it contains whitespace", share.HostPath)
+		}
+		shares = append(shares, share)
+	}
+
+	return exportNFSShares(machinename, shares, ip, u.uid, u.gid)
+}
+
+// checkExportIP checks ip is on a network the user had the helper set up, and isn't
+// leased to another machine there, so shares are only exported to the user's machines
+func (u helperUser) checkExportIP(machinename string, ip net.IP) error {
+	if ip == nil {
+		return errors.New("invalid IP address")
+	}
+
+	ifaces, err := u.userIfaces()
+	if err != nil {
+		return err
+	}
+	for _, iface := range ifaces {
+		networks, err := ifaceNetworks(iface)
+		if err != nil || networkContaining(networks, ip) == nil {
+			continue
+		}
+
+		leases, err := readDHCPLeases(filepath.Join(helperRunDir, strconv.Itoa(u.uid), iface, dhcpLeaseFilename))
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, lease := range leases {
+			if lease.IP.Equal(ip) && !lease.expired(now) && lease.Hostname != "" && lease.Hostname != machinename {
+				return fmt.Errorf("%s is leased to %s, not %s", ip, lease.Hostname, machinename)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not on a network set up by the driver", ip)
+}
+
+func helperUnexportShares(u helperUser, args []string) error {
+	if !machineNameRegex.MatchString(args[0]) {
+		return fmt.Errorf("invalid machine name %s", args[0])
+	}
+	return unexportNFSShares(args[0], u.uid)
+}
+
+// helperPath returns the driver binary, which is also the helper
+func helperPath() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+// helperEnv is prepended to the helper command when the driver is already root. The
+// helper then acts for root, rather than for whoever started a root shell with sudo or
+// doas, as it would going by the variables they set.
+var helperEnv = []string{"env", "-u", "SUDO_UID", "-u", "SUDO_GID", "-u", "SUDO_USER", "-u", "DOAS_USER"}
+
+// helperArgs returns the command running a helper operation as root
+func helperArgs(op string, args ...string) ([]string, error) {
+	path, err := helperPath()
+	if err != nil {
+		return nil, err
+	}
+	p, err := currentPrivilege()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := append([]string{path, helperSubcommand, op}, args...)
+	if p == privilegeNone {
+		cmd = append(append([]string(nil), helperEnv...), cmd...)
+	}
+	return rootCommand(cmd...)
+}
+
+// privileged runs a helper operation as root
+func privileged(op string, args ...string) error {
+	_, err := privilegedOutput(op, args...)
+	return err
+}
+
+// privilegedOutput runs a helper operation as root and returns what it printed
+func privilegedOutput(op string, args ...string) ([]byte, error) {
+	cmdargs, err := helperArgs(op, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("EXEC: " + strings.Join(cmdargs, " "))
+	stdout, stderr, err := runner.run(cmdargs[0], cmdargs[1:]...)
+	log.Debugf("STDOUT: %s", stdout)
+	log.Debugf("STDERR: %s", stderr)
+	if err != nil {
+		return stdout, fmt.Errorf("%s failed: %s: %s", op, err, strings.TrimSpace(string(stderr)))
+	}
+	return stdout, nil
+}
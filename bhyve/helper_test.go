@@ -0,0 +1,484 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// withRunDir points helperRunDir at a new temporary directory, returning a function
+// restoring and removing it
+func withRunDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := helperRunDir
+	helperRunDir = filepath.Join(dir, "docker-machine-bhyve")
+	return func() {
+		helperRunDir = saved
+		os.RemoveAll(dir)
+	}
+}
+
+// testOwner returns a user owning paths, giving them to another user when run as root
+// as root passes every ownership check
+func testOwner(t *testing.T, paths ...string) helperUser {
+	if os.Getuid() != 0 {
+		return helperUser{uid: os.Getuid(), gid: os.Getgid()}
+	}
+	for _, path := range paths {
+		if err := os.Lchown(path, 1001, 1001); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return helperUser{uid: 1001, gid: 1001}
+}
+
+func TestHelperOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk := filepath.Join(dir, "disk.img")
+	if err := ioutil.WriteFile(disk, []byte("disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.img")
+	if err := os.Symlink(disk, link); err != nil {
+		t.Fatal(err)
+	}
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	u := testOwner(t, dir, disk, link, fifo)
+
+	f, err := u.open(disk, os.O_RDWR, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if f, err := u.open(dir, os.O_RDONLY, true); err != nil {
+		t.Errorf("open() refused the user's directory: %s", err)
+	} else {
+		f.Close()
+	}
+	for _, path := range []string{link, fifo, dir, "disk.img"} {
+		if f, err := u.open(path, os.O_RDONLY, false); err == nil {
+			f.Close()
+			t.Errorf("open() accepted %s", path)
+		}
+	}
+
+	other := helperUser{uid: u.uid + 1, gid: u.gid}
+	if f, err := other.open(disk, os.O_RDONLY, false); err == nil {
+		f.Close()
+		t.Error("open() accepted another user's file")
+	}
+}
+
+func TestFdPath(t *testing.T) {
+	f, err := ioutil.TempFile("", "fdpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString("checked\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := fdPath(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(path, "/dev/fd/") {
+		t.Errorf("fdPath() = %s", path)
+	}
+
+	// a child opens the same file by the path, whatever is at the name now
+	if err := os.Remove(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("cat", path).Output()
+	if err != nil || string(out) != "checked\n" {
+		t.Errorf("child read %q, %v through %s", out, err, path)
+	}
+}
+
+func TestOpenDeviceMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk := filepath.Join(dir, "disk.img")
+	cd := filepath.Join(dir, "boot2docker.iso")
+	for _, path := range []string{disk, cd} {
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "passwd")
+	if err := os.Symlink("/etc/passwd", link); err != nil {
+		t.Fatal(err)
+	}
+	u := testOwner(t, disk, cd, link)
+
+	files, devmap, err := openDeviceMap(u, "(hd0) "+disk+"\n(cd0) "+cd+"\n")
+	for _, f := range files {
+		defer f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("opened %d files", len(files))
+	}
+	want := "(hd0) /dev/fd/" + strconv.Itoa(int(files[0].Fd())) + "\n" +
+		"(cd0) /dev/fd/" + strconv.Itoa(int(files[1].Fd())) + "\n"
+	if devmap != want {
+		t.Errorf("openDeviceMap() = %q, want %q", devmap, want)
+	}
+
+	for _, bad := range []string{"(hd0) " + link, "(hd1) " + disk, "(hd0) /etc/passwd", "(hd0)"} {
+		files, _, err := openDeviceMap(u, bad)
+		for _, f := range files {
+			f.Close()
+		}
+		if err == nil {
+			t.Errorf("openDeviceMap() accepted %q", bad)
+		}
+	}
+}
+
+func TestVMConfigOpenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk := filepath.Join(dir, "disk.img")
+	cd := filepath.Join(dir, "boot2docker.iso")
+	share := filepath.Join(dir, "src")
+	for _, path := range []string{disk, cd} {
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(share, 0755); err != nil {
+		t.Fatal(err)
+	}
+	u := testOwner(t, disk, cd, share)
+
+	config := vmConfig{
+		Name: "docker-machine-dev", CPUs: 1, MemoryMB: 1024, Disk: disk, CD: cd, Console: "/dev/nmdm0A",
+		NICs:   []vmNIC{{"virtio-net", "tap0", "58:9c:fc:00:00:01"}},
+		Shares: []Share{{HostPath: share, Tag: "src"}},
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := config.openFiles(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	args := strings.Join(config.bhyveArgs(), " ")
+	for i, want := range []string{"3:0,virtio-blk,", "5:0,ahci-cd,", "6:0,virtio-9p,src="} {
+		if !strings.Contains(args, want+"/dev/fd/"+strconv.Itoa(int(files[i].Fd()))) {
+			t.Errorf("bhyve isn't given %s by /dev/fd: %s", want, args)
+		}
+	}
+	if strings.Contains(args, dir) {
+		t.Errorf("bhyve is given paths it would open by name: %s", args)
+	}
+
+	// another user's share
+	config = vmConfig{Disk: disk, CD: cd, Shares: []Share{{HostPath: "/", Tag: "root"}}}
+	if files, err := config.openFiles(u); err == nil {
+		for _, f := range files {
+			f.Close()
+		}
+		t.Error("openFiles() accepted a share the user doesn't own")
+	}
+}
+
+// requireRoot skips tests of what the helper does as root
+func requireRoot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+}
+
+func TestHelperRunDir(t *testing.T) {
+	requireRoot(t)
+	defer withRunDir(t)()
+
+	u := helperUser{uid: 1001, gid: 1001}
+	dir, err := u.runDir("bridge0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(helperRunDir, "1001", "bridge0"); dir != want {
+		t.Errorf("runDir() = %s, want %s", dir, want)
+	}
+	for _, path := range []string{filepath.Join(helperRunDir, "1001"), dir} {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if st.Uid != 0 || st.Gid != 1001 || info.Mode().Perm() != 0750 {
+			t.Errorf("%s is %d:%d %o, want 0:1001 750", path, st.Uid, st.Gid, info.Mode().Perm())
+		}
+	}
+
+	// a symlink left by the user isn't followed
+	other := helperUser{uid: 1002, gid: 1002}
+	if err := os.Symlink("/etc", filepath.Join(helperRunDir, "1002")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.runDir("bridge0"); err == nil {
+		t.Error("runDir() followed a symlink")
+	}
+}
+
+func TestHelperClaim(t *testing.T) {
+	requireRoot(t)
+	defer withRunDir(t)()
+
+	owner := helperUser{uid: 1001, gid: 1001}
+	other := helperUser{uid: 1002, gid: 1002}
+
+	if err := owner.checkClaim(claimVM, "docker-machine-dev"); err == nil {
+		t.Error("checkClaim() accepted a VM nobody created")
+	}
+	if err := owner.claim(claimVM, "docker-machine-dev", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.checkClaim(claimVM, "docker-machine-dev"); err != nil {
+		t.Errorf("checkClaim() refused the owner: %s", err)
+	}
+	if err := other.checkClaim(claimVM, "docker-machine-dev"); err == nil {
+		t.Error("checkClaim() accepted another user")
+	}
+	if err := (helperUser{}).checkClaim(claimVM, "docker-machine-dev"); err != nil {
+		t.Errorf("checkClaim() refused root: %s", err)
+	}
+	if err := other.checkClaim(claimTap, "docker-machine-dev"); err == nil {
+		t.Error("a VM claim covers the tap of the same name")
+	}
+
+	// a running VM stays with its owner, once it's gone the name is free
+	if err := other.claim(claimVM, "docker-machine-dev", true); err == nil {
+		t.Error("claim() took another user's running VM")
+	}
+	if err := owner.claim(claimVM, "docker-machine-dev", true); err != nil {
+		t.Errorf("claim() refused the owner's running VM: %s", err)
+	}
+	if err := other.claim(claimVM, "docker-machine-dev", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.checkClaim(claimVM, "docker-machine-dev"); err == nil {
+		t.Error("the previous owner can still destroy the VM")
+	}
+}
+
+func TestValidateDHCPConf(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.99.1/24")
+	networks := []*net.IPNet{network}
+	base := "domain-needed\ninterface=bridge0\ndhcp-hostsfile=/store/dnsmasq.d\n"
+
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{"rendered", renderDHCPConf("bridge0", "192.168.99.100,192.168.99.254", "/store/dnsmasq.d", "local", true), false},
+		{"range with lease time", base + "dhcp-range=192.168.99.100,192.168.99.200,12h\n", false},
+		{"not allowed", base + "dhcp-script=/tmp/x\n", true},
+		{"bare interface", "interface\n", true},
+		{"bare hosts file", "dhcp-hostsfile\n", true},
+		{"bare range", "dhcp-range\n", true},
+		{"other interface", "interface=bridge1\n", true},
+		{"other hosts file", "dhcp-hostsfile=/etc\n", true},
+		{"range outside the subnet", base + "dhcp-range=10.0.0.100,10.0.0.200\n", true},
+		{"range leaving the subnet", base + "dhcp-range=192.168.99.100,192.168.100.20\n", true},
+		{"single address", base + "dhcp-range=192.168.99.100\n", true},
+		{"tagged range", base + "dhcp-range=set:x,192.168.99.100,192.168.99.200\n", true},
+		{"range on another interface", base + "dhcp-range=::100,::1ff,constructor:bridge1,slaac\n", true},
+		{"ipv6 range without constructor", base + "dhcp-range=fd00::100,fd00::1ff\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDHCPConf(tt.conf, "bridge0", "/store/dnsmasq.d", networks)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateDHCPConf() = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// loopbackIface returns the name of the loopback interface, lo0 on FreeBSD
+func loopbackIface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && ifaceRegex.MatchString(iface.Name) {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestHelperIfaceClaims(t *testing.T) {
+	requireRoot(t)
+	defer withRunDir(t)()
+	lo := loopbackIface(t)
+
+	owner := helperUser{uid: 1001, gid: 1001}
+	other := helperUser{uid: 1002, gid: 1002}
+
+	// interfaces the driver didn't create are off limits
+	if err := owner.claimIface(lo); err == nil {
+		t.Error("claimIface() took an existing interface")
+	}
+	if err := owner.checkIface(lo); err == nil {
+		t.Error("checkIface() accepted an interface nobody created")
+	}
+	for op, args := range map[string][]string{
+		"ensure-bridge":          {lo},
+		"setup-net":              {lo, "192.168.99.1/24", ""},
+		"setup-net6":             {lo, "fd00:99::1/64"},
+		"create-tap":             {lo},
+		"destroy-vale-host-port": {"vale0", "vh0"},
+		"start-dhcp":             {"/nonexistent", lo},
+	} {
+		if err := helperOps[op].run(owner, args); err == nil {
+			t.Errorf("%s accepted interfaces nobody created", op)
+		}
+	}
+
+	if err := owner.claimIface("bridge97"); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.checkIface("bridge97"); err != nil {
+		t.Errorf("checkIface() refused the owner: %s", err)
+	}
+	if err := other.checkIface("bridge97"); err == nil {
+		t.Error("checkIface() accepted another user")
+	}
+	if ifaces, err := owner.userIfaces(); err != nil || len(ifaces) != 1 || ifaces[0] != "bridge97" {
+		t.Errorf("userIfaces() = %v, %v", ifaces, err)
+	}
+	if ifaces, err := other.userIfaces(); err != nil || len(ifaces) != 0 {
+		t.Errorf("another user's userIfaces() = %v, %v", ifaces, err)
+	}
+
+	// the VALE host port and switch of another user can't be destroyed
+	if err := owner.claim(claimVale, "vale0", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.claim(claimIface, "vh0", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := helperDestroyValeHostPort(other, []string{"vale0", "vh0"}); err == nil {
+		t.Error("destroy-vale-host-port accepted another user")
+	}
+}
+
+func TestCheckExportIP(t *testing.T) {
+	requireRoot(t)
+	defer withRunDir(t)()
+	lo := loopbackIface(t)
+
+	owner := helperUser{uid: 1001, gid: 1001}
+	other := helperUser{uid: 1002, gid: 1002}
+	if err := owner.claim(claimIface, lo, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := owner.checkExportIP("dev", net.ParseIP("127.0.0.5")); err != nil {
+		t.Errorf("checkExportIP() refused an address on the owner's network: %s", err)
+	}
+	if err := owner.checkExportIP("dev", net.ParseIP("10.99.0.5")); err == nil {
+		t.Error("checkExportIP() accepted an address on no driver network")
+	}
+	if err := other.checkExportIP("dev", net.ParseIP("127.0.0.5")); err == nil {
+		t.Error("checkExportIP() accepted another user's network")
+	}
+	if err := owner.checkExportIP("dev", nil); err == nil {
+		t.Error("checkExportIP() accepted an invalid address")
+	}
+
+	rundir, err := owner.runDir(lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	leases := future + " 58:9c:fc:00:00:01 127.0.0.5 dev *\n" + future + " 58:9c:fc:00:00:02 127.0.0.6 prod *\n"
+	if err := ioutil.WriteFile(filepath.Join(rundir, dhcpLeaseFilename), []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.checkExportIP("dev", net.ParseIP("127.0.0.5")); err != nil {
+		t.Errorf("checkExportIP() refused the machine's lease: %s", err)
+	}
+	if err := owner.checkExportIP("dev", net.ParseIP("127.0.0.6")); err == nil {
+		t.Error("checkExportIP() accepted another machine's lease")
+	}
+}
+
+func TestVMConfigCheckNICs(t *testing.T) {
+	requireRoot(t)
+	defer withRunDir(t)()
+
+	owner := helperUser{uid: 1001, gid: 1001}
+	other := helperUser{uid: 1002, gid: 1002}
+	if err := owner.claim(claimTap, "tap7", false); err != nil {
+		t.Fatal(err)
+	}
+
+	config := vmConfig{NICs: []vmNIC{{Backend: "tap7"}, {Backend: "vale5:dev_nic2"}}}
+	if err := config.checkNICs(owner); err != nil {
+		t.Fatalf("checkNICs() refused the owner: %s", err)
+	}
+	if err := owner.checkClaim(claimVale, "vale5"); err != nil {
+		t.Errorf("the VALE switch wasn't claimed: %s", err)
+	}
+	if err := config.checkNICs(other); err == nil {
+		t.Error("checkNICs() accepted another user's tap")
+	}
+	if err := (vmConfig{NICs: []vmNIC{{Backend: "vale5:other"}}}).checkNICs(other); err == nil {
+		t.Error("checkNICs() accepted another user's VALE switch")
+	}
+	if err := (vmConfig{NICs: []vmNIC{{Backend: "tap8"}}}).checkNICs(owner); err == nil {
+		t.Error("checkNICs() accepted a tap nobody created")
+	}
+}
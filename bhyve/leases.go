@@ -0,0 +1,275 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+var errLeaseNotFound = errors.New("IP Not Found")
+
+// dhcpLease is a single entry from a dnsmasq lease file.
+type dhcpLease struct {
+	// Expiry is when the lease ends, the zero time means it never does
+	Expiry time.Time
+	// MAC is the client hardware address, for DHCPv6 it's recovered from the DUID if possible
+	MAC net.HardwareAddr
+	IP  net.IP
+	// Hostname and ClientID are empty if the client didn't send one
+	Hostname string
+	ClientID string
+	// IAID is the identity association of a DHCPv6 lease
+	IAID string
+}
+
+func (l dhcpLease) expired(now time.Time) bool {
+	return !l.Expiry.IsZero() && !l.Expiry.After(now)
+}
+
+// newerThan reports whether l expires after other, leases that never expire being newest
+func (l dhcpLease) newerThan(other dhcpLease) bool {
+	if other.Expiry.IsZero() {
+		return false
+	}
+	return l.Expiry.IsZero() || l.Expiry.After(other.Expiry)
+}
+
+// leaseField returns a lease file field, dnsmasq writes "*" for missing ones
+func leaseField(field string) string {
+	if field == "*" {
+		return ""
+	}
+	return field
+}
+
+// macFromDUID extracts the link layer address from a DUID-LLT or DUID-LL
+func macFromDUID(duid string) net.HardwareAddr {
+	var raw []byte
+	for _, b := range strings.Split(duid, ":") {
+		v, err := strconv.ParseUint(b, 16, 8)
+		if err != nil {
+			return nil
+		}
+		raw = append(raw, byte(v))
+	}
+
+	// type (2 bytes), hardware type (2 bytes), time for DUID-LLT (4 bytes), then the address
+	if len(raw) < 4 || raw[0] != 0 || raw[2] != 0 || raw[3] != 1 {
+		return nil
+	}
+	switch raw[1] {
+	case 1:
+		if len(raw) == 14 {
+			return net.HardwareAddr(raw[8:])
+		}
+	case 3:
+		if len(raw) == 10 {
+			return net.HardwareAddr(raw[4:])
+		}
+	}
+
+	return nil
+}
+
+// parseDHCPLease parses the fields of one lease line
+func parseDHCPLease(words []string, ipv6 bool) (dhcpLease, error) {
+	var lease dhcpLease
+
+	if len(words) < 5 {
+		return lease, fmt.Errorf("expected 5 fields, got %d", len(words))
+	}
+
+	expiry, err := strconv.ParseInt(words[0], 10, 64)
+	if err != nil {
+		return lease, fmt.Errorf("bad expiry %q", words[0])
+	}
+	if expiry != 0 {
+		lease.Expiry = time.Unix(expiry, 0)
+	}
+
+	lease.IP = net.ParseIP(words[2])
+	if lease.IP == nil {
+		return lease, fmt.Errorf("bad IP address %q", words[2])
+	}
+
+	lease.Hostname = leaseField(words[3])
+	lease.ClientID = leaseField(words[4])
+
+	if ipv6 {
+		lease.IAID = words[1]
+		lease.MAC = macFromDUID(lease.ClientID)
+	} else {
+		lease.MAC, err = net.ParseMAC(words[1])
+		if err != nil {
+			return lease, fmt.Errorf("bad MAC address %q", words[1])
+		}
+	}
+
+	return lease, nil
+}
+
+// parseDHCPLeases reads a dnsmasq lease file. IPv4 leases look like
+// "<expiry> <mac> <ip> <hostname> <client-id>", then after a "duid <server-duid>"
+// line IPv6 leases look like "<expiry> <iaid> <ip> <hostname> <client-duid>".
+// Lines that don't parse are skipped, so one bad entry doesn't hide every machine's lease.
+func parseDHCPLeases(r io.Reader) ([]dhcpLease, error) {
+	var leases []dhcpLease
+
+	ipv6 := false
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+
+		if words[0] == "duid" {
+			ipv6 = true
+			continue
+		}
+
+		lease, err := parseDHCPLease(words, ipv6)
+		if err != nil {
+			log.Debugf("Skipping lease line %d: %s", lineno, err)
+			continue
+		}
+		leases = append(leases, lease)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return leases, nil
+}
+
+// findDHCPLease returns the newest unexpired lease for mac of the requested address family
+func findDHCPLease(leases []dhcpLease, mac net.HardwareAddr, ipv6 bool, now time.Time) (dhcpLease, bool) {
+	var found dhcpLease
+	ok := false
+
+	for _, lease := range leases {
+		if lease.MAC.String() != mac.String() || (lease.IP.To4() == nil) != ipv6 || lease.expired(now) {
+			continue
+		}
+		if !ok || lease.newerThan(found) {
+			found = lease
+			ok = true
+		}
+	}
+
+	return found, ok
+}
+
+func getIPfromDHCPLease(dhcpleasefile string, macaddress string, ipv6 bool) (string, error) {
+	mac, err := net.ParseMAC(macaddress)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(dhcpleasefile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	leases, err := parseDHCPLeases(file)
+	if err != nil {
+		return "", err
+	}
+
+	lease, ok := findDHCPLease(leases, mac, ipv6, time.Now())
+	if !ok {
+		return "", errLeaseNotFound
+	}
+
+	log.Debugf("IP is: " + lease.IP.String())
+	return lease.IP.String(), nil
+}
+
+// eui64Address returns the SLAAC address a guest with mac forms in subnet6's /64 when it
+// doesn't use privacy addresses
+func eui64Address(subnet6 string, mac net.HardwareAddr) (net.IP, error) {
+	_, network, err := net.ParseCIDR(subnet6)
+	if err != nil {
+		return nil, err
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("%s is not an EUI-48 address", mac)
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, network.IP.To16()[:8])
+	copy(ip[8:], []byte{mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]})
+	return ip, nil
+}
+
+// parseNDP returns the address ndp -an lists for mac in subnet6, such as
+// "fd00:99::5a9c:fcff:fe00:1  58:9c:fc:00:00:01 bridge0 23h59m58s S R"
+func parseNDP(out []byte, mac net.HardwareAddr, subnet6 string) (string, bool) {
+	_, network, err := net.ParseCIDR(subnet6)
+	if err != nil {
+		return "", false
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		lladdr, err := net.ParseMAC(fields[1])
+		if err != nil || lladdr.String() != mac.String() {
+			continue
+		}
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip != nil && network.Contains(ip) {
+			return ip.String(), true
+		}
+	}
+
+	return "", false
+}
+
+// getIPv6 returns the machine's address in subnet6. boot2docker has no DHCPv6 client and
+// only configures itself with SLAAC, so without a DHCPv6 lease the host's neighbor table
+// is checked, after pinging the address SLAAC would give the guest to fill it in.
+func getIPv6(dhcpdir string, macaddress string, subnet6 string) (string, error) {
+	ip, err := getIPfromDHCPLease(filepath.Join(dhcpRunDir(dhcpdir), dhcpLeaseFilename), macaddress, true)
+	if err == nil {
+		return ip, nil
+	}
+
+	mac, err := net.ParseMAC(macaddress)
+	if err != nil {
+		return "", err
+	}
+	slaac, err := eui64Address(subnet6, mac)
+	if err != nil {
+		return "", err
+	}
+
+	// an error just means the guest doesn't use this address
+	_, _ = runner.output("ping6", "-c", "1", "-X", "1", slaac.String())
+
+	out, err := runner.output("ndp", "-an")
+	if err != nil {
+		return "", err
+	}
+	if ip, ok := parseNDP(out, mac, subnet6); ok {
+		return ip, nil
+	}
+
+	return "", errLeaseNotFound
+}
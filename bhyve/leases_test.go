@@ -0,0 +1,222 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLeases = `1700000100 58:9c:fc:00:00:01 192.168.99.101 one 01:58:9c:fc:00:00:01
+1700000200 58:9c:fc:00:00:02 192.168.99.102 * *
+0 58:9c:fc:00:00:03 192.168.99.103 static *
+1600000000 58:9c:fc:00:00:01 192.168.99.150 one *
+garbage
+1700000100 not-a-mac 192.168.99.104 bad *
+1700000100 58:9c:fc:00:00:04 not-an-ip bad *
+soon 58:9c:fc:00:00:04 192.168.99.104 bad *
+duid 00:01:00:01:2c:6e:0e:4a:58:9c:fc:ff:ff:ff
+1700000300 1234 fd00:99::101 one 00:01:00:01:2c:6e:0e:4a:58:9c:fc:00:00:01
+1700000300 5678 fd00:99::102 * 00:03:00:01:58:9c:fc:00:00:02
+1700000300 9abc fd00:99::103 * 00:04:11:22:33:44
+`
+
+func TestParseDHCPLeases(t *testing.T) {
+	leases, err := parseDHCPLeases(strings.NewReader(testLeases))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		ip       string
+		mac      string
+		hostname string
+		iaid     string
+	}{
+		{"192.168.99.101", "58:9c:fc:00:00:01", "one", ""},
+		{"192.168.99.102", "58:9c:fc:00:00:02", "", ""},
+		{"192.168.99.103", "58:9c:fc:00:00:03", "static", ""},
+		{"192.168.99.150", "58:9c:fc:00:00:01", "one", ""},
+		{"fd00:99::101", "58:9c:fc:00:00:01", "one", "1234"},
+		{"fd00:99::102", "58:9c:fc:00:00:02", "", "5678"},
+		{"fd00:99::103", "", "", "9abc"},
+	}
+
+	if len(leases) != len(want) {
+		t.Fatalf("got %d leases, want %d: %v", len(leases), len(want), leases)
+	}
+	for i, w := range want {
+		l := leases[i]
+		if l.IP.String() != w.ip || l.MAC.String() != w.mac || l.Hostname != w.hostname || l.IAID != w.iaid {
+			t.Errorf("lease %d = %s %s %q %q, want %s %s %q %q", i, l.IP, l.MAC, l.Hostname, l.IAID,
+				w.ip, w.mac, w.hostname, w.iaid)
+		}
+	}
+	if !leases[2].Expiry.IsZero() {
+		t.Errorf("a lease that never expires has expiry %s", leases[2].Expiry)
+	}
+}
+
+func TestParseDHCPLease(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		ipv6    bool
+		wantErr bool
+	}{
+		{"ipv4", "1700000100 58:9c:fc:00:00:01 192.168.99.101 one *", false, false},
+		{"ipv6", "1700000300 1234 fd00:99::101 one 00:03:00:01:58:9c:fc:00:00:01", true, false},
+		{"ipv6 with any iaid", "1700000300 not-a-mac fd00:99::101 one *", true, false},
+		{"too few fields", "1700000100 58:9c:fc:00:00:01 192.168.99.101", false, true},
+		{"bad expiry", "soon 58:9c:fc:00:00:01 192.168.99.101 one *", false, true},
+		{"bad mac", "1700000100 1234 192.168.99.101 one *", false, true},
+		{"bad ip", "1700000100 58:9c:fc:00:00:01 192.168.99 one *", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDHCPLease(strings.Fields(tt.line), tt.ipv6)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseDHCPLease() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFindDHCPLease(t *testing.T) {
+	leases, err := parseDHCPLeases(strings.NewReader(testLeases))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		mac    string
+		ipv6   bool
+		now    int64
+		want   string
+		wantOK bool
+	}{
+		{"newest unexpired", "58:9c:fc:00:00:01", false, 1650000000, "192.168.99.101", true},
+		{"all expired", "58:9c:fc:00:00:01", false, 1800000000, "", false},
+		{"never expires", "58:9c:fc:00:00:03", false, 1800000000, "192.168.99.103", true},
+		{"ipv6 from duid-llt", "58:9c:fc:00:00:01", true, 1650000000, "fd00:99::101", true},
+		{"ipv6 from duid-ll", "58:9c:fc:00:00:02", true, 1650000000, "fd00:99::102", true},
+		{"unknown mac", "58:9c:fc:00:00:09", false, 1650000000, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac, err := net.ParseMAC(tt.mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lease, ok := findDHCPLease(leases, mac, tt.ipv6, time.Unix(tt.now, 0))
+			if ok != tt.wantOK || (ok && lease.IP.String() != tt.want) {
+				t.Errorf("findDHCPLease() = %s, %t, want %s, %t", lease.IP, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGetIPfromDHCPLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leasefile := filepath.Join(dir, dhcpLeaseFilename)
+	if err := ioutil.WriteFile(leasefile, []byte("garbage\n0 58:9c:fc:00:00:03 192.168.99.103 static *\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := getIPfromDHCPLease(leasefile, "58:9c:fc:00:00:03", false)
+	if err != nil || ip != "192.168.99.103" {
+		t.Errorf("getIPfromDHCPLease() = %s, %v", ip, err)
+	}
+	if _, err := getIPfromDHCPLease(leasefile, "58:9c:fc:00:00:01", false); err != errLeaseNotFound {
+		t.Errorf("got %v for a machine without a lease", err)
+	}
+}
+
+func TestEUI64Address(t *testing.T) {
+	mac, _ := net.ParseMAC("58:9c:fc:00:00:01")
+	ip, err := eui64Address(defaultSubnet6, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "fd00:99::5a9c:fcff:fe00:1" {
+		t.Errorf("eui64Address() = %s", ip)
+	}
+}
+
+const testNDP = `Neighbor                             Linklayer Address  Netif Expire    S Flags
+fe80::5a9c:fcff:fe00:1%bridge0       58:9c:fc:00:00:01 bridge0 23h59m58s S
+2001:db8::1                          58:9c:fc:00:00:01    em0 23h59m58s S
+fd00:99::1                           02:13:e8:aa:bb:cc bridge0 permanent R
+fd00:99::a1b2:c3d4:e5f6:1            58:9c:fc:00:00:01 bridge0 23h59m58s S
+`
+
+func TestParseNDP(t *testing.T) {
+	tests := []struct {
+		name   string
+		mac    string
+		want   string
+		wantOK bool
+	}{
+		{"privacy address", "58:9c:fc:00:00:01", "fd00:99::a1b2:c3d4:e5f6:1", true},
+		{"not a neighbor", "58:9c:fc:00:00:02", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac, _ := net.ParseMAC(tt.mac)
+			ip, ok := parseNDP([]byte(testNDP), mac, defaultSubnet6)
+			if ip != tt.want || ok != tt.wantOK {
+				t.Errorf("parseNDP() = %s, %t, want %s, %t", ip, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGetIPv6(t *testing.T) {
+	dhcpdir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dhcpdir)
+	defer withRunDir(t)()
+
+	rec := &recordingRunner{}
+	rec.reply("ndp -an", testNDP)
+	defer withRunner(rec)()
+
+	// no DHCPv6 lease, as for boot2docker
+	ip, err := getIPv6(dhcpdir, "58:9c:fc:00:00:01", defaultSubnet6)
+	if err != nil || ip != "fd00:99::a1b2:c3d4:e5f6:1" {
+		t.Errorf("getIPv6() = %s, %v", ip, err)
+	}
+	if _, err := getIPv6(dhcpdir, "58:9c:fc:00:00:02", defaultSubnet6); err != errLeaseNotFound {
+		t.Errorf("got %v for a machine without an IPv6 address", err)
+	}
+
+	leases := "duid 00:01:00:01:2c:6e:0e:4a:58:9c:fc:ff:ff:ff\n" +
+		"0 1234 fd00:99::101 one 00:03:00:01:58:9c:fc:00:00:01\n"
+	if err := os.MkdirAll(dhcpRunDir(dhcpdir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dhcpRunDir(dhcpdir), dhcpLeaseFilename), []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := getIPv6(dhcpdir, "58:9c:fc:00:00:01", defaultSubnet6); err != nil || ip != "fd00:99::101" {
+		t.Errorf("getIPv6() = %s, %v, want the DHCPv6 lease", ip, err)
+	}
+}
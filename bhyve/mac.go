@@ -0,0 +1,183 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	macPrefix   = "58:9c:fc"
+	maxMACTries = 256
+)
+
+// storedMachine is the part of a machine's config.json we care about
+type storedMachine struct {
+	Name       string
+	DriverName string
+	Driver     Driver
+}
+
+// storedMachines returns the bhyve machines in the store, other than skipname
+func storedMachines(storepath string, skipname string) ([]storedMachine, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(storepath, "machines"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var machines []storedMachine
+	for _, dir := range dirs {
+		if !dir.IsDir() || dir.Name() == skipname {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(storepath, "machines", dir.Name(), "config.json"))
+		if err != nil {
+			// not created yet, or not a machine
+			continue
+		}
+
+		var m storedMachine
+		if err := json.Unmarshal(data, &m); err != nil {
+			log.Debugf("Failed to parse config for %s: %s", dir.Name(), err)
+			continue
+		}
+		if m.DriverName != "bhyve" {
+			continue
+		}
+		m.Name = dir.Name()
+		machines = append(machines, m)
+	}
+
+	return machines, nil
+}
+
+// macAddressesInUse maps the MAC addresses used by other machines in the store, and
+// by unexpired leases not handed out to machinename, to who is using them
+func macAddressesInUse(storepath string, machinename string) (map[string]string, error) {
+	inuse := map[string]string{}
+
+	machines, err := storedMachines(storepath, machinename)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range machines {
+		if mac, err := net.ParseMAC(m.Driver.MACAddress); err == nil {
+			inuse[mac.String()] = "machine " + m.Name
+		}
+		for _, nic := range m.Driver.NICs {
+			if mac, err := net.ParseMAC(nic.MACAddress); err == nil {
+				inuse[mac.String()] = "machine " + m.Name
+			}
+		}
+	}
+
+	// each network's dnsmasq keeps its leases in its own run dir
+	dirs, err := ioutil.ReadDir(filepath.Join(storepath, dhcpDirname))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	now := time.Now()
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		leases, err := readDHCPLeases(filepath.Join(dhcpRunDir(filepath.Join(storepath, dhcpDirname, dir.Name())), dhcpLeaseFilename))
+		if err != nil {
+			return nil, err
+		}
+		for _, lease := range leases {
+			if lease.MAC == nil || lease.expired(now) || lease.Hostname == machinename {
+				continue
+			}
+			if _, ok := inuse[lease.MAC.String()]; !ok {
+				inuse[lease.MAC.String()] = "lease for " + lease.IP.String()
+			}
+		}
+	}
+
+	return inuse, nil
+}
+
+// readDHCPLeases parses the lease file at path, which doesn't exist until dnsmasq has
+// handed out a lease
+func readDHCPLeases(path string) ([]dhcpLease, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseDHCPLeases(file)
+}
+
+// deriveMACAddress hashes the store path, machine name and NIC name into the last three
+// octets, so recreating a machine gets the same MAC and with it the same lease
+func deriveMACAddress(storepath string, machinename string, nicname string, attempt int) string {
+	seed := storepath + "\x00" + machinename
+	if nicname != "" {
+		seed += "\x00" + nicname
+	}
+	if attempt > 0 {
+		seed += "\x00" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(seed))
+
+	return fmt.Sprintf("%s:%02x:%02x:%02x", macPrefix, sum[0], sum[1], sum[2])
+}
+
+// generateMACAddress picks a MAC not in inuse for a NIC of machinename and records it
+// there. nicname is empty for the primary NIC.
+func generateMACAddress(inuse map[string]string, storepath string, machinename string, nicname string) (string, error) {
+	for attempt := 0; attempt < maxMACTries; attempt++ {
+		mac := deriveMACAddress(storepath, machinename, nicname, attempt)
+		if owner, ok := inuse[mac]; ok {
+			log.Debugf("MAC %s already used by %s", mac, owner)
+			continue
+		}
+		inuse[mac] = "machine " + machinename
+		return mac, nil
+	}
+
+	return "", errors.New("could not find an unused MAC address")
+}
+
+// checkMACAddress validates a user supplied MAC, makes sure it's not in inuse and records it there
+func checkMACAddress(inuse map[string]string, machinename string, macaddress string) (string, error) {
+	mac, err := net.ParseMAC(macaddress)
+	if err != nil {
+		return "", err
+	}
+	if len(mac) != 6 {
+		return "", fmt.Errorf("%s is not an Ethernet MAC address", macaddress)
+	}
+	if mac[0]&1 == 1 {
+		return "", fmt.Errorf("%s is a multicast MAC address", macaddress)
+	}
+
+	if owner, ok := inuse[mac.String()]; ok {
+		return "", fmt.Errorf("MAC address %s is already used by %s", mac, owner)
+	}
+	inuse[mac.String()] = "machine " + machinename
+
+	return mac.String(), nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeriveMACAddress(t *testing.T) {
+	mac := deriveMACAddress("/store", "dev", "", 0)
+	if !strings.HasPrefix(mac, macPrefix+":") || len(mac) != len("58:9c:fc:00:00:00") {
+		t.Errorf("derived %s, want a %s address", mac, macPrefix)
+	}
+	if again := deriveMACAddress("/store", "dev", "", 0); again != mac {
+		t.Errorf("derived %s then %s for the same machine", mac, again)
+	}
+
+	others := []struct {
+		name      string
+		storepath string
+		machine   string
+		nic       string
+		attempt   int
+	}{
+		{"other store", "/other", "dev", "", 0},
+		{"other machine", "/store", "prod", "", 0},
+		{"second NIC", "/store", "dev", "net1", 0},
+		{"retry", "/store", "dev", "", 1},
+	}
+	for _, o := range others {
+		if got := deriveMACAddress(o.storepath, o.machine, o.nic, o.attempt); got == mac {
+			t.Errorf("%s derived the same MAC %s", o.name, got)
+		}
+	}
+}
+
+func TestGenerateMACAddress(t *testing.T) {
+	first := deriveMACAddress("/store", "dev", "", 0)
+	second := deriveMACAddress("/store", "dev", "", 1)
+
+	inuse := map[string]string{first: "machine other"}
+	mac, err := generateMACAddress(inuse, "/store", "dev", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac != second {
+		t.Errorf("generated %s, want the next attempt %s", mac, second)
+	}
+	if inuse[mac] != "machine dev" {
+		t.Errorf("%s isn't recorded as used by dev: %q", mac, inuse[mac])
+	}
+
+	full := map[string]string{}
+	for attempt := 0; attempt < maxMACTries; attempt++ {
+		full[deriveMACAddress("/store", "dev", "", attempt)] = "machine other"
+	}
+	if _, err := generateMACAddress(full, "/store", "dev", ""); err == nil {
+		t.Error("generated a MAC with every attempt in use")
+	}
+}
+
+func TestCheckMACAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		mac     string
+		want    string
+		wantErr bool
+	}{
+		{"valid", "58:9C:FC:00:00:10", "58:9c:fc:00:00:10", false},
+		{"dashes", "58-9c-fc-00-00-11", "58:9c:fc:00:00:11", false},
+		{"malformed", "58:9c:fc:00:00", "", true},
+		{"not ethernet", "58:9c:fc:00:00:00:00:01", "", true},
+		{"multicast", "01:00:5e:00:00:01", "", true},
+		{"in use", "58:9c:fc:00:00:01", "", true},
+	}
+
+	for _, tt := range tests {
+		inuse := map[string]string{"58:9c:fc:00:00:01": "machine other"}
+		got, err := checkMACAddress(inuse, "dev", tt.mac)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if !tt.wantErr && inuse[got] != "machine dev" {
+			t.Errorf("%s: %s isn't recorded as used by dev", tt.name, got)
+		}
+	}
+}
+
+func TestMACAddressesInUse(t *testing.T) {
+	defer withRunDir(t)()
+	storepath := testStore(t, "dev")
+	defer os.RemoveAll(storepath)
+
+	writeStoredMachine(t, storepath, "other",
+		`{"MACAddress": "58:9c:fc:00:00:01", "NICs": [{"Bridge": "bridge1", "MACAddress": "58:9c:fc:00:00:02"}]}`)
+	writeStoredMachine(t, storepath, "dev", `{"MACAddress": "58:9c:fc:00:00:03"}`)
+
+	// each network's leases are in its own run dir, a stray file in the store is ignored
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	leases := map[string]string{
+		"bridge0": future + " 58:9c:fc:00:00:04 192.168.99.104 gone *\n" +
+			future + " 58:9c:fc:00:00:03 192.168.99.103 dev *\n" +
+			"1600000000 58:9c:fc:00:00:05 192.168.99.105 expired *\n",
+		"vale0": future + " 58:9c:fc:00:00:06 10.0.0.106 * *\n",
+	}
+	for iface, data := range leases {
+		dhcpdir := filepath.Join(storepath, dhcpDirname, iface)
+		if err := os.MkdirAll(dhcpdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(dhcpRunDir(dhcpdir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dhcpRunDir(dhcpdir), dhcpLeaseFilename), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(storepath, dhcpDirname, "bridge2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stray := future + " 58:9c:fc:00:00:07 192.168.99.107 stray *\n"
+	if err := ioutil.WriteFile(filepath.Join(storepath, dhcpLeaseFilename), []byte(stray), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inuse, err := macAddressesInUse(storepath, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"58:9c:fc:00:00:01": "machine other",
+		"58:9c:fc:00:00:02": "machine other",
+		"58:9c:fc:00:00:04": "lease for 192.168.99.104",
+		"58:9c:fc:00:00:06": "lease for 10.0.0.106",
+	}
+	if len(inuse) != len(want) {
+		t.Errorf("in use: %v, want %v", inuse, want)
+	}
+	for mac, owner := range want {
+		if inuse[mac] != owner {
+			t.Errorf("%s is used by %q, want %q", mac, inuse[mac], owner)
+		}
+	}
+}
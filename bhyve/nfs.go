@@ -0,0 +1,188 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	shareMode9P  = "9p"
+	shareModeNFS = "nfs"
+
+	defaultExportsFile = "/etc/exports"
+	exportsBlockBegin  = "# BEGIN docker-machine-driver-bhyve "
+	exportsBlockEnd    = "# END docker-machine-driver-bhyve "
+)
+
+// shareDevice returns the device of the filesystem holding path
+func shareDevice(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
+
+// renderExports returns the exports(5) lines sharing shares with the machine at ip only.
+// A host can only be given once per filesystem, so there's a line for each filesystem
+// listing its shares. The line is read-only only if all of its shares are, otherwise the
+// read-only shares are just mounted read-only in the guest.
+func renderExports(shares []Share, ip string, uid int, gid int) ([]string, error) {
+	var devs []uint64
+	paths := map[uint64][]string{}
+	readonly := map[uint64]bool{}
+	for _, share := range shares {
+		dev, err := shareDevice(share.HostPath)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := paths[dev]; !ok {
+			devs = append(devs, dev)
+			readonly[dev] = true
+		}
+		paths[dev] = append(paths[dev], share.HostPath)
+		readonly[dev] = readonly[dev] && share.ReadOnly
+	}
+
+	var lines []string
+	for _, dev := range devs {
+		options := "-mapall=" + strconv.Itoa(uid) + ":" + strconv.Itoa(gid)
+		if readonly[dev] {
+			options = "-ro " + options
+		}
+		lines = append(lines, strings.Join(paths[dev], " ")+" "+options+" "+ip)
+	}
+	return lines, nil
+}
+
+// exportsBlockName names the managed block of the user's machine, machine names are only
+// unique to a user's store
+func exportsBlockName(machinename string, uid int) string {
+	return machinename + " uid=" + strconv.Itoa(uid)
+}
+
+// replaceExportsBlock returns exports with the named managed block replaced by lines,
+// or removed if lines is empty. Everything outside the block is left alone. A block
+// without its end line is refused, rather than guessing where it stops.
+func replaceExportsBlock(exports string, name string, lines []string) (string, error) {
+	begin := exportsBlockBegin + name
+	end := exportsBlockEnd + name
+
+	block := ""
+	if len(lines) > 0 {
+		block = begin + "\n" + strings.Join(lines, "\n") + "\n" + end + "\n"
+	}
+
+	var b strings.Builder
+	inblock := false
+	for _, line := range strings.SplitAfter(exports, "\n") {
+		switch strings.TrimSuffix(line, "\n") {
+		case begin:
+			inblock = true
+			b.WriteString(block)
+			block = ""
+		case end:
+			inblock = false
+		default:
+			if !inblock {
+				b.WriteString(line)
+			}
+		}
+	}
+	if inblock {
+		return "", fmt.Errorf("%q has no %q line after it, fix the exports by hand", begin, end)
+	}
+
+	out := b.String()
+	if block != "" {
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		out += block
+	}
+	return out, nil
+}
+
+// updateExports rewrites the named block in exportsfile, reporting whether it changed
+func updateExports(exportsfile string, name string, lines []string) (bool, error) {
+	exports, err := ioutil.ReadFile(exportsfile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	updated, err := replaceExportsBlock(string(exports), name, lines)
+	if err != nil {
+		return false, err
+	}
+	if updated == string(exports) {
+		return false, nil
+	}
+
+	return true, ioutil.WriteFile(exportsfile, []byte(updated), 0644)
+}
+
+func reloadMountd() error {
+	log.Debugf("Reloading mountd")
+	return easyCmd("service", "mountd", "reload")
+}
+
+// exportNFSShares exports shares to the machine at ip, mapping access to uid and gid.
+// It runs as root in the helper.
+func exportNFSShares(machinename string, shares []Share, ip string, uid int, gid int) error {
+	lines, err := renderExports(shares, ip, uid, gid)
+	if err != nil {
+		return err
+	}
+
+	changed, err := updateExports(defaultExportsFile, exportsBlockName(machinename, uid), lines)
+	if err != nil || !changed {
+		return err
+	}
+
+	return reloadMountd()
+}
+
+func unexportNFSShares(machinename string, uid int) error {
+	changed, err := updateExports(defaultExportsFile, exportsBlockName(machinename, uid), nil)
+	if err != nil || !changed {
+		return err
+	}
+
+	return reloadMountd()
+}
+
+// nfsMountCommand returns the guest command mounting the share from hostip at its host path
+func (s Share) nfsMountCommand(hostip string) string {
+	options := "nolock,vers=3"
+	if s.ReadOnly {
+		options += ",ro"
+	}
+	if strings.Contains(hostip, ":") {
+		hostip = "[" + hostip + "]"
+	}
+	return fmt.Sprintf("sudo mkdir -p %s && sudo mount -t nfs -o %s %s %s", shellQuote(s.HostPath), options,
+		shellQuote(hostip+":"+s.HostPath), shellQuote(s.HostPath))
+}
+
+func mountNFSShares(d drivers.Driver, shares []Share, hostip string) error {
+	for _, share := range shares {
+		log.Infof("Mounting %s in the guest over NFS...", share.HostPath)
+		out, err := drivers.RunSSHCommandFromDriver(d, share.nfsMountCommand(hostip))
+		if err != nil {
+			return fmt.Errorf("failed to mount %s: %s: %s", share.HostPath, err, out)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderExports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	docs := filepath.Join(dir, "docs")
+	for _, path := range []string{src, docs} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		shares []Share
+		want   string
+	}{
+		{"one filesystem", []Share{{HostPath: src}, {HostPath: docs, ReadOnly: true}},
+			src + " " + docs + " -mapall=1001:1001 192.168.99.10"},
+		{"all read-only", []Share{{HostPath: src, ReadOnly: true}, {HostPath: docs, ReadOnly: true}},
+			src + " " + docs + " -ro -mapall=1001:1001 192.168.99.10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, err := renderExports(tt.shares, "192.168.99.10", 1001, 1001)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lines) != 1 || lines[0] != tt.want {
+				t.Errorf("renderExports() = %q, want %q", lines, tt.want)
+			}
+		})
+	}
+
+	// a line for each filesystem
+	other := "/proc"
+	srcdev, _ := shareDevice(src)
+	if otherdev, err := shareDevice(other); err != nil || otherdev == srcdev {
+		t.Skipf("no second filesystem at %s", other)
+	}
+	lines, err := renderExports([]Share{{HostPath: src}, {HostPath: other}, {HostPath: docs}}, "192.168.99.10", 1001, 1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[0] != src+" "+docs+" -mapall=1001:1001 192.168.99.10" {
+		t.Errorf("renderExports() = %q", lines)
+	}
+
+	if _, err := renderExports([]Share{{HostPath: filepath.Join(dir, "missing")}}, "192.168.99.10", 1001, 1001); err == nil {
+		t.Error("exported a missing directory")
+	}
+}
+
+func TestReplaceExportsBlock(t *testing.T) {
+	block := "# BEGIN docker-machine-driver-bhyve dev\n/src -mapall=1001:1001 192.168.99.10\n# END docker-machine-driver-bhyve dev\n"
+	lines := []string{"/src -mapall=1001:1001 192.168.99.10"}
+
+	tests := []struct {
+		name    string
+		exports string
+		lines   []string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", lines, block, false},
+		{"nothing to remove", "\n/usr -ro\n", nil, "\n/usr -ro\n", false},
+		{"keeps leading blank lines", "\n\n# mine\n/usr -ro\n", lines, "\n\n# mine\n/usr -ro\n" + block, false},
+		{"adds a missing newline", "/usr -ro", lines, "/usr -ro\n" + block, false},
+		{"replaces in place", "/usr -ro\n" + "# BEGIN docker-machine-driver-bhyve dev\n/old\n# END docker-machine-driver-bhyve dev\n" +
+			"\n/var -ro\n", lines, "/usr -ro\n" + block + "\n/var -ro\n", false},
+		{"removes", "/usr -ro\n" + block + "/var -ro\n\n", nil, "/usr -ro\n/var -ro\n\n", false},
+		{"leaves other machines alone", "# BEGIN docker-machine-driver-bhyve other\n/other\n# END docker-machine-driver-bhyve other\n",
+			nil, "# BEGIN docker-machine-driver-bhyve other\n/other\n# END docker-machine-driver-bhyve other\n", false},
+		{"unterminated block", "/usr -ro\n# BEGIN docker-machine-driver-bhyve dev\n/old\n/var -ro\n", lines, "", true},
+		{"unterminated block removed", "# BEGIN docker-machine-driver-bhyve dev\n/old\n/var -ro\n", nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := replaceExportsBlock(tt.exports, "dev", tt.lines)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("replaceExportsBlock() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("replaceExportsBlock() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportsBlockPerUser(t *testing.T) {
+	lines := []string{"/src -mapall=1001:1001 192.168.99.10"}
+	exports, err := replaceExportsBlock("", exportsBlockName("dev", 1001), lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(exports, "# BEGIN docker-machine-driver-bhyve dev uid=1001\n") {
+		t.Errorf("block not marked with the uid:\n%s", exports)
+	}
+
+	// another user's machine of the same name
+	if got, err := replaceExportsBlock(exports, exportsBlockName("dev", 1002), nil); err != nil || got != exports {
+		t.Errorf("removed another user's block (%v):\n%s", err, got)
+	}
+	if got, err := replaceExportsBlock(exports, exportsBlockName("dev", 1001), nil); err != nil || got != "" {
+		t.Errorf("didn't remove the user's block (%v):\n%s", err, got)
+	}
+}
+
+func TestUpdateExports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	exportsfile := filepath.Join(dir, "exports")
+	original := "\n# exported by hand\n/usr -ro -network 10.0.0.0/8\n"
+	if err := ioutil.WriteFile(exportsfile, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{"/src -mapall=1001:1001 192.168.99.10"}
+	if changed, err := updateExports(exportsfile, "dev", lines); err != nil || !changed {
+		t.Fatalf("updateExports() = %t, %v", changed, err)
+	}
+	if changed, err := updateExports(exportsfile, "dev", lines); err != nil || changed {
+		t.Errorf("rewriting the same block changed the file: %t, %v", changed, err)
+	}
+	if changed, err := updateExports(exportsfile, "dev", nil); err != nil || !changed {
+		t.Fatalf("updateExports() = %t, %v", changed, err)
+	}
+
+	data, err := ioutil.ReadFile(exportsfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != original {
+		t.Errorf("exports after removing the block = %q, want %q", data, original)
+	}
+
+	// a block whose end line was deleted by hand is left for the admin to fix
+	broken := original + "# BEGIN docker-machine-driver-bhyve dev\n/src\n/var -ro\n"
+	if err := ioutil.WriteFile(exportsfile, []byte(broken), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := updateExports(exportsfile, "dev", lines); err == nil {
+		t.Error("updateExports() rewrote an unterminated block")
+	}
+	if data, err := ioutil.ReadFile(exportsfile); err != nil || string(data) != broken {
+		t.Errorf("exports with an unterminated block changed to %q (%v)", data, err)
+	}
+}
+
+func TestNFSMountCommand(t *testing.T) {
+	share := Share{HostPath: "/home/me/src", ReadOnly: true}
+	want := "sudo mkdir -p '/home/me/src' && sudo mount -t nfs -o nolock,vers=3,ro '[fd00:99::1]:/home/me/src' '/home/me/src'"
+	if got := share.nfsMountCommand("fd00:99::1"); got != want {
+		t.Errorf("nfsMountCommand() = %s", got)
+	}
+}
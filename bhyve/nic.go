@@ -0,0 +1,75 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const defaultNICModel = "virtio-net"
+
+// NIC is an additional network interface, attached to a tap on its own bridge or to a
+// port on a VALE switch. NetDev is the tap, VALE ports go away with the VM.
+type NIC struct {
+	Bridge     string
+	ValeSwitch string
+	MACAddress string
+	Model      string
+	NetDev     string
+}
+
+// parseNICSpec parses a --bhyve-nic value of the form bridge=...|vale=...[,mac=...][,model=...]
+func parseNICSpec(spec string) (NIC, error) {
+	nic := NIC{Model: defaultNICModel}
+
+	for _, opt := range strings.Split(spec, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return NIC{}, fmt.Errorf("invalid NIC option %q in %q", opt, spec)
+		}
+
+		switch kv[0] {
+		case "bridge":
+			nic.Bridge = kv[1]
+		case "vale":
+			if err := validateValeSwitch(kv[1]); err != nil {
+				return NIC{}, err
+			}
+			nic.ValeSwitch = kv[1]
+		case "mac":
+			nic.MACAddress = kv[1]
+		case "model":
+			if kv[1] != "virtio-net" && kv[1] != "e1000" {
+				return NIC{}, fmt.Errorf("unsupported NIC model %s, use virtio-net or e1000", kv[1])
+			}
+			nic.Model = kv[1]
+		default:
+			return NIC{}, fmt.Errorf("unknown NIC option %s in %q", kv[0], spec)
+		}
+	}
+
+	if (nic.Bridge == "") == (nic.ValeSwitch == "") {
+		return NIC{}, fmt.Errorf("NIC %q needs either a bridge or a VALE switch", spec)
+	}
+
+	return nic, nil
+}
+
+// valePort returns the switch port of the NIC, numbered like the NIC so it doesn't clash
+// with the machine's other ports
+func (n NIC) valePort(machinename string, index int) string {
+	return valePort(n.ValeSwitch, machinename+"_nic"+strconv.Itoa(index+1))
+}
+
+// vmNIC returns the NIC as given to bhyve, on its tap or VALE port
+func (n NIC) vmNIC(machinename string, index int) vmNIC {
+	backend := n.NetDev
+	if n.ValeSwitch != "" {
+		backend = n.valePort(machinename, index)
+	}
+	return vmNIC{Model: n.Model, Backend: backend, MAC: n.MACAddress}
+}
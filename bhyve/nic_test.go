@@ -0,0 +1,68 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"testing"
+)
+
+func TestParseNICSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    NIC
+		wantErr bool
+	}{
+		{"bridge", "bridge=bridge1", NIC{Bridge: "bridge1", Model: defaultNICModel}, false},
+		{"bridge with mac", "bridge=bridge1,mac=58:9c:fc:00:00:10",
+			NIC{Bridge: "bridge1", MACAddress: "58:9c:fc:00:00:10", Model: defaultNICModel}, false},
+		{"bridge with model", "model=e1000,bridge=bridge1", NIC{Bridge: "bridge1", Model: "e1000"}, false},
+		{"vale", "vale=vale1", NIC{ValeSwitch: "vale1", Model: defaultNICModel}, false},
+		{"vale with mac", "vale=vale1,mac=58:9c:fc:00:00:11,model=virtio-net",
+			NIC{ValeSwitch: "vale1", MACAddress: "58:9c:fc:00:00:11", Model: "virtio-net"}, false},
+		{"empty", "", NIC{}, true},
+		{"no backend", "mac=58:9c:fc:00:00:10", NIC{}, true},
+		{"bridge and vale", "bridge=bridge1,vale=vale1", NIC{}, true},
+		{"empty bridge", "bridge=", NIC{}, true},
+		{"no value", "bridge", NIC{}, true},
+		{"bad vale switch", "vale=bridge1", NIC{}, true},
+		{"vale port", "vale=vale1:port", NIC{}, true},
+		{"bad model", "bridge=bridge1,model=rtl8139", NIC{}, true},
+		{"unknown option", "bridge=bridge1,tap=tap0", NIC{}, true},
+		{"trailing comma", "bridge=bridge1,", NIC{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseNICSpec(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNICBackend(t *testing.T) {
+	tests := []struct {
+		name string
+		nic  NIC
+		want string
+	}{
+		{"tap", NIC{Bridge: "bridge1", NetDev: "tap3"}, "tap3"},
+		{"vale", NIC{ValeSwitch: "vale1"}, "vale1:my_dev_nic2"},
+	}
+
+	for _, tt := range tests {
+		got := tt.nic.vmNIC("my-dev", 1)
+		if got.Backend != tt.want {
+			t.Errorf("%s: backend %s, want %s", tt.name, got.Backend, tt.want)
+		}
+		if !tapRegex.MatchString(got.Backend) && !valePortRegex.MatchString(got.Backend) {
+			t.Errorf("%s: the helper would refuse backend %s", tt.name, got.Backend)
+		}
+	}
+}
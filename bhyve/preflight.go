@@ -0,0 +1,365 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultDevfsRules = "/etc/devfs.rules"
+	defaultDmesgBoot  = "/var/run/dmesg.boot"
+)
+
+// preflightFailure is a host problem and how to fix it
+type preflightFailure struct {
+	problem string
+	hint    string
+}
+
+// preflightError collects every failed check, so they can all be fixed in one go
+type preflightError []preflightFailure
+
+func (e preflightError) Error() string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("%d host setup problem(s):", len(e)))
+	for _, f := range e {
+		b.WriteString("\n  * " + f.problem)
+		for _, line := range strings.Split(f.hint, "\n") {
+			b.WriteString("\n      " + line)
+		}
+	}
+	return b.String()
+}
+
+// preflight checks the host can run machines, querying it through runner only
+type preflight struct {
+	runner     commandRunner
+	devfsRules string
+	dmesgBoot  string
+	firmware   string
+	helper     string
+	privilege  string
+	storePath  string
+	diskSize   int64
+	vale       bool
+	image      bool
+	nfs        bool
+}
+
+// requiredCommand is a command the driver runs, and the package providing it
+type requiredCommand struct {
+	path string
+	pkg  string
+}
+
+// escalation returns how the helper will be run as root, sudo if nothing is installed yet
+func (p preflight) escalation() string {
+	if p.privilege != "" && p.privilege != privilegeAuto {
+		return p.privilege
+	}
+	e, err := detectPrivilege(p.runner, os.Geteuid())
+	if err != nil {
+		return privilegeSudo
+	}
+	return e
+}
+
+func (p preflight) requiredCommands() []requiredCommand {
+	var commands []requiredCommand
+	if e := p.escalation(); e != privilegeNone {
+		commands = append(commands, requiredCommand{e, e})
+	}
+	commands = append(commands, []requiredCommand{
+		{"/usr/local/sbin/dnsmasq", "dnsmasq"},
+		{"/usr/sbin/bhyve", ""},
+		{"/usr/sbin/bhyvectl", ""},
+		{"/usr/sbin/daemon", ""},
+		{"/usr/sbin/ngctl", ""},
+		{"/usr/bin/fuser", ""},
+		{"/sbin/ifconfig", ""},
+		{"/sbin/sysctl", ""},
+	}...)
+	if !p.image {
+		commands = append(commands,
+			requiredCommand{"/usr/local/sbin/grub-bhyve", "grub2-bhyve"},
+			requiredCommand{"/usr/bin/env", ""})
+	}
+	if p.vale {
+		commands = append(commands, requiredCommand{"/usr/sbin/valectl", ""})
+	}
+	if p.nfs {
+		commands = append(commands, requiredCommand{"/usr/sbin/service", ""})
+	}
+	return commands
+}
+
+func (p preflight) checkCommands() []preflightFailure {
+	var failures []preflightFailure
+	for _, c := range p.requiredCommands() {
+		if _, err := p.runner.lookPath(c.path); err != nil {
+			hint := c.path + " is part of the base system, check your FreeBSD install"
+			if c.pkg != "" {
+				hint = "pkg install " + c.pkg
+			}
+			failures = append(failures, preflightFailure{c.path + " not found", hint})
+		}
+	}
+	return failures
+}
+
+// checkPrivilege checks the helper can be run as root without a password, and that only
+// root can change it, as otherwise the sudoers or doas entry would let anyone run anything
+func (p preflight) checkPrivilege() []preflightFailure {
+	e := p.escalation()
+	if e == privilegeNone {
+		if os.Geteuid() != 0 {
+			return []preflightFailure{{
+				"--bhyve-privilege none needs docker-machine to run as root",
+				"run docker-machine as root, or use --bhyve-privilege sudo or doas",
+			}}
+		}
+		return nil
+	}
+	if _, err := p.runner.lookPath(e); err != nil {
+		// reported by checkCommands
+		return nil
+	}
+
+	var failures []preflightFailure
+	if out, err := p.runner.output("stat", "-f", "%u %Lp", p.helper); err == nil {
+		fields := append(strings.Fields(string(out)), "", "")
+		mode, merr := strconv.ParseUint(fields[1], 8, 32)
+		if fields[0] != "0" || merr != nil || mode&022 != 0 {
+			failures = append(failures, preflightFailure{
+				p.helper + " must belong to root and only be writable by root",
+				"install it as root, e.g.: install -o root -g wheel -m 0755 docker-machine-driver-bhyve /usr/local/bin/",
+			})
+		}
+	}
+
+	if _, err := p.runner.output(e, "-n", p.helper, helperSubcommand, "check"); err != nil {
+		hint := "add to " + defaultSudoers + ":\n" + sudoersEntry("<user>", p.helper)
+		if e == privilegeDoas {
+			hint = "add to " + defaultDoasConf + ":\n" + doasEntry("<user>", p.helper)
+		}
+		failures = append(failures, preflightFailure{
+			"no password-less " + e + " for " + p.helper + " " + helperSubcommand,
+			hint,
+		})
+	}
+	return failures
+}
+
+func (p preflight) checkKmods() []preflightFailure {
+	var failures []preflightFailure
+	for _, kmod := range []string{"vmm", "nmdm", "ng_ether"} {
+		if _, err := p.runner.output("kldstat", "-q", "-m", kmod); err != nil {
+			failures = append(failures, preflightFailure{
+				"kernel module " + kmod + " not loaded",
+				"kldload " + kmod + "\nsysrc kld_list+=" + kmod,
+			})
+		}
+	}
+	return failures
+}
+
+func (p preflight) sysctl(name string) string {
+	out, err := p.runner.output("sysctl", "-n", name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// checkVirtualization checks vmm found VT-x with EPT, or AMD-V, and the CPU has POPCNT
+func (p preflight) checkVirtualization() []preflightFailure {
+	if _, err := p.runner.output("kldstat", "-q", "-m", "vmm"); err != nil {
+		// reported by checkKmods, the sysctls only exist once vmm is loaded
+		return nil
+	}
+
+	var failures []preflightFailure
+	if p.sysctl("hw.vmm.vmx.initialized") != "1" && p.sysctl("hw.vmm.svm.features") == "" {
+		failures = append(failures, preflightFailure{
+			"vmm could not initialize hardware virtualization",
+			"enable VT-x/AMD-V in the firmware settings, bhyve needs VT-x with EPT or AMD-V with RVI",
+		})
+	}
+	if p.sysctl("hw.vmm.vmx.cap.unrestricted_guest") == "0" {
+		failures = append(failures, preflightFailure{
+			"CPU lacks VT-x unrestricted guest support",
+			"bhyve needs a CPU with EPT and unrestricted guest support, such as Intel Westmere or later",
+		})
+	}
+	if dmesg, err := p.runner.output("cat", p.dmesgBoot); err == nil && !strings.Contains(string(dmesg), "POPCNT") {
+		failures = append(failures, preflightFailure{
+			"CPU lacks POPCNT",
+			"bhyve needs a CPU with the POPCNT instruction",
+		})
+	}
+	return failures
+}
+
+// devfsRuleset returns the rule lines of ruleset, given by name or number, in a
+// devfs.rules file, and whether it's there
+func devfsRuleset(rules string, ruleset string) ([]string, bool) {
+	var lines []string
+	found, in := false, false
+	for _, line := range strings.Split(rules, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if m := devfsSectionRegex.FindStringSubmatch(line); m != nil {
+			in = m[1] == ruleset || m[2] == ruleset
+			found = found || in
+			continue
+		}
+		if in && line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, found
+}
+
+// devfsAllowsNMDM reports whether ruleset, or a ruleset it includes, has a rule giving
+// nmdm devices a mode the group or everyone can read and write
+func devfsAllowsNMDM(rules string, ruleset string, depth int) bool {
+	if depth > 8 {
+		return false
+	}
+	lines, _ := devfsRuleset(rules, ruleset)
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "add" && fields[1] == "include" {
+			if devfsAllowsNMDM(rules, strings.TrimPrefix(fields[2], "$"), depth+1) {
+				return true
+			}
+			continue
+		}
+
+		matched, mode := false, uint64(0)
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "path":
+				matched, _ = path.Match(strings.Trim(fields[i+1], `'"`), "nmdm0A")
+			case "mode":
+				mode, _ = strconv.ParseUint(fields[i+1], 8, 32)
+			}
+		}
+		if fields[0] == "add" && matched && (mode&060 == 060 || mode&006 == 006) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDevfs checks the active devfs ruleset lets the user open nmdm devices, as in the
+// README
+func (p preflight) checkDevfs() []preflightFailure {
+	hint := "add to " + p.devfsRules + ":\n" +
+		"[system=10]\n" +
+		devfsRuleNMDM + "\n" +
+		"then run: sysrc devfs_system_ruleset=system && service devfs restart"
+
+	out, err := p.runner.output("sysrc", "-n", "devfs_system_ruleset")
+	ruleset := strings.TrimSpace(string(out))
+	if err != nil || ruleset == "" {
+		return []preflightFailure{{"devfs_system_ruleset not set in /etc/rc.conf", hint}}
+	}
+
+	rules, err := p.runner.output("cat", p.devfsRules)
+	if err != nil {
+		return []preflightFailure{{p.devfsRules + " can't be read", hint}}
+	}
+	if _, found := devfsRuleset(string(rules), ruleset); !found {
+		return []preflightFailure{{"devfs ruleset " + ruleset + " not found in " + p.devfsRules, hint}}
+	}
+	if !devfsAllowsNMDM(string(rules), ruleset, 0) {
+		return []preflightFailure{{"devfs ruleset " + ruleset + " has no rule letting users open nmdm devices", hint}}
+	}
+	return nil
+}
+
+// checkFdescfs checks fdescfs is mounted on /dev/fd, the helper hands bhyve and grub-bhyve
+// the files it checked through it
+func (p preflight) checkFdescfs() []preflightFailure {
+	out, err := p.runner.output("mount", "-p", "-t", "fdescfs")
+	if err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 && fields[1] == "/dev/fd" {
+				return nil
+			}
+		}
+	}
+	return []preflightFailure{{"fdescfs is not mounted on /dev/fd",
+		"run: mount -t fdescfs fdesc /dev/fd\n" +
+			"and add to /etc/fstab:\n" +
+			"fdesc /dev/fd fdescfs rw 0 0"}}
+}
+
+func (p preflight) checkFirmware() []preflightFailure {
+	if !p.image {
+		return nil
+	}
+	if _, err := p.runner.output("test", "-f", p.firmware); err == nil {
+		return nil
+	}
+	return []preflightFailure{{p.firmware + " not found, cloud images boot with UEFI", "pkg install bhyve-firmware"}}
+}
+
+// checkDiskSpace checks the store has room for the machine's disk image to fill up
+func (p preflight) checkDiskSpace() []preflightFailure {
+	out, err := p.runner.output("df", "-k", "-P", p.storePath)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) < 4 {
+		return nil
+	}
+	avail, err := strconv.ParseUint(fields[3], 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	free := avail * 1024
+	if free < uint64(p.diskSize) {
+		return []preflightFailure{{
+			fmt.Sprintf("%s has %d MB free, the disk image can grow to %d MB", p.storePath, free>>20, p.diskSize>>20),
+			"free some space, use a smaller --bhyve-disk-size, or a different --storage-path",
+		}}
+	}
+	return nil
+}
+
+// run runs every check, returning a preflightError listing all failures
+func (p preflight) run() error {
+	var failures []preflightFailure
+	for _, check := range []func() []preflightFailure{
+		p.checkCommands,
+		p.checkPrivilege,
+		p.checkKmods,
+		p.checkVirtualization,
+		p.checkDevfs,
+		p.checkFdescfs,
+		p.checkFirmware,
+		p.checkDiskSpace,
+	} {
+		failures = append(failures, check()...)
+	}
+
+	if len(failures) > 0 {
+		return preflightError(failures)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeHost implements the commandRunner interface for queries, answering them from
+// outputs. Commands without an output fail, and lookPath finds anything not in missing.
+type fakeHost struct {
+	outputs map[string]string
+	missing map[string]bool
+}
+
+func (h fakeHost) run(name string, args ...string) ([]byte, []byte, error) {
+	return nil, nil, errors.New("preflight changed the host")
+}
+
+func (h fakeHost) runInput(stdin string, name string, args ...string) ([]byte, error) {
+	return nil, errors.New("preflight changed the host")
+}
+
+func (h fakeHost) output(name string, args ...string) ([]byte, error) {
+	out, ok := h.outputs[strings.Join(append([]string{name}, args...), " ")]
+	if !ok {
+		return nil, errors.New("exit status 1")
+	}
+	return []byte(out), nil
+}
+
+func (h fakeHost) lookPath(name string) (string, error) {
+	if h.missing[name] {
+		return "", errors.New("not found")
+	}
+	return name, nil
+}
+
+func (h fakeHost) do(description string, change func() error) error {
+	return errors.New("preflight changed the host")
+}
+
+const testHelper = "/usr/local/bin/docker-machine-driver-bhyve"
+
+// healthyHost returns the outputs of a FreeBSD host set up as the README says
+func healthyHost() fakeHost {
+	return fakeHost{
+		outputs: map[string]string{
+			"kldstat -q -m vmm":                           "",
+			"kldstat -q -m nmdm":                          "",
+			"kldstat -q -m ng_ether":                      "",
+			"sysctl -n hw.vmm.vmx.initialized":            "1\n",
+			"sysctl -n hw.vmm.vmx.cap.unrestricted_guest": "1\n",
+			"cat " + defaultDmesgBoot:                     "  Features2=0x7ffafbff<SSE3,PCLMULQDQ,POPCNT,AESNI>\n",
+			"sysrc -n devfs_system_ruleset":               "system\n",
+			"cat " + defaultDevfsRules:                    "[system=10]\nadd path 'nmdm*' mode 0660\n",
+			"test -f " + defaultFirmware:                  "",
+			"mount -p -t fdescfs":                         "fdesc\t\t\t/dev/fd\t\tfdescfs\trw\t\t0 0\n",
+			"df -k -P /store": "Filesystem 1024-blocks Used Available Capacity Mounted on\n" +
+				"zroot/home 104857600 1048576 52428800 2% /home\n",
+			"stat -f %u %Lp " + testHelper:                              "0 755\n",
+			"sudo -n " + testHelper + " " + helperSubcommand + " check": "",
+		},
+		missing: map[string]bool{},
+	}
+}
+
+func testPreflight(host fakeHost) preflight {
+	return preflight{
+		runner:     host,
+		devfsRules: defaultDevfsRules,
+		dmesgBoot:  defaultDmesgBoot,
+		firmware:   defaultFirmware,
+		helper:     testHelper,
+		privilege:  privilegeSudo,
+		storePath:  "/store",
+		diskSize:   defaultDiskSize * 1024 * 1024,
+		image:      true,
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(h fakeHost)
+		want  string
+	}{
+		{"healthy", func(h fakeHost) {}, ""},
+		{"no dnsmasq", func(h fakeHost) { h.missing["/usr/local/sbin/dnsmasq"] = true }, "/usr/local/sbin/dnsmasq not found"},
+		{"no sudo rule", func(h fakeHost) { delete(h.outputs, "sudo -n "+testHelper+" "+helperSubcommand+" check") },
+			"no password-less sudo"},
+		{"helper writable", func(h fakeHost) { h.outputs["stat -f %u %Lp "+testHelper] = "0 775\n" }, "only be writable by root"},
+		{"helper owned by user", func(h fakeHost) { h.outputs["stat -f %u %Lp "+testHelper] = "1001 755\n" }, "must belong to root"},
+		{"no vmm", func(h fakeHost) { delete(h.outputs, "kldstat -q -m vmm") }, "kernel module vmm not loaded"},
+		{"no virtualization", func(h fakeHost) { h.outputs["sysctl -n hw.vmm.vmx.initialized"] = "0\n" },
+			"could not initialize hardware virtualization"},
+		{"amd", func(h fakeHost) {
+			delete(h.outputs, "sysctl -n hw.vmm.vmx.initialized")
+			delete(h.outputs, "sysctl -n hw.vmm.vmx.cap.unrestricted_guest")
+			h.outputs["sysctl -n hw.vmm.svm.features"] = "0x2ef\n"
+		}, ""},
+		{"no popcnt", func(h fakeHost) { h.outputs["cat "+defaultDmesgBoot] = "  Features2=0x7ffafbff<SSE3>\n" }, "CPU lacks POPCNT"},
+		{"no dmesg.boot", func(h fakeHost) { delete(h.outputs, "cat "+defaultDmesgBoot) }, ""},
+		{"no ruleset", func(h fakeHost) { h.outputs["sysrc -n devfs_system_ruleset"] = "\n" }, "devfs_system_ruleset not set"},
+		{"no devfs.rules", func(h fakeHost) { delete(h.outputs, "cat "+defaultDevfsRules) }, "can't be read"},
+		{"other ruleset", func(h fakeHost) { h.outputs["sysrc -n devfs_system_ruleset"] = "jails\n" },
+			"devfs ruleset jails not found"},
+		{"nmdm in another ruleset", func(h fakeHost) {
+			h.outputs["cat "+defaultDevfsRules] = "[system=10]\nadd path 'tap*' mode 0660\n\n[jails=11]\nadd path 'nmdm*' mode 0660\n"
+		}, "devfs ruleset system has no rule"},
+		{"nmdm commented out", func(h fakeHost) {
+			h.outputs["cat "+defaultDevfsRules] = "[system=10]\n# add path 'nmdm*' mode 0660\n"
+		}, "devfs ruleset system has no rule"},
+		{"no fdescfs", func(h fakeHost) { h.outputs["mount -p -t fdescfs"] = "" }, "fdescfs is not mounted"},
+		{"fdescfs elsewhere", func(h fakeHost) { h.outputs["mount -p -t fdescfs"] = "fdesc /compat/linux/dev/fd fdescfs rw 0 0\n" },
+			"fdescfs is not mounted"},
+		{"no firmware", func(h fakeHost) { delete(h.outputs, "test -f "+defaultFirmware) }, "cloud images boot with UEFI"},
+		{"full disk", func(h fakeHost) {
+			h.outputs["df -k -P /store"] = "Filesystem 1024-blocks Used Available Capacity Mounted on\n" +
+				"zroot/home 104857600 104000000 857600 99% /home\n"
+		}, "/store has 837 MB free"},
+		{"no store yet", func(h fakeHost) { delete(h.outputs, "df -k -P /store") }, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := healthyHost()
+			tt.setup(host)
+
+			err := testPreflight(host).run()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("run() = %v", err)
+				}
+				return
+			}
+			perr, ok := err.(preflightError)
+			if !ok || len(perr) != 1 || !strings.Contains(perr[0].problem, tt.want) {
+				t.Errorf("run() = %v, want only %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevfsAllowsNMDM(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		ruleset string
+		want    bool
+	}{
+		{"readme", "[system=10]\nadd path 'nmdm*' mode 0660\n", "system", true},
+		{"by number", "[system=10]\nadd path 'nmdm*' mode 0660\n", "10", true},
+		{"unquoted with group", "[system=10]\nadd path nmdm* mode 660 group operator\n", "system", true},
+		{"everyone", "[system=10]\nadd path 'nmdm*' mode 0666\n", "system", true},
+		{"owner only", "[system=10]\nadd path 'nmdm*' mode 0600\n", "system", false},
+		{"other devices", "[system=10]\nadd path 'tap*' mode 0660\n", "system", false},
+		{"hidden", "[system=10]\nadd hide path 'nmdm*'\n", "system", false},
+		{"included", "[base=5]\nadd path 'nmdm*' mode 0660\n\n[system=10]\nadd include $base\n", "system", true},
+		{"include loop", "[a=5]\nadd include $b\n\n[b=6]\nadd include $a\n", "a", false},
+		{"trailing comment", "[system=10] # mine\nadd path 'nmdm*' mode 0660 # consoles\n", "system", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := devfsAllowsNMDM(tt.rules, tt.ruleset, 0); got != tt.want {
+				t.Errorf("devfsAllowsNMDM() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFixDevfsRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  string
+	}{
+		{"empty", "", "[system=10]\n" + devfsRuleNMDM + "\n"},
+		{"already there", "[system=10]\n" + devfsRuleNMDM + "\n", "[system=10]\n" + devfsRuleNMDM + "\n"},
+		{"in another ruleset", "[jails=10]\n" + devfsRuleNMDM + "\n",
+			"[jails=10]\n" + devfsRuleNMDM + "\n\n[system=11]\n" + devfsRuleNMDM + "\n"},
+		{"ruleset without it", "[system=10]\nadd path 'tap*' mode 0660\n",
+			"[system=10]\n" + devfsRuleNMDM + "\nadd path 'tap*' mode 0660\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fixDevfsRules(tt.rules, "system")
+			if got != tt.want {
+				t.Errorf("fixDevfsRules() = %q, want %q", got, tt.want)
+			}
+			if !devfsAllowsNMDM(got, "system", 0) {
+				t.Errorf("the fixed rules still don't allow nmdm:\n%s", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// How the driver gets root to run the helper
+const (
+	privilegeAuto = "auto"
+	privilegeNone = "none"
+	privilegeSudo = "sudo"
+	privilegeDoas = "doas"
+)
+
+var privilege = privilegeAuto
+
+func validatePrivilege(p string) error {
+	switch p {
+	case "", privilegeAuto, privilegeNone, privilegeSudo, privilegeDoas:
+		return nil
+	}
+	return fmt.Errorf("unknown privilege escalation %s, use auto, none, sudo or doas", p)
+}
+
+// setPrivilege selects how to get root for the rest of the process, every driver entry
+// point running commands as root calls it with the machine's setting
+func setPrivilege(p string) {
+	if p == "" {
+		p = privilegeAuto
+	}
+	privilege = p
+}
+
+// detectPrivilege picks none when already root, otherwise sudo or doas, whichever is installed
+func detectPrivilege(r commandRunner, euid int) (string, error) {
+	if euid == 0 {
+		return privilegeNone, nil
+	}
+	for _, p := range []string{privilegeSudo, privilegeDoas} {
+		if _, err := r.lookPath(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", errors.New("neither sudo nor doas is installed, install one or run as root")
+}
+
+func currentPrivilege() (string, error) {
+	if privilege != privilegeAuto {
+		return privilege, nil
+	}
+	return detectPrivilege(runner, os.Geteuid())
+}
+
+// CheckDoas refuses to run anything but the helper as root through doas. doas.conf can't
+// limit the driver to its helper subcommand, so this stops the doas rule giving the user
+// the rest of the driver, such as the plugin server or doctor --fix, as root.
+func CheckDoas(args []string) error {
+	return checkDoas(args, os.Geteuid(), os.Getenv("DOAS_USER"))
+}
+
+func checkDoas(args []string, euid int, doasuser string) error {
+	if euid != 0 || doasuser == "" || (len(args) > 0 && args[0] == helperSubcommand) {
+		return nil
+	}
+	return fmt.Errorf("only the %s subcommand can be run through doas, run docker-machine as %s instead",
+		helperSubcommand, doasuser)
+}
+
+// rootCommand returns the command line running args as root
+func rootCommand(args ...string) ([]string, error) {
+	p, err := currentPrivilege()
+	if err != nil {
+		return nil, err
+	}
+	if p == privilegeNone {
+		return args, nil
+	}
+	return append([]string{p}, args...), nil
+}
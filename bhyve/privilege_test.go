@@ -0,0 +1,112 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCheckDoas(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		euid     int
+		doasuser string
+		wantErr  bool
+	}{
+		{"helper through doas", []string{"helper", "check"}, 0, "jsmith", false},
+		{"plugin through doas", nil, 0, "jsmith", true},
+		{"doctor through doas", []string{"doctor", "--fix", "--yes"}, 0, "jsmith", true},
+		{"helper name as an argument", []string{"doctor", "helper"}, 0, "jsmith", true},
+		{"root", []string{"doctor", "--fix"}, 0, "", false},
+		{"user", nil, 1001, "", false},
+		{"doas to another user", []string{"doctor"}, 1002, "jsmith", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDoas(tt.args, tt.euid, tt.doasuser)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkDoas() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// withEnv sets the environment variables in vars, returning a function restoring them
+func withEnv(vars map[string]string) func() {
+	saved := map[string]*string{}
+	for name, value := range vars {
+		if old, ok := os.LookupEnv(name); ok {
+			saved[name] = &old
+		} else {
+			saved[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, old := range saved {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+func TestHelperArgsPrivilege(t *testing.T) {
+	defer setPrivilege(privilege)
+
+	setPrivilege(privilegeSudo)
+	args, err := helperArgs("check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args[0] != privilegeSudo || args[2] != helperSubcommand {
+		t.Errorf("helperArgs() with sudo = %v", args)
+	}
+
+	setPrivilege(privilegeNone)
+	args, err = helperArgs("check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(args[:len(helperEnv)], " ") != strings.Join(helperEnv, " ") || args[len(helperEnv)+1] != helperSubcommand {
+		t.Errorf("helperArgs() as root = %v, want the sudo and doas variables removed", args)
+	}
+}
+
+// TestHelperAsRoot checks the helper started by a driver running as root from a sudo
+// or doas shell acts for root rather than the user who started the shell
+func TestHelperAsRoot(t *testing.T) {
+	requireRoot(t)
+	defer withEnv(map[string]string{"SUDO_UID": "1001", "SUDO_GID": "1001", "SUDO_USER": "jsmith", "DOAS_USER": "root"})()
+
+	// what the variables would make the helper do
+	if u, err := currentHelperUser(); err != nil || u.uid != 1001 {
+		t.Fatalf("currentHelperUser() with SUDO_UID = %+v, %v", u, err)
+	}
+
+	out, err := exec.Command(helperEnv[0], append(helperEnv[1:], "env")...).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "SUDO_") || strings.HasPrefix(line, "DOAS_USER=") {
+			t.Errorf("the helper gets %s", line)
+		}
+	}
+
+	for _, name := range []string{"SUDO_UID", "SUDO_GID", "SUDO_USER", "DOAS_USER"} {
+		os.Unsetenv(name)
+	}
+	if u, err := currentHelperUser(); err != nil || u.uid != 0 || u.gid != 0 {
+		t.Errorf("currentHelperUser() without the variables = %+v, %v, want root", u, err)
+	}
+}
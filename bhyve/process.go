@@ -0,0 +1,58 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// processChecker inspects processes by pid.
+type processChecker interface {
+	// alive reports whether a process with the given pid exists.
+	alive(pid int) bool
+	// command returns the command name of the process with the given pid.
+	command(pid int) (string, error)
+}
+
+// psProcessChecker implements the processChecker interface using kill(2) and ps(1).
+type psProcessChecker struct{}
+
+func (psProcessChecker) alive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	// processes started via sudo belong to root, so EPERM still means it exists
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func (psProcessChecker) command(pid int) (string, error) {
+	out, err := runner.output("ps", "-o", "comm=", "-p", strconv.Itoa(pid))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Base(strings.TrimSpace(string(out))), nil
+}
+
+var processes processChecker = psProcessChecker{}
+
+// processIs reports whether pid is alive and running command.
+func processIs(pid int, command string) bool {
+	if !processes.alive(pid) {
+		return false
+	}
+
+	name, err := processes.command(pid)
+	if err != nil {
+		return false
+	}
+
+	return name == command
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+// fakeProcesses implements the processChecker interface with a fixed process table
+type fakeProcesses map[int]string
+
+func (f fakeProcesses) alive(pid int) bool {
+	_, ok := f[pid]
+	return ok
+}
+
+func (f fakeProcesses) command(pid int) (string, error) {
+	return f[pid], nil
+}
+
+// withProcesses replaces the process checker, returning a function restoring it
+func withProcesses(p processChecker) func() {
+	saved := processes
+	processes = p
+	return func() { processes = saved }
+}
+
+func TestPsProcessChecker(t *testing.T) {
+	checker := psProcessChecker{}
+
+	if !checker.alive(os.Getpid()) {
+		t.Error("this process isn't alive")
+	}
+	if checker.alive(0) || checker.alive(-1) {
+		t.Error("invalid pids are alive")
+	}
+
+	name, err := checker.command(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Base(os.Args[0]); !strings.HasPrefix(want, name) {
+		t.Errorf("command() = %q, want %q", name, want)
+	}
+	if !processIs(os.Getpid(), name) || processIs(os.Getpid(), "dnsmasq") {
+		t.Error("processIs doesn't match the command name")
+	}
+}
+
+func TestDHCPServerPid(t *testing.T) {
+	defer withProcesses(fakeProcesses{100: "dnsmasq", 200: "sshd"})()
+	defer withRunDir(t)()
+
+	tests := []struct {
+		name    string
+		pidfile string
+		want    int
+	}{
+		{"running", "100\n", 100},
+		{"reused pid", "200\n", 0},
+		{"dead", "300\n", 0},
+		{"garbage", "dnsmasq\n", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dhcpdir, err := ioutil.TempDir("", "dnsmasq")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dhcpdir)
+
+			if err := os.MkdirAll(dhcpRunDir(dhcpdir), 0755); err != nil {
+				t.Fatal(err)
+			}
+			pidfile := filepath.Join(dhcpRunDir(dhcpdir), dhcpPidFilename)
+			if err := ioutil.WriteFile(pidfile, []byte(tt.pidfile), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			pid, err := dhcpServerPid(dhcpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pid != tt.want {
+				t.Errorf("dhcpServerPid() = %d, want %d", pid, tt.want)
+			}
+		})
+	}
+}
+
+func TestDHCPServerUsers(t *testing.T) {
+	defer withProcesses(fakeProcesses{})()
+	defer withRunDir(t)()
+
+	storepath, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storepath)
+
+	// created before the driver kept host entries
+	writeStoredMachine(t, storepath, "legacy", `{"Bridge": "bridge0", "DHCPRange": "192.168.99.100,192.168.99.254"}`)
+	writeStoredMachine(t, storepath, "switched", `{"Bridge": "bridge0", "NetworkBackend": "vale", "ValeSwitch": "vale0"}`)
+
+	d := NewDriver("new", storepath)
+	if err := writeDHCPHost(d.dhcpDir(), d.MachineName, "58:9c:fc:00:00:01", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := d.dhcpServerUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(users, ",") != "legacy" {
+		t.Errorf("dhcpServerUsers() = %v, want [legacy]", users)
+	}
+
+	if err := os.MkdirAll(dhcpRunDir(d.dhcpDir()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	pidfile := filepath.Join(dhcpRunDir(d.dhcpDir()), dhcpPidFilename)
+	if err := ioutil.WriteFile(pidfile, []byte("100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer withProcesses(fakeProcesses{100: "dnsmasq"})()
+
+	var out bytes.Buffer
+	if err := DHCPStatus(&out, storepath); err != nil {
+		t.Fatal(err)
+	}
+	if want := "bridge0: " + state.Running.String() + ", used by legacy, new\n"; out.String() != want {
+		t.Errorf("DHCPStatus() = %q, want %q", out.String(), want)
+	}
+
+	// the legacy machine still needs it
+	rec := &recordingRunner{}
+	defer withRunner(rec)()
+	if err := d.stopDHCPServerIfUnused(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.recorded) != 0 {
+		t.Errorf("stopped a DHCP server still in use: %v", rec.recorded)
+	}
+
+	if err := os.RemoveAll(filepath.Join(storepath, "machines", "legacy")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.stopDHCPServerIfUnused(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.recorded) == 0 || !strings.Contains(rec.recorded[0], "signal-dhcp bridge0 TERM") {
+		t.Errorf("didn't stop the unused DHCP server: %v", rec.recorded)
+	}
+	if !strings.Contains(strings.Join(rec.recorded, "\n"), "wait for dnsmasq") {
+		t.Errorf("didn't wait for dnsmasq to exit: %v", rec.recorded)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// proxySettings are the proxy environment variables to set in the guest
+type proxySettings struct {
+	httpProxy  string
+	httpsProxy string
+	noProxy    string
+}
+
+func (p proxySettings) empty() bool {
+	return p.httpProxy == "" && p.httpsProxy == ""
+}
+
+// hostProxyEnv returns a proxy variable from the host's environment, in either case
+func hostProxyEnv(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// guestProxyURL validates a proxy URL and points proxies on the host's loopback
+// interface at hostip, which is how the guest reaches the host
+func guestProxyURL(proxy string, hostip string) (string, error) {
+	if proxy == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		// curl and docker accept a bare host:port
+		u, err = url.Parse("http://" + proxy)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid proxy %s", proxy)
+		}
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		if strings.Contains(hostip, ":") {
+			hostip = "[" + hostip + "]"
+		}
+		if u.Port() != "" {
+			u.Host = hostip + ":" + u.Port()
+		} else {
+			u.Host = hostip
+		}
+	}
+
+	return u.String(), nil
+}
+
+// mergeNoProxy appends entries missing from the comma separated noproxy list
+func mergeNoProxy(noproxy string, entries ...string) string {
+	var list []string
+	seen := map[string]bool{}
+	for _, entry := range append(strings.Split(noproxy, ","), entries...) {
+		entry = strings.TrimSpace(entry)
+		if entry != "" && !seen[entry] {
+			seen[entry] = true
+			list = append(list, entry)
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// networkCIDR returns the network a host address in CIDR notation is on, e.g.
+// 192.168.99.0/24 for 192.168.99.1/24
+func networkCIDR(subnet string) (string, error) {
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", err
+	}
+	return network.String(), nil
+}
+
+// variables returns the variables to set, in both cases as tools disagree on which to read
+func (p proxySettings) variables() [][2]string {
+	var vars [][2]string
+	for _, v := range [][2]string{{"HTTP_PROXY", p.httpProxy}, {"HTTPS_PROXY", p.httpsProxy}, {"NO_PROXY", p.noProxy}} {
+		if v[1] != "" {
+			vars = append(vars, v, [2]string{strings.ToLower(v[0]), v[1]})
+		}
+	}
+	return vars
+}
+
+// renderProfileExports returns the boot2docker profile lines setting the proxy for dockerd
+func (p proxySettings) renderProfileExports() string {
+	var b strings.Builder
+	for _, v := range p.variables() {
+		b.WriteString("export " + v[0] + "=" + shellQuote(v[1]) + "\n")
+	}
+	return b.String()
+}
+
+// renderEnvironment returns /etc/environment lines for cloud images
+func (p proxySettings) renderEnvironment() string {
+	var b strings.Builder
+	for _, v := range p.variables() {
+		b.WriteString(v[0] + "=" + strconv.Quote(v[1]) + "\n")
+	}
+	return b.String()
+}
+
+// renderSystemdDropIn returns a docker.service drop-in setting the proxy for dockerd
+func (p proxySettings) renderSystemdDropIn() string {
+	var b strings.Builder
+	b.WriteString("[Service]\n")
+	for _, v := range p.variables() {
+		b.WriteString("Environment=" + strconv.Quote(v[0]+"="+v[1]) + "\n")
+	}
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
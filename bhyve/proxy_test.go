@@ -0,0 +1,73 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"testing"
+)
+
+func TestGuestProxyURL(t *testing.T) {
+	tests := []struct {
+		proxy   string
+		hostip  string
+		want    string
+		wantErr bool
+	}{
+		{"", "192.168.99.1", "", false},
+		{"http://proxy.example.com:3128", "192.168.99.1", "http://proxy.example.com:3128", false},
+		{"proxy.example.com:3128", "192.168.99.1", "http://proxy.example.com:3128", false},
+		{"http://localhost:3128", "192.168.99.1", "http://192.168.99.1:3128", false},
+		{"http://user:pw@127.0.0.1", "192.168.99.1", "http://user:pw@192.168.99.1", false},
+		{"http://[::1]:3128", "fd00:99::1", "http://[fd00:99::1]:3128", false},
+		{"http://%zz", "192.168.99.1", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := guestProxyURL(tt.proxy, tt.hostip)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("guestProxyURL(%q) = %q, %v, want %q, error %t", tt.proxy, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSetGuestProxy(t *testing.T) {
+	d := NewDriver("dev", "/store")
+	d.HTTPProxy = "http://localhost:3128"
+	d.NoProxy = "example.com,localhost"
+	d.EnableDNS = true
+	d.DNSDomain = "docker-machine.local"
+
+	if err := d.setGuestProxy(); err != nil {
+		t.Fatal(err)
+	}
+	if d.HTTPProxy != "http://192.168.99.1:3128" {
+		t.Errorf("HTTPProxy = %s", d.HTTPProxy)
+	}
+	if want := "example.com,localhost,127.0.0.1,192.168.99.0/24,.docker-machine.local"; d.NoProxy != want {
+		t.Errorf("NoProxy = %s, want %s", d.NoProxy, want)
+	}
+
+	exports := d.proxySettings().renderProfileExports()
+	if want := "export HTTP_PROXY='http://192.168.99.1:3128'\nexport http_proxy='http://192.168.99.1:3128'\n" +
+		"export NO_PROXY='" + d.NoProxy + "'\nexport no_proxy='" + d.NoProxy + "'\n"; exports != want {
+		t.Errorf("renderProfileExports() = %q, want %q", exports, want)
+	}
+}
+
+// TestProxyOnlyUserdata checks a proxy alone is installed before provisioning, like the
+// other userdata options
+func TestProxyOnlyUserdata(t *testing.T) {
+	opts := userdataOptions{proxy: proxySettings{httpsProxy: "http://proxy:3128"}}
+	if opts.empty() {
+		t.Fatal("a proxy alone isn't installed")
+	}
+	profile, err := renderProfile(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(profile) != "export HTTPS_PROXY='http://proxy:3128'\nexport https_proxy='http://proxy:3128'\n" {
+		t.Errorf("renderProfile() = %q", profile)
+	}
+}
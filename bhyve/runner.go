@@ -0,0 +1,123 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+)
+
+// commandRunner runs host commands and makes other host changes, so the driver can be
+// tested off FreeBSD and dry runs can show what it would do.
+type commandRunner interface {
+	// run runs a command changing the host and returns its stdout and stderr.
+	run(name string, args ...string) ([]byte, []byte, error)
+	// runInput runs a command with stdin as its input and returns its combined output.
+	runInput(stdin string, name string, args ...string) ([]byte, error)
+	// output runs a command only querying the host and returns its stdout.
+	output(name string, args ...string) ([]byte, error)
+	// lookPath finds a command like exec.LookPath.
+	lookPath(name string) (string, error)
+	// do makes a change to the host other than running a command, such as writing a file.
+	do(description string, change func() error) error
+}
+
+// execRunner implements the commandRunner interface using os/exec.
+type execRunner struct{}
+
+func (execRunner) run(name string, args ...string) ([]byte, []byte, error) {
+	cmd := exec.Command(name, args...)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+func (execRunner) runInput(stdin string, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	return cmd.CombinedOutput()
+}
+
+func (execRunner) output(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+func (execRunner) lookPath(name string) (string, error) {
+	return exec.LookPath(name)
+}
+
+func (execRunner) do(description string, change func() error) error {
+	return change()
+}
+
+var runner commandRunner = execRunner{}
+
+// recordingRunner implements the commandRunner interface by recording the commands and
+// changes, in order, instead of making them. Queries are passed to queries if set, so a
+// dry run sees the real host, otherwise they get a reply like commands do.
+type recordingRunner struct {
+	queries  commandRunner
+	replies  map[string]string
+	recorded []string
+}
+
+// reply sets the output of commands whose command line starts with prefix
+func (r *recordingRunner) reply(prefix string, output string) {
+	if r.replies == nil {
+		r.replies = map[string]string{}
+	}
+	r.replies[prefix] = output
+}
+
+// replyFor returns the reply with the longest prefix of cmdline
+func (r *recordingRunner) replyFor(cmdline string) []byte {
+	longest := ""
+	for prefix := range r.replies {
+		if strings.HasPrefix(cmdline, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return nil
+	}
+	return []byte(r.replies[longest])
+}
+
+func (r *recordingRunner) record(name string, args []string) []byte {
+	cmdline := strings.Join(append([]string{name}, args...), " ")
+	r.recorded = append(r.recorded, cmdline)
+	return r.replyFor(cmdline)
+}
+
+func (r *recordingRunner) run(name string, args ...string) ([]byte, []byte, error) {
+	return r.record(name, args), nil, nil
+}
+
+func (r *recordingRunner) runInput(stdin string, name string, args ...string) ([]byte, error) {
+	return r.record(name, args), nil
+}
+
+func (r *recordingRunner) output(name string, args ...string) ([]byte, error) {
+	if r.queries != nil {
+		return r.queries.output(name, args...)
+	}
+	return r.replyFor(strings.Join(append([]string{name}, args...), " ")), nil
+}
+
+func (r *recordingRunner) lookPath(name string) (string, error) {
+	if r.queries != nil {
+		return r.queries.lookPath(name)
+	}
+	return name, nil
+}
+
+func (r *recordingRunner) do(description string, change func() error) error {
+	r.recorded = append(r.recorded, "# "+description)
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"testing"
+)
+
+// withRunner replaces the command runner, returning a function restoring it
+func withRunner(r commandRunner) func() {
+	saved := runner
+	runner = r
+	return func() { runner = saved }
+}
+
+func TestRecordingRunnerReplies(t *testing.T) {
+	rec := &recordingRunner{}
+	rec.reply("sysctl -n", "0")
+	rec.reply("sysctl -n net.inet.ip.forwarding", "1")
+
+	if out, _ := rec.output("sysctl", "-n", "net.inet.ip.forwarding"); string(out) != "1" {
+		t.Errorf("the longest prefix didn't win: %q", out)
+	}
+	if out, _ := rec.output("sysctl", "-n", "kern.ostype"); string(out) != "0" {
+		t.Errorf("got %q", out)
+	}
+	if out, _, _ := rec.run("ifconfig", "bridge0"); out != nil {
+		t.Errorf("got %q for a command without a reply", out)
+	}
+
+	changed := false
+	if err := rec.do("change something", func() error { changed = true; return nil }); err != nil || changed {
+		t.Error("do made the change")
+	}
+
+	want := []string{"ifconfig bridge0", "# change something"}
+	if len(rec.recorded) != len(want) {
+		t.Fatalf("recorded %v, want %v", rec.recorded, want)
+	}
+	for i := range want {
+		if rec.recorded[i] != want[i] {
+			t.Errorf("recorded %v, want %v", rec.recorded, want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+var shareTagRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// Share is a host directory shared into the guest with virtio-9p and mounted at the same path.
+type Share struct {
+	HostPath string
+	Tag      string
+	ReadOnly bool
+}
+
+// parseShareSpec parses a --bhyve-share value of the form hostpath:tag[:ro]
+func parseShareSpec(spec string) (Share, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return Share{}, fmt.Errorf("invalid share %q, use hostpath:tag[:ro]", spec)
+	}
+
+	share := Share{Tag: fields[1]}
+	if len(fields) == 3 {
+		if fields[2] != "ro" {
+			return Share{}, fmt.Errorf("invalid share option %q in %q", fields[2], spec)
+		}
+		share.ReadOnly = true
+	}
+
+	if !shareTagRegex.MatchString(share.Tag) {
+		return Share{}, fmt.Errorf("invalid share tag %q, only letters, digits and _ are allowed", share.Tag)
+	}
+
+	hostpath, err := filepath.Abs(fields[0])
+	if err != nil {
+		return Share{}, err
+	}
+	// bhyve splits its device options on commas
+	if strings.Contains(hostpath, ",") {
+		return Share{}, fmt.Errorf("can't share %s, it contains a comma", hostpath)
+	}
+	info, err := os.Stat(hostpath)
+	if err != nil {
+		return Share{}, err
+	}
+	if !info.IsDir() {
+		return Share{}, fmt.Errorf("%s is not a directory", hostpath)
+	}
+	share.HostPath = hostpath
+
+	return share, nil
+}
+
+// bhyveDevice returns the bhyve -s device for the share
+func (s Share) bhyveDevice() string {
+	device := "virtio-9p," + s.Tag + "=" + s.HostPath
+	if s.ReadOnly {
+		device += ",ro"
+	}
+	return device
+}
+
+// mountCommand returns the guest command mounting the share at its host path
+func (s Share) mountCommand() string {
+	options := "trans=virtio,version=9p2000.L"
+	if s.ReadOnly {
+		options += ",ro"
+	}
+	return fmt.Sprintf("sudo mkdir -p %s && sudo mount -t 9p -o %s %s %s", shellQuote(s.HostPath), options, s.Tag,
+		shellQuote(s.HostPath))
+}
+
+func mountShares(d drivers.Driver, shares []Share) error {
+	for _, share := range shares {
+		log.Infof("Mounting %s in the guest...", share.HostPath)
+		out, err := drivers.RunSSHCommandFromDriver(d, share.mountCommand())
+		if err != nil {
+			return fmt.Errorf("failed to mount %s: %s: %s", share.HostPath, err, out)
+		}
+	}
+
+	return nil
+}
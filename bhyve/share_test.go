@@ -0,0 +1,73 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseShareSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	quoted := filepath.Join(dir, "it's here")
+	comma := filepath.Join(dir, "a,b")
+	for _, path := range []string{quoted, comma} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		spec    string
+		want    Share
+		wantErr bool
+	}{
+		{dir + ":src", Share{HostPath: dir, Tag: "src"}, false},
+		{dir + ":src:ro", Share{HostPath: dir, Tag: "src", ReadOnly: true}, false},
+		{quoted + ":src", Share{HostPath: quoted, Tag: "src"}, false},
+		{dir, Share{}, true},
+		{dir + ":src:rw", Share{}, true},
+		{dir + ":bad-tag", Share{}, true},
+		{comma + ":src", Share{}, true},
+		{filepath.Join(dir, "missing") + ":src", Share{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			share, err := parseShareSpec(tt.spec)
+			if (err != nil) != tt.wantErr || share != tt.want {
+				t.Errorf("parseShareSpec() = %+v, %v, want %+v, error %t", share, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMountCommandQuoting(t *testing.T) {
+	share := Share{HostPath: "/home/me/it's $HOME `here`", Tag: "src", ReadOnly: true}
+
+	cmd := share.mountCommand()
+	if !strings.Contains(cmd, "-o trans=virtio,version=9p2000.L,ro src ") {
+		t.Errorf("mountCommand() = %s", cmd)
+	}
+
+	// run it with a function printing its arguments in place of sudo, the path must come through unchanged
+	out, err := exec.Command("sh", "-c", "sudo() { printf '%s\\n' \"$*\"; }; "+cmd).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "mkdir -p " + share.HostPath + "\nmount -t 9p -o trans=virtio,version=9p2000.L,ro src " + share.HostPath + "\n"
+	if string(out) != want {
+		t.Errorf("the guest would run:\n%s\nwant:\n%s", out, want)
+	}
+}
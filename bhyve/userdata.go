@@ -0,0 +1,287 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+// boot2docker extracts userdata.tar to /home/docker, so extra files are staged there
+// and install.sh moves them to /var/lib/boot2docker
+const (
+	userdataDir     = ".bhyve"
+	userdataInstall = "/home/docker/" + userdataDir + "/install.sh"
+)
+
+// userdataOptions are extra files for the boot2docker persistence disk, paths are on the host
+type userdataOptions struct {
+	bootsync        string
+	bootlocal       string
+	profile         string
+	caCerts         []string
+	registryMirrors []string
+	proxy           proxySettings
+}
+
+func (o userdataOptions) empty() bool {
+	return o.bootsync == "" && o.bootlocal == "" && o.profile == "" && len(o.caCerts) == 0 &&
+		len(o.registryMirrors) == 0 && o.proxy.empty()
+}
+
+// renderProfile returns the additions to boot2docker's profile, the proxy settings
+// followed by the user's profile
+func renderProfile(opts userdataOptions) ([]byte, error) {
+	profile := []byte(opts.proxy.renderProfileExports())
+	if opts.profile != "" {
+		data, err := ioutil.ReadFile(opts.profile)
+		if err != nil {
+			return nil, err
+		}
+		profile = append(profile, data...)
+	}
+	return profile, nil
+}
+
+// bootsyncScript runs before docker starts on every boot, restoring the daemon config and
+// the docker init script wrapper, which the tmpfs root would otherwise lose
+const bootsyncScript = `#!/bin/sh
+# installed by docker-machine-driver-bhyve
+dir=/var/lib/boot2docker/bhyve
+
+if [ -f $dir/daemon.json ]; then
+	mkdir -p /etc/docker
+	cp $dir/daemon.json /etc/docker/daemon.json
+fi
+
+if [ ! -f /etc/init.d/docker.orig ]; then
+	mv /etc/init.d/docker /etc/init.d/docker.orig
+	install -m 0755 $dir/docker-init.sh /etc/init.d/docker
+fi
+
+if [ -f $dir/bootsync.sh ]; then
+	sh $dir/bootsync.sh
+fi
+`
+
+// dockerInitScript wraps boot2docker's docker init script, adding the profile additions
+// whenever docker starts. Provisioning replaces the profile and restarts docker, so
+// adding them once wouldn't last until the provisioned daemon runs.
+const dockerInitScript = `#!/bin/sh
+# installed by docker-machine-driver-bhyve
+dir=/var/lib/boot2docker/bhyve
+profile=/var/lib/boot2docker/profile
+
+if [ -f $dir/profile ] && ! grep -q '^# BEGIN docker-machine-driver-bhyve' $profile 2>/dev/null; then
+	{
+		echo '# BEGIN docker-machine-driver-bhyve'
+		cat $dir/profile
+		echo '# END docker-machine-driver-bhyve'
+	} >> $profile
+fi
+
+exec /etc/init.d/docker.orig "$@"
+`
+
+// installScript moves the staged files into place on the first boot, before provisioning,
+// and applies them straight away: docker is restarted and bootlocal.sh run, as boot2docker
+// started both before the files were there
+const installScript = `#!/bin/sh
+set -e
+src=/home/docker/` + userdataDir + `
+dst=/var/lib/boot2docker
+
+mkdir -p $dst/bhyve
+for f in bootsync.sh profile daemon.json docker-init.sh; do
+	if [ -f $src/$f ]; then
+		cp $src/$f $dst/bhyve/$f
+	fi
+done
+install -m 0755 $src/bootsync-wrapper.sh $dst/bootsync.sh
+if [ -f $src/bootlocal.sh ]; then
+	install -m 0755 $src/bootlocal.sh $dst/bootlocal.sh
+fi
+if [ -d $src/certs ]; then
+	mkdir -p $dst/certs
+	cp $src/certs/* $dst/certs/
+	cat $src/certs/* >> /etc/ssl/certs/ca-certificates.crt
+fi
+
+sh $dst/bootsync.sh
+/etc/init.d/docker restart
+if [ -f $dst/bootlocal.sh ]; then
+	sh $dst/bootlocal.sh > /var/log/bootlocal.log 2>&1 < /dev/null &
+fi
+`
+
+func addTarFile(tw *tar.Writer, name string, mode int64, data []byte) error {
+	file := &tar.Header{Name: name, Size: int64(len(data)), Mode: mode}
+	if err := tw.WriteHeader(file); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func addTarDir(tw *tar.Writer, name string, mode int64) error {
+	return tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: mode})
+}
+
+// caCertFiles expands the CA certificate options, which may be files or directories of
+// .pem and .crt files
+func caCertFiles(paths []string) ([]string, error) {
+	var certs []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			certs = append(certs, path)
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (ext == ".pem" || ext == ".crt") {
+				certs = append(certs, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(certs)
+	return certs, nil
+}
+
+// renderDaemonConfig returns the Docker daemon.json for the options, or nil if none is needed
+func renderDaemonConfig(opts userdataOptions) ([]byte, error) {
+	if len(opts.registryMirrors) == 0 {
+		return nil, nil
+	}
+	return json.MarshalIndent(map[string]interface{}{"registry-mirrors": opts.registryMirrors}, "", "  ")
+}
+
+// addUserdataFiles stages the optional files in the bundle
+func addUserdataFiles(tw *tar.Writer, opts userdataOptions) error {
+	if opts.empty() {
+		return nil
+	}
+
+	if err := addTarDir(tw, userdataDir, 0755); err != nil {
+		return err
+	}
+
+	files := []struct {
+		path string
+		name string
+		mode int64
+	}{
+		{opts.bootsync, "bootsync.sh", 0755},
+		{opts.bootlocal, "bootlocal.sh", 0755},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return err
+		}
+		if err := addTarFile(tw, userdataDir+"/"+f.name, f.mode, data); err != nil {
+			return err
+		}
+	}
+
+	profile, err := renderProfile(opts)
+	if err != nil {
+		return err
+	}
+	if len(profile) > 0 {
+		if err := addTarFile(tw, userdataDir+"/profile", 0644, profile); err != nil {
+			return err
+		}
+	}
+
+	certs, err := caCertFiles(opts.caCerts)
+	if err != nil {
+		return err
+	}
+	if len(certs) > 0 {
+		if err := addTarDir(tw, userdataDir+"/certs", 0755); err != nil {
+			return err
+		}
+	}
+	for i, cert := range certs {
+		data, err := ioutil.ReadFile(cert)
+		if err != nil {
+			return err
+		}
+		// boot2docker only picks up .pem files, names are numbered to avoid clashes
+		name := fmt.Sprintf("%s/certs/%02d-%s.pem", userdataDir, i,
+			strings.TrimSuffix(filepath.Base(cert), filepath.Ext(cert)))
+		if err := addTarFile(tw, name, 0644, data); err != nil {
+			return err
+		}
+	}
+
+	daemonconfig, err := renderDaemonConfig(opts)
+	if err != nil {
+		return err
+	}
+	if daemonconfig != nil {
+		if err := addTarFile(tw, userdataDir+"/daemon.json", 0644, daemonconfig); err != nil {
+			return err
+		}
+	}
+
+	if err := addTarFile(tw, userdataDir+"/bootsync-wrapper.sh", 0755, []byte(bootsyncScript)); err != nil {
+		return err
+	}
+	if err := addTarFile(tw, userdataDir+"/docker-init.sh", 0755, []byte(dockerInitScript)); err != nil {
+		return err
+	}
+	return addTarFile(tw, userdataDir+"/install.sh", 0755, []byte(installScript))
+}
+
+// installUserdata runs install.sh in the guest, once SSH is up on the first boot and before
+// docker-machine provisions it
+func installUserdata(d drivers.Driver, opts userdataOptions) error {
+	if opts.empty() {
+		return nil
+	}
+
+	log.Infof("Installing userdata files...")
+	out, err := drivers.RunSSHCommandFromDriver(d, "sudo sh "+userdataInstall)
+	if err != nil {
+		return fmt.Errorf("failed to install userdata files: %s: %s", err, out)
+	}
+
+	return nil
+}
+
+// validateRegistryMirror checks a mirror is an http(s) URL, as dockerd requires
+func validateRegistryMirror(mirror string) error {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("registry mirror %s should be an http or https URL", mirror)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testUserdataOptions writes a file for each userdata option to dir
+func testUserdataOptions(t *testing.T, dir string) userdataOptions {
+	files := map[string]string{
+		"bootsync.sh":    "touch " + filepath.Join(dir, "root", "bootsync-ran") + "\n",
+		"bootlocal.sh":   "touch " + filepath.Join(dir, "root", "bootlocal-ran") + "\n",
+		"profile":        "EXTRA_ARGS=\"$EXTRA_ARGS --label dev\"\n",
+		"certs/corp.crt": "corp cert\n",
+		"certs/lab.pem":  "lab cert\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return userdataOptions{
+		bootsync:        filepath.Join(dir, "bootsync.sh"),
+		bootlocal:       filepath.Join(dir, "bootlocal.sh"),
+		profile:         filepath.Join(dir, "profile"),
+		caCerts:         []string{filepath.Join(dir, "certs")},
+		registryMirrors: []string{"https://mirror.example.com"},
+		proxy:           proxySettings{httpProxy: "http://proxy:3128"},
+	}
+}
+
+func TestKeyBundleContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "userdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf, err := generateKeyBundle(filepath.Join(dir, "id_rsa"), testUserdataOptions(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int64{
+		"boot2docker, please format-me": 0,
+		".ssh":                          0700,
+		".ssh/authorized_keys":          0644,
+		".ssh/authorized_keys2":         0644,
+		".bhyve":                        0755,
+		".bhyve/bootsync.sh":            0755,
+		".bhyve/bootlocal.sh":           0755,
+		".bhyve/profile":                0644,
+		".bhyve/certs":                  0755,
+		".bhyve/certs/00-corp.pem":      0644,
+		".bhyve/certs/01-lab.pem":       0644,
+		".bhyve/daemon.json":            0644,
+		".bhyve/bootsync-wrapper.sh":    0755,
+		".bhyve/docker-init.sh":         0755,
+		".bhyve/install.sh":             0755,
+	}
+	contents := map[string]string{}
+	tr := tar.NewReader(buf)
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && hdr.Name != "boot2docker, please format-me" {
+			t.Errorf("the format magic is %s, it has to come first", hdr.Name)
+		}
+		mode, ok := want[hdr.Name]
+		if !ok {
+			t.Errorf("unexpected %s", hdr.Name)
+			continue
+		}
+		if hdr.Mode != mode {
+			t.Errorf("%s has mode %o, want %o", hdr.Name, hdr.Mode, mode)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[hdr.Name] = string(data)
+	}
+	for name := range want {
+		if _, ok := contents[name]; !ok {
+			t.Errorf("%s missing", name)
+		}
+	}
+
+	if want := "export HTTP_PROXY='http://proxy:3128'\n"; !strings.HasPrefix(contents[".bhyve/profile"], want) {
+		t.Errorf("profile doesn't start with the proxy:\n%s", contents[".bhyve/profile"])
+	}
+	if !strings.HasSuffix(contents[".bhyve/profile"], "--label dev\"\n") {
+		t.Errorf("profile doesn't end with the user's:\n%s", contents[".bhyve/profile"])
+	}
+	if !strings.Contains(contents[".bhyve/daemon.json"], "https://mirror.example.com") {
+		t.Errorf("daemon.json lacks the mirror:\n%s", contents[".bhyve/daemon.json"])
+	}
+}
+
+func TestKeyBundleWithoutUserdata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "userdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf, err := generateKeyBundle(filepath.Join(dir, "id_rsa"), userdataOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(hdr.Name, userdataDir) {
+			t.Errorf("bundle without userdata has %s", hdr.Name)
+		}
+	}
+}
+
+// TestUserdataFirstBoot runs install.sh in a fake boot2docker root, then replaces the
+// profile and restarts docker as provisioning does, checking docker gets the additions both
+// times
+func TestUserdataFirstBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "userdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	buf, err := generateKeyBundle(filepath.Join(dir, "id_rsa"), testUserdataOptions(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the scripts' paths are moved into root
+	rooted := strings.NewReplacer(
+		"/var/lib/boot2docker", root+"/var/lib/boot2docker",
+		"/home/docker", root+"/home/docker",
+		"/etc/", root+"/etc/",
+		"/var/log", root+"/var/log",
+	)
+	for _, d := range []string{"home/docker", "etc/init.d", "etc/ssl/certs", "var/lib/boot2docker", "var/log"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(root, "home/docker", hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(rooted.Replace(string(data))), os.FileMode(hdr.Mode)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// boot2docker's docker init script, logging each action with the profile it starts with
+	dockerlog := filepath.Join(root, "docker.log")
+	initscript := "#!/bin/sh\necho \"$1\" >> " + dockerlog + "\ncat " + root + "/var/lib/boot2docker/profile >> " + dockerlog + " 2>/dev/null\n"
+	if err := ioutil.WriteFile(filepath.Join(root, "etc/init.d/docker"), []byte(initscript), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	install := exec.Command("sh", filepath.Join(root, "home/docker", userdataDir, "install.sh"))
+	if out, err := install.CombinedOutput(); err != nil {
+		t.Fatalf("install.sh failed: %s: %s", err, out)
+	}
+
+	started, err := ioutil.ReadFile(dockerlog)
+	if err != nil {
+		t.Fatalf("docker wasn't restarted: %s", err)
+	}
+	if !strings.HasPrefix(string(started), "restart\n# BEGIN docker-machine-driver-bhyve\nexport HTTP_PROXY=") {
+		t.Errorf("docker restarted without the profile additions:\n%s", started)
+	}
+
+	checks := map[string]string{
+		"etc/docker/daemon.json":               "https://mirror.example.com",
+		"etc/ssl/certs/ca-certificates.crt":    "corp cert\nlab cert\n",
+		"var/lib/boot2docker/bootlocal.sh":     "bootlocal-ran",
+		"var/lib/boot2docker/certs/01-lab.pem": "lab cert\n",
+	}
+	for name, want := range checks {
+		data, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil || !strings.Contains(string(data), want) {
+			t.Errorf("%s = %q, %v, want it to contain %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "bootsync-ran")); err != nil {
+		t.Errorf("the user's bootsync.sh didn't run: %s", err)
+	}
+
+	// provisioning writes its own profile and restarts docker, twice to check the
+	// additions aren't repeated
+	profile := filepath.Join(root, "var/lib/boot2docker/profile")
+	for i := 0; i < 2; i++ {
+		if err := ioutil.WriteFile(dockerlog, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err := ioutil.WriteFile(profile, []byte("EXTRA_ARGS='--tlsverify'\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		restart := exec.Command(filepath.Join(root, "etc/init.d/docker"), "restart")
+		if out, err := restart.CombinedOutput(); err != nil {
+			t.Fatalf("docker restart failed: %s: %s", err, out)
+		}
+
+		started, err := ioutil.ReadFile(dockerlog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(started), "restart\nEXTRA_ARGS='--tlsverify'\n# BEGIN docker-machine-driver-bhyve\n") ||
+			strings.Count(string(started), "# BEGIN") != 1 {
+			t.Errorf("docker restarted with the wrong profile after provisioning:\n%s", started)
+		}
+	}
+}
+
+func TestUserdataScriptsSyntax(t *testing.T) {
+	for name, script := range map[string]string{
+		"bootsync":    bootsyncScript,
+		"docker init": dockerInitScript,
+		"install":     installScript,
+	} {
+		check := exec.Command("sh", "-n")
+		check.Stdin = bytes.NewBufferString(script)
+		if out, err := check.CombinedOutput(); err != nil {
+			t.Errorf("%s script: %s: %s", name, err, out)
+		}
+	}
+}
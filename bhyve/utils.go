@@ -5,10 +5,7 @@
 package bhyve
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/rand"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/docker/machine/libmachine/log"
@@ -16,7 +13,6 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -33,14 +29,6 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-func generateMACAddress() string {
-	oidprefix := "58:9c:fc"
-	b1, _ := randomHex(1)
-	b2, _ := randomHex(1)
-	b3, _ := randomHex(1)
-	return oidprefix + ":" + b1 + ":" + b2 + ":" + b3
-}
-
 func stripCtlAndExtFromBytes(str string) string {
 	// https://rosettacode.org/wiki/Strip_control_codes_and_extended_characters_from_a_string#Go
 	b := make([]byte, len(str))
@@ -55,44 +43,48 @@ func stripCtlAndExtFromBytes(str string) string {
 	return string(b[:bl])
 }
 
-func randomHex(n int) (string, error) {
-	// https://sosedoff.com/2014/12/15/generate-random-hex-string-in-go.html
-	randbytes := make([]byte, n)
-	if _, err := rand.Read(randbytes); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(randbytes), nil
-}
-
 func easyCmd(args ...string) error {
 	log.Debugf("EXEC: " + strings.Join(args, " "))
-	cmd := exec.Command(args[0], args[1:]...)
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	log.Debugf("STDOUT: %s", stdout.String())
-	log.Debugf("STDERR: %s", stderr.String())
+	stdout, stderr, err := runner.run(args[0], args[1:]...)
+	log.Debugf("STDOUT: %s", stdout)
+	log.Debugf("STDERR: %s", stderr)
 	return err
 }
 
+// installAsRoot replaces a file belonging to root by writing a copy and installing it over the original
+func installAsRoot(filename string, content string, mode string) error {
+	tmpfile, err := ioutil.TempFile("", filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.WriteString(content); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	args, err := rootCommand("install", "-m", mode, tmpfile.Name(), filename)
+	if err != nil {
+		return err
+	}
+	return easyCmd(args...)
+}
+
 func findNMDMDev() (string, error) {
 	lastnmdm := 0
 
 	for {
 		nmdmdev := "/dev/nmdm" + strconv.Itoa(lastnmdm)
 		log.Debugf("checking nmdm: %s", nmdmdev+"A")
-		cmd := exec.Command("sudo", "fuser", nmdmdev+"A")
-		var stdout bytes.Buffer
-		var stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
+		stdout, err := privilegedOutput("nmdm-users", nmdmdev+"A")
 		if err != nil {
 			return "", err
 		}
-		out := stdout.String()
+		out := string(stdout)
 		// Check if fuser reported anything
 		log.Debugf("status: %s", out)
 		words := strings.Fields(out)
@@ -152,27 +144,21 @@ func copyFile(src, dst string) (int64, error) {
 	return nBytes, nil
 }
 
-func ensureIPForwardingEnabled() error {
-	log.Debugf("Checking IP forwarding")
-	cmd := exec.Command("sysctl", "-n", "net.inet.ip.forwarding")
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
+func ensureSysctlEnabled(name string) error {
+	log.Debugf("Checking %s", name)
+	stdout, err := runner.output("sysctl", "-n", name)
 	if err != nil {
 		return err
 	}
 
-	isenabled, err := strconv.Atoi(strings.Trim(stdout.String(), "\n"))
+	isenabled, err := strconv.Atoi(strings.Trim(string(stdout), "\n"))
 	if err != nil {
 		return err
 	}
 
 	if isenabled == 0 {
-		log.Debugf("IP forwarding not enabled, enabling")
-		err = easyCmd("sudo", "sysctl", "net.inet.ip.forwarding=1")
+		log.Debugf("%s not enabled, enabling", name)
+		err = privileged("sysctl-enable", name)
 		if err != nil {
 			return err
 		}
@@ -180,24 +166,35 @@ func ensureIPForwardingEnabled() error {
 	return nil
 }
 
+func ensureIPForwardingEnabled() error {
+	return ensureSysctlEnabled("net.inet.ip.forwarding")
+}
+
+// ng_nat only does IPv4, so IPv6 is routed rather than NATed
+func ensureIP6ForwardingEnabled() error {
+	return ensureSysctlEnabled("net.inet6.ip6.forwarding")
+}
+
 func destroyTap(netdev string) error {
-	return easyCmd("sudo", "ifconfig", netdev, "destroy")
+	return privileged("destroy-tap", netdev)
 }
 
 func destroyVM(vmname string) error {
-	tries := 0
-	for ; tries < retrycount; tries++ {
-		if fileExists("/dev/vmm/" + vmname) {
-			_ = easyCmd("sudo", "bhyvectl", "--destroy", "--vm="+vmname)
-			time.Sleep(sleeptime * time.Millisecond)
-		}
+	if !fileExists("/dev/vmm/" + vmname) {
+		return nil
 	}
 
-	if tries > retrycount {
+	_ = privileged("destroy-vm", vmname)
+	return runner.do("wait for "+vmname+" to be destroyed", func() error {
+		for tries := 0; tries < retrycount; tries++ {
+			time.Sleep(sleeptime * time.Millisecond)
+			if !fileExists("/dev/vmm/" + vmname) {
+				return nil
+			}
+			_ = privileged("destroy-vm", vmname)
+		}
 		return fmt.Errorf("failed to kill %s", vmname)
-	}
-
-	return nil
+	})
 }
 
 func killConsoleLogger(pidfile string) error {
@@ -217,11 +214,9 @@ func killConsoleLogger(pidfile string) error {
 		return err
 	}
 
-	if err := process.Signal(syscall.SIGKILL); err != nil {
-		return err
-	}
-
-	return nil
+	return runner.do("kill the console logger", func() error {
+		return process.Signal(syscall.SIGKILL)
+	})
 }
 
 func writeDeviceMap(devmap string, cdpath string, diskname string) error {
@@ -251,35 +246,17 @@ func writeDeviceMap(devmap string, cdpath string, diskname string) error {
 	return nil
 }
 
+// bootGrub loads boot2docker's kernel with grub-bhyve, it runs as root in the helper
+func bootGrub(devmap string, memsize string, vmname string) ([]byte, error) {
+	return runner.runInput("linux (cd0)/boot/vmlinuz waitusb=5:LABEL=boot2docker-data base norestore noembed\n"+
+		"initrd (cd0)/boot/initrd.img\n"+
+		"boot\n",
+		"env", "-i", "TERM=xterm", "/usr/local/sbin/grub-bhyve", "-m", devmap, "-r", "cd0", "-M", memsize+"M", vmname)
+}
+
 func runGrub(devmap string, memsize string, vmname string) error {
 	for maxtries := 0; maxtries < retrycount; maxtries++ {
-		cmd := exec.Command("sudo", "env", "-i", "TERM=xterm", "/usr/local/sbin/grub-bhyve",
-			"-m", devmap, "-r", "cd0", "-M", memsize+"M", vmname)
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			return err
-		}
-
-		go func() {
-			_, err = io.WriteString(stdin, "linux (cd0)/boot/vmlinuz waitusb=5:LABEL=boot2docker-data base norestore noembed\n")
-			if err != nil {
-				return
-			}
-			_, err = io.WriteString(stdin, "initrd (cd0)/boot/initrd.img\n")
-			if err != nil {
-				return
-			}
-			_, err = io.WriteString(stdin, "boot\n")
-			if err != nil {
-				return
-			}
-			err = stdin.Close()
-			if err != nil {
-				return
-			}
-		}()
-
-		out, err := cmd.CombinedOutput()
+		out, _ := privilegedOutput("grub", devmap, memsize, vmname)
 		log.Debugf("grub-bhyve: " + stripCtlAndExtFromBytes(string(out)))
 		if strings.Contains(string(out), "GNU GRUB") {
 			log.Debugf("grub-bhyve: looks OK")
@@ -291,56 +268,68 @@ func runGrub(devmap string, memsize string, vmname string) error {
 	return nil
 }
 
-func writeDHCPConf(dhcpconffile string, bridge string, dhcprange string) error {
-	log.Debugf("Writing DHCP server config")
+func parseDHCPRange(dhcprange string) (net.IP, net.IP, error) {
+	fields := strings.Split(dhcprange, ",")
+	if len(fields) < 2 {
+		return nil, nil, fmt.Errorf("invalid DHCP range %s", dhcprange)
+	}
 
-	f, err := os.OpenFile(dhcpconffile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+	start := net.ParseIP(strings.TrimSpace(fields[0]))
+	end := net.ParseIP(strings.TrimSpace(fields[1]))
+	if start == nil || end == nil {
+		return nil, nil, fmt.Errorf("invalid DHCP range %s", dhcprange)
 	}
 
-	_, err = f.WriteString("port=0\ndomain-needed\nno-resolv\nexcept-interface=lo0\nbind-interfaces\nlocal-service\ndhcp-authoritative\n\n")
-	if err != nil {
-		return err
+	return start, end, nil
+}
+
+func ipInRange(ip net.IP, start net.IP, end net.IP) bool {
+	ip16 := ip.To16()
+	return bytes.Compare(ip16, start.To16()) >= 0 && bytes.Compare(ip16, end.To16()) <= 0
+}
+
+func validateStaticIP(staticip string, subnet string, dhcprange string) error {
+	ip := net.ParseIP(staticip)
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid IP address %s", staticip)
 	}
 
-	_, err = f.WriteString("interface=" + bridge + "\n")
+	bridgeip, oursubnet, err := net.ParseCIDR(subnet)
 	if err != nil {
 		return err
 	}
 
-	_, err = f.WriteString("dhcp-range=" + dhcprange + "\n")
+	if !oursubnet.Contains(ip) {
+		return fmt.Errorf("IP address %s is not in subnet %s", staticip, subnet)
+	}
+
+	if ip.Equal(bridgeip) {
+		return fmt.Errorf("IP address %s is used by the bridge", staticip)
+	}
+
+	start, end, err := parseDHCPRange(dhcprange)
 	if err != nil {
 		return err
 	}
 
+	if !ipInRange(ip, start, end) {
+		return fmt.Errorf("IP address %s is not in DHCP range %s", staticip, dhcprange)
+	}
+
 	return nil
 }
 
-func startDHCPServer(dhcpdir string, bridge string, dhcprange string) error {
-	log.Debugf("Starting DHCP Server")
-
-	dhcppidfile := filepath.Join(dhcpdir, "dnsmasq.pid")
-	dhcpconffile := filepath.Join(dhcpdir, "dnsmasq.conf")
-	dhcpleasefile := filepath.Join(dhcpdir, "bhyve.leases")
-
-	if !fileExists(dhcpconffile) {
-		err := writeDHCPConf(dhcpconffile, bridge, dhcprange)
-		if err != nil {
-			return err
-		}
-	}
-	// dnsmasq may leave it's PID file if killed?
-	if !fileExists(dhcppidfile) {
-		err := easyCmd("sudo", "dnsmasq", "-i", bridge, "-C", dhcpconffile, "-x", dhcppidfile, "-l", dhcpleasefile)
-		if err != nil {
-			return err
-		}
+// findtapdev creates a tap on the bridge
+func findtapdev(bridge string) (string, error) {
+	out, err := privilegedOutput("create-tap", bridge)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return strings.TrimSpace(string(out)), nil
 }
 
-func findtapdev(bridge string) (string, error) {
+// createTap creates the next free tap and adds it to the bridge, it runs as root in the helper
+func createTap(bridge string) (string, error) {
 	lasttap := 0
 	numtaps := 0
 	nexttap := 0
@@ -368,17 +357,17 @@ func findtapdev(bridge string) (string, error) {
 	log.Debugf("nexttap: %d", nexttap)
 
 	nexttapname := "tap" + strconv.Itoa(nexttap)
-	err := easyCmd("sudo", "ifconfig", nexttapname, "create")
+	err := easyCmd("ifconfig", nexttapname, "create")
 	if err != nil {
 		return "", err
 	}
 
-	err = easyCmd("sudo", "ifconfig", bridge, "addm", nexttapname)
+	err = easyCmd("ifconfig", bridge, "addm", nexttapname)
 	if err != nil {
 		return "", err
 	}
 
-	err = easyCmd("sudo", "ifconfig", nexttapname, "up")
+	err = easyCmd("ifconfig", nexttapname, "up")
 	if err != nil {
 		return "", err
 	}
@@ -386,32 +375,9 @@ func findtapdev(bridge string) (string, error) {
 	return nexttapname, nil
 }
 
-func getIPfromDHCPLease(dhcpleasefile string, macaddress string) (string, error) {
-	file, err := os.Open(dhcpleasefile)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	if err := scanner.Err(); err != nil {
-		return "", err
-	}
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, macaddress) {
-			log.Debugf("Found our MAC")
-			words := strings.Fields(line)
-			ip := words[2]
-			log.Debugf("IP is: " + ip)
-			return ip, nil
-		}
-	}
-
-	return "", errors.New("IP Not Found")
-}
-
-func setupnet(bridge string, subnet string) error {
+// setupnet creates the host-only interface with the subnet address and NATs it through
+// the uplink. The interface is a bridge, or a VALE host port if valeswitch is set.
+func setupnet(bridge string, subnet string, valeswitch string) error {
 	localhost := "127.0.0.0/8"
 	_, localhostsubnet, _ := net.ParseCIDR(localhost)
 
@@ -457,39 +423,44 @@ func setupnet(bridge string, subnet string) error {
 
 	log.Debugf("Setting up %s on %s, aliased to %s on %s", subnet, bridge, useip, useiface.Name)
 
-	err := easyCmd("sudo", "ifconfig", bridge, "create")
+	var err error
+	if valeswitch != "" {
+		err = createValeHostPort(valeswitch, bridge)
+	} else {
+		err = easyCmd("ifconfig", bridge, "create")
+	}
 	if err != nil {
 		return err
 	}
-	err = easyCmd("sudo", "ifconfig", bridge, subnet)
+	err = easyCmd("ifconfig", bridge, subnet)
 	if err != nil {
 		return err
 	}
-	err = easyCmd("sudo", "ifconfig", bridge, "up")
+	err = easyCmd("ifconfig", bridge, "up")
 	if err != nil {
 		return err
 	}
 
-	err = easyCmd("sudo", "ngctl", "mkpeer", useiface.Name+":", "nat", "lower", "in")
+	err = easyCmd("ngctl", "mkpeer", useiface.Name+":", "nat", "lower", "in")
 	if err != nil {
 		return err
 	}
 
-	err = easyCmd("sudo", "ngctl", "name", useiface.Name+":lower", useiface.Name+"_NAT")
+	err = easyCmd("ngctl", "name", useiface.Name+":lower", useiface.Name+"_NAT")
 	if err != nil {
 		return err
 	}
-	err = easyCmd("sudo", "ngctl", "connect", useiface.Name+":", useiface.Name+"_NAT:", "upper", "out")
+	err = easyCmd("ngctl", "connect", useiface.Name+":", useiface.Name+"_NAT:", "upper", "out")
 	if err != nil {
 		return err
 	}
 
-	err = easyCmd("sudo", "ngctl", "msg", useiface.Name+"_NAT:", "setdlt", "1")
+	err = easyCmd("ngctl", "msg", useiface.Name+"_NAT:", "setdlt", "1")
 	if err != nil {
 		return err
 	}
 
-	err = easyCmd("sudo", "ngctl", "msg", useiface.Name+"_NAT:", "setaliasaddr", useip.String())
+	err = easyCmd("ngctl", "msg", useiface.Name+"_NAT:", "setaliasaddr", useip.String())
 	if err != nil {
 		return err
 	}
@@ -498,77 +469,67 @@ func setupnet(bridge string, subnet string) error {
 	return nil
 }
 
-func startConsoleLogger(storepath string, nmdmdev string) error {
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-
-	if err != nil {
-		return err
+// ensureBridge creates a bridge without any addresses for additional NICs
+func ensureBridge(bridge string) error {
+	if _, err := net.InterfaceByName(bridge); err == nil {
+		log.Debugf("Interface %s exists", bridge)
+		return nil
 	}
 
-	err = easyCmd("/usr/sbin/daemon", "-f", "-p",
-		filepath.Join(storepath, "nmdm.pid"), dir+"/docker-machine-driver-bhyve-nmdm", nmdmdev+"B",
-		filepath.Join(storepath, "console.log"))
+	log.Debugf("Creating bridge %s", bridge)
+	err := easyCmd("ifconfig", bridge, "create")
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return easyCmd("ifconfig", bridge, "up")
 }
 
-func checkRequiredCommand(commandname string) error {
-	_, err := exec.LookPath(commandname)
+// setupnet6 adds the IPv6 prefix to the bridge, which setupnet may have created earlier
+func setupnet6(bridge string, subnet6 string) error {
+	bridgeip, _, err := net.ParseCIDR(subnet6)
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func checkRequiredCommands() error {
-	if err := checkRequiredCommand("sudo"); err != nil {
-		return errors.New("sudo not installed")
-	}
-	if err := checkRequiredCommand("/usr/local/sbin/grub-bhyve"); err != nil {
-		return errors.New("/usr/local/sbin/grub-bhyve not found")
-	}
-	if err := checkRequiredCommand("/usr/local/sbin/dnsmasq"); err != nil {
-		return errors.New("/usr/local/sbin/dnsmasq not found")
+	iface, err := net.InterfaceByName(bridge)
+	if err != nil {
+		return err
 	}
-	return nil
-}
 
-func kmodLoaded(kmod string) error {
-	cmd := exec.Command("kldstat", "-m", kmod)
-	err := cmd.Start()
+	addrs, err := iface.Addrs()
 	if err != nil {
 		return err
 	}
-	if err := cmd.Wait(); err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			if _, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				return errors.New("required kmod " + kmod + " not loaded")
-			}
-		} else {
-			return err
+	for _, addr := range addrs {
+		ipAddr, _, err := net.ParseCIDR(addr.String())
+		if err == nil && ipAddr.Equal(bridgeip) {
+			log.Debugf("Interface %s already has address %s", bridge, bridgeip)
+			return nil
 		}
 	}
-	log.Debugf("kmod %s is loaded", kmod)
 
-	return err
-}
+	log.Debugf("Setting up %s on %s", subnet6, bridge)
 
-func checkRequireKmods() error {
-	log.Debugf("Checking kmods")
-	err := kmodLoaded("vmm")
+	// bridges come up with IPv6 disabled
+	err = easyCmd("ifconfig", bridge, "inet6", "-ifdisabled")
 	if err != nil {
 		return err
 	}
 
-	err = kmodLoaded("nmdm")
+	return easyCmd("ifconfig", bridge, "inet6", subnet6, "alias")
+}
+
+func startConsoleLogger(storepath string, nmdmdev string) error {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+
 	if err != nil {
 		return err
 	}
 
-	err = kmodLoaded("ng_ether")
+	err = easyCmd("/usr/sbin/daemon", "-f", "-p",
+		filepath.Join(storepath, "nmdm.pid"), dir+"/docker-machine-driver-bhyve-nmdm", nmdmdev+"B",
+		filepath.Join(storepath, "console.log"))
 	if err != nil {
 		return err
 	}
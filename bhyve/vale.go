@@ -0,0 +1,87 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	networkBackendBridge = "bridge"
+	networkBackendVale   = "vale"
+	defaultValeSwitch    = "vale0"
+)
+
+func validateValeSwitch(switchname string) error {
+	if !strings.HasPrefix(switchname, "vale") || switchname == "vale" || strings.Contains(switchname, ":") {
+		return fmt.Errorf("invalid VALE switch name %s, it must look like vale0", switchname)
+	}
+	return nil
+}
+
+// valeName replaces the characters netmap doesn't allow in switch and port names
+func valeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// valeHostPort returns the name of the persistent port giving the host a leg on the
+// switch. It must not start with "vale" or netmap would take it for a switch.
+func valeHostPort(switchname string) string {
+	return "vh" + strings.TrimPrefix(switchname, "vale")
+}
+
+// valePort returns the ephemeral switch port bhyve attaches the machine to, it goes
+// away when bhyve exits
+func valePort(switchname string, machinename string) string {
+	return switchname + ":" + valeName(machinename)
+}
+
+// createValeHostPort creates hostport as a host interface and attaches it to the switch,
+// after which it can be configured like a bridge
+func createValeHostPort(switchname string, hostport string) error {
+	log.Debugf("Attaching %s to VALE switch %s", hostport, switchname)
+
+	err := easyCmd("valectl", "-n", hostport)
+	if err != nil {
+		return err
+	}
+
+	return easyCmd("valectl", "-a", switchname+":"+hostport)
+}
+
+func destroyValeHostPort(switchname string, hostport string) error {
+	log.Debugf("Detaching %s from VALE switch %s", hostport, switchname)
+
+	err := easyCmd("valectl", "-d", switchname+":"+hostport)
+	if err != nil {
+		return err
+	}
+
+	return easyCmd("valectl", "-r", hostport)
+}
+
+// valeSwitchInUse reports whether a machine other than machinename is attached to the switch
+func valeSwitchInUse(storepath string, machinename string, switchname string) (bool, error) {
+	machines, err := storedMachines(storepath, machinename)
+	if err != nil {
+		return false, err
+	}
+
+	for _, m := range machines {
+		if m.Driver.NetworkBackend == networkBackendVale && m.Driver.ValeSwitch == switchname {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValeHostPort(t *testing.T) {
+	if got := valeHostPort("vale0"); got != "vh0" {
+		t.Errorf("valeHostPort() = %s", got)
+	}
+	if got := valePort("vale0", "my-machine.1"); got != "vale0:my_machine_1" {
+		t.Errorf("valePort() = %s", got)
+	}
+	for _, name := range []string{"vale", "bridge0", "vale0:port"} {
+		if validateValeSwitch(name) == nil {
+			t.Errorf("%s accepted as a VALE switch", name)
+		}
+	}
+}
+
+func TestValeSwitchInUse(t *testing.T) {
+	storepath, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storepath)
+
+	writeStoredMachine(t, storepath, "bridged", `{"Bridge": "bridge0"}`)
+	writeStoredMachine(t, storepath, "switched", `{"NetworkBackend": "vale", "ValeSwitch": "vale0"}`)
+
+	if inuse, err := valeSwitchInUse(storepath, "new", "vale0"); err != nil || !inuse {
+		t.Errorf("vale0 in use = %t, %v", inuse, err)
+	}
+	if inuse, err := valeSwitchInUse(storepath, "switched", "vale0"); err != nil || inuse {
+		t.Errorf("vale0 in use by another machine = %t, %v", inuse, err)
+	}
+}
+
+// TestValeDHCPServer checks a VALE machine starts its own dnsmasq on the switch's host
+// port, rather than moving the bridge's one
+func TestValeDHCPServer(t *testing.T) {
+	storepath, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storepath)
+	defer withProcesses(fakeProcesses{100: "dnsmasq"})()
+	defer withRunDir(t)()
+
+	bridged := NewDriver("bridged", storepath)
+	if err := os.MkdirAll(dhcpRunDir(bridged.dhcpDir()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dhcpRunDir(bridged.dhcpDir()), dhcpPidFilename), []byte("100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeStoredMachine(t, storepath, "bridged", `{"Bridge": "bridge0"}`)
+
+	switched := NewDriver("switched", storepath)
+	switched.NetworkBackend = networkBackendVale
+	switched.Subnet = "10.0.0.1/24"
+	switched.DHCPRange = "10.0.0.100,10.0.0.200"
+
+	rec := &recordingRunner{}
+	defer withRunner(rec)()
+	err = startDHCPServer(storepath, switched.dhcpDir(), switched.hostInterface(), switched.DHCPRange, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := strings.Join(rec.recorded, "\n")
+	if !strings.Contains(recorded, "# write "+filepath.Join(storepath, dhcpDirname, "vh0", dhcpConfFilename)) {
+		t.Errorf("didn't write the VALE network's config:\n%s", recorded)
+	}
+	if !strings.Contains(recorded, "start-dhcp "+filepath.Join(storepath, dhcpDirname, "vh0")+" vh0") {
+		t.Errorf("didn't start dnsmasq on vh0:\n%s", recorded)
+	}
+	if strings.Contains(recorded, bridged.dhcpDir()) || strings.Contains(recorded, "bridge0") {
+		t.Errorf("touched the bridge's DHCP server:\n%s", recorded)
+	}
+
+	// removing the VALE machine leaves the bridge's dnsmasq running
+	rec.recorded = nil
+	if err := switched.stopDHCPServerIfUnused(); err != nil {
+		t.Fatal(err)
+	}
+	if recorded := strings.Join(rec.recorded, "\n"); strings.Contains(recorded, "signal-dhcp bridge0") {
+		t.Errorf("stopped the bridge's DHCP server:\n%s", recorded)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const vmConfigFilename = "vm.json"
+
+// vmNIC is a network device, Backend is a tap or a VALE port
+type vmNIC struct {
+	Model   string
+	Backend string
+	MAC     string
+}
+
+// vmConfig is everything the helper needs to start bhyve, it builds the command line
+// itself so only validated devices are given to bhyve
+type vmConfig struct {
+	Name     string
+	CPUs     int
+	MemoryMB int
+	Disk     string
+	CD       string
+	UEFI     bool
+	Console  string
+	NICs     []vmNIC
+	Shares   []Share
+}
+
+func writeVMConfig(filename string, config vmConfig) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+func (c vmConfig) validate() error {
+	if !vmNameRegex.MatchString(c.Name) {
+		return fmt.Errorf("invalid VM name %s", c.Name)
+	}
+	if c.CPUs < 1 || c.CPUs > 256 {
+		return fmt.Errorf("invalid CPU count %d", c.CPUs)
+	}
+	if c.MemoryMB < 1 {
+		return fmt.Errorf("invalid memory size %d", c.MemoryMB)
+	}
+	if !nmdmRegex.MatchString(c.Console) {
+		return fmt.Errorf("%s is not an nmdm device", c.Console)
+	}
+	if len(c.NICs) == 0 {
+		return fmt.Errorf("no network interfaces")
+	}
+	if len(c.NICs)-1+len(c.Shares) > maxSlot-firstExtraSlot+1 {
+		return fmt.Errorf("too many devices")
+	}
+	for _, nic := range c.NICs {
+		if nic.Model != "virtio-net" && nic.Model != "e1000" {
+			return fmt.Errorf("invalid NIC model %s", nic.Model)
+		}
+		if !tapRegex.MatchString(nic.Backend) && !valePortRegex.MatchString(nic.Backend) {
+			return fmt.Errorf("invalid NIC backend %s", nic.Backend)
+		}
+		if !macRegex.MatchString(nic.MAC) {
+			return fmt.Errorf("invalid MAC address %s", nic.MAC)
+		}
+	}
+	for _, share := range c.Shares {
+		if !shareTagRegex.MatchString(share.Tag) {
+			return fmt.Errorf("invalid share tag %s", share.Tag)
+		}
+	}
+	return nil
+}
+
+// checkNICs checks each NIC is on a tap or VALE switch belonging to the user. A VALE
+// switch nobody has claimed yet is claimed for the user.
+func (c vmConfig) checkNICs(u helperUser) error {
+	for _, nic := range c.NICs {
+		if tapRegex.MatchString(nic.Backend) {
+			if err := u.checkClaim(claimTap, nic.Backend); err != nil {
+				return err
+			}
+			continue
+		}
+
+		valeswitch := strings.SplitN(nic.Backend, ":", 2)[0]
+		if err := u.claim(claimVale, valeswitch, claimed(claimVale, valeswitch)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openFiles opens the disk, CD and shares, which bhyve uses as root, checking they
+// belong to the user. The config is changed to give them to bhyve by /dev/fd path, so
+// they can't be swapped for something else before bhyve opens them.
+func (c *vmConfig) openFiles(u helperUser) ([]*os.File, error) {
+	var files []*os.File
+	open := func(path *string, flag int, dir bool) error {
+		f, err := u.open(*path, flag, dir)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		*path, err = fdPath(f)
+		return err
+	}
+
+	err := open(&c.Disk, os.O_RDWR, false)
+	if err == nil {
+		err = open(&c.CD, os.O_RDONLY, false)
+	}
+	for i := range c.Shares {
+		if err == nil {
+			err = open(&c.Shares[i].HostPath, os.O_RDONLY|syscall.O_DIRECTORY, true)
+		}
+	}
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+// bhyveArgs returns the bhyve command line for the VM
+func (c vmConfig) bhyveArgs() []string {
+	primary := c.NICs[0]
+	args := []string{"-A", "-H", "-P",
+		"-s", "0:0,hostbridge",
+		"-s", "1:0,lpc",
+		"-s", "2:0," + primary.Model + "," + primary.Backend + ",mac=" + primary.MAC,
+		"-s", "3:0,virtio-blk," + c.Disk,
+		"-s", "4:0,virtio-rnd,/dev/random",
+		"-s", "5:0,ahci-cd," + c.CD}
+	slot := firstExtraSlot
+	for _, nic := range c.NICs[1:] {
+		args = append(args, "-s", strconv.Itoa(slot)+":0,"+nic.Model+","+nic.Backend+",mac="+nic.MAC)
+		slot++
+	}
+	for _, share := range c.Shares {
+		args = append(args, "-s", strconv.Itoa(slot)+":0,"+share.bhyveDevice())
+		slot++
+	}
+	if c.UEFI {
+		args = append(args, "-l", "bootrom,"+defaultFirmware)
+	}
+	return append(args, "-l", "com1,"+c.Console, "-c", strconv.Itoa(c.CPUs), "-m", strconv.Itoa(c.MemoryMB)+"M", c.Name)
+}
@@ -9,20 +9,46 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/docker/machine/libmachine/log"
-	"github.com/docker/machine/libmachine/mcnutils"
 	"github.com/docker/machine/libmachine/ssh"
 	"gitlab.mouf.net/swills/docker-machine-driver-bhyve/b2d"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
 
-func updateISOCache(storepath string, isoURL string) error {
+// isoOptions selects which boot2docker ISO a machine gets
+type isoOptions struct {
+	// url is a direct download or GitHub release URL, bypassing the cache
+	url string
+	// indexURL is an image index to get releases from instead of GitHub
+	indexURL string
+	// sha256 is the checksum the ISO must have
+	sha256 string
+	// version pins a cached version
+	version string
+	// offline avoids any HTTP requests
+	offline bool
+	// skipChecksum allows ISOs without a known checksum
+	skipChecksum bool
+	// timeout limits downloads, zero means no limit
+	timeout time.Duration
+}
+
+func newB2dUtils(storepath string, opts isoOptions) *b2d.B2dUtils {
 	b2dinstance := b2d.NewB2dUtils(storepath)
-	mcnutilsinstance := mcnutils.NewB2dUtils(storepath)
+	if opts.indexURL != "" {
+		b2dinstance = b2d.NewB2dUtilsFromIndex(storepath, opts.indexURL)
+	}
+	b2dinstance.FetchTimeout = opts.timeout
+	return b2dinstance
+}
+
+func updateISOCache(storepath string, opts isoOptions) error {
+	b2dinstance := newB2dUtils(storepath, opts)
 
 	// recreate the cache dir if it has been manually deleted
 	if _, err := os.Stat(b2dinstance.ImgCachePath); os.IsNotExist(err) {
@@ -43,42 +69,178 @@ func updateISOCache(storepath string, isoURL string) error {
 		}
 	}
 
-	if isoURL != "" {
+	if opts.url != "" {
 		// Non-default B2D are not cached
 		log.Debugf("Not caching non-default B2D URL	")
 		return nil
 	}
 
 	exists := b2dinstance.Exists()
+
+	if opts.version != "" {
+		// a pinned version is only downloaded from an image index, GitHub ones have to be cached
+		if _, err := os.Stat(b2dinstance.VersionedISOPath(opts.version)); err == nil {
+			return nil
+		}
+		// caches from before versions were kept only have the default ISO
+		if exists {
+			cachedVersion, err := b2dinstance.Version()
+			if err != nil {
+				return err
+			}
+			if cachedVersion == opts.version {
+				_, err = b2dinstance.StoreVersion()
+				return err
+			}
+		}
+		// an image index lists every version, so they can be downloaded
+		if opts.indexURL != "" && !opts.offline {
+			log.Infof("Boot2Docker %s is not cached, downloading it from %s...", opts.version, opts.indexURL)
+			return downloadVersionISO(b2dinstance, opts.version, opts.skipChecksum)
+		}
+		return fmt.Errorf("boot2docker %s is not cached in %s", opts.version, b2dinstance.ImgCachePath)
+	}
+
+	if opts.offline {
+		if !exists {
+			return fmt.Errorf("offline mode needs a boot2docker ISO in %s", b2dinstance.ImgCachePath)
+		}
+		log.Debugf("Offline, using cached Boot2Docker ISO without checking for updates")
+		return nil
+	}
+
 	if !exists {
 		log.Info("No default Boot2Docker ISO found locally, downloading the latest release...")
-		return mcnutilsinstance.DownloadLatestBoot2Docker("")
+		return downloadLatestISO(b2dinstance, opts.skipChecksum)
 	}
 
 	latest := b2dinstance.IsLatest()
 	if !latest {
 		log.Info("Default Boot2Docker ISO is out-of-date, downloading the latest release...")
-		return mcnutilsinstance.DownloadLatestBoot2Docker("")
+		return downloadLatestISO(b2dinstance, opts.skipChecksum)
 	}
 
 	return nil
 }
 
-func copyIsoToMachineDir(storepath string, isoURL, machineName string) error {
-	b2dinst := b2d.NewB2dUtils(storepath)
-	mcnutilsinstance := mcnutils.NewB2dUtils(storepath)
+// downloadLatestISO downloads the latest release into the cache, verifies it against the
+// release's published checksum and records the checksum to verify later copies against.
+// A release without a checksum is refused unless skipChecksum is set.
+func downloadLatestISO(b2dinstance *b2d.B2dUtils, skipChecksum bool) error {
+	downloadURL, err := b2dinstance.GetReleaseURL("")
+	if err != nil {
+		return err
+	}
+
+	sum, err := b2dinstance.GetChecksum(downloadURL)
+	if err == b2d.ErrNoChecksum && skipChecksum {
+		log.Warnf("No checksum published for %s, it can't be verified", downloadURL)
+	} else if err == b2d.ErrNoChecksum {
+		return fmt.Errorf("no checksum published for %s, use --bhyve-skip-checksum to use it unverified", downloadURL)
+	} else if err != nil {
+		return err
+	}
+
+	if err := b2dinstance.DownloadISO(b2dinstance.ImgCachePath, b2dinstance.Filename(), downloadURL); err != nil {
+		return err
+	}
+
+	isoPath := filepath.Join(b2dinstance.ImgCachePath, b2dinstance.Filename())
+	if sum, err = verifyDownload(isoPath, sum); err != nil {
+		return err
+	}
+
+	if err := b2d.WriteChecksum(isoPath, sum); err != nil {
+		return err
+	}
+
+	_, err = b2dinstance.StoreVersion()
+	return err
+}
+
+// downloadVersionISO downloads a release version into the cache, verified like
+// downloadLatestISO
+func downloadVersionISO(b2dinstance *b2d.B2dUtils, version string, skipChecksum bool) error {
+	downloadURL, err := b2dinstance.GetVersionURL(version)
+	if err == b2d.ErrUnknownVersion {
+		return fmt.Errorf("boot2docker %s is not in the image index", version)
+	}
+	if err != nil {
+		return err
+	}
+
+	sum, err := b2dinstance.GetChecksum(downloadURL)
+	if err == b2d.ErrNoChecksum && skipChecksum {
+		log.Warnf("No checksum published for %s, it can't be verified", downloadURL)
+	} else if err == b2d.ErrNoChecksum {
+		return fmt.Errorf("no checksum published for %s, use --bhyve-skip-checksum to use it unverified", downloadURL)
+	} else if err != nil {
+		return err
+	}
+
+	isoPath := b2dinstance.VersionedISOPath(version)
+	if err := b2dinstance.DownloadISO(filepath.Dir(isoPath), filepath.Base(isoPath), downloadURL); err != nil {
+		return err
+	}
 
-	if err := updateISOCache(storepath, isoURL); err != nil {
+	if sum, err = verifyDownload(isoPath, sum); err != nil {
 		return err
 	}
 
+	return b2d.WriteChecksum(isoPath, sum)
+}
+
+// verifyDownload checks a downloaded ISO against expected, removing it if it doesn't match,
+// and returns its checksum. With no expected checksum, the ISO's own is returned.
+func verifyDownload(isoPath string, expected string) (string, error) {
+	if expected == "" {
+		return b2d.SHA256File(isoPath)
+	}
+
+	if err := b2d.VerifySHA256(isoPath, expected); err != nil {
+		if rmerr := os.Remove(isoPath); rmerr != nil {
+			log.Warnf("Failed to remove %s: %s", isoPath, rmerr)
+		}
+		return "", err
+	}
+
+	return expected, nil
+}
+
+// cachedISOChecksum verifies the cached ISO against its recorded checksum and returns it
+func cachedISOChecksum(isoPath string) (string, error) {
+	sum, err := b2d.ReadChecksum(isoPath)
+	if err == b2d.ErrNoChecksum {
+		// cached before checksums were recorded, record it now so copies can be checked
+		log.Debugf("No checksum recorded for %s", isoPath)
+		if sum, err = b2d.SHA256File(isoPath); err != nil {
+			return "", err
+		}
+		return sum, b2d.WriteChecksum(isoPath, sum)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return sum, b2d.VerifySHA256(isoPath, sum)
+}
+
+// copyIsoToMachineDir puts the ISO in the machine's directory and returns its checksum,
+// which must match opts.sha256 if that is set
+func copyIsoToMachineDir(storepath string, opts isoOptions, machineName string) (string, error) {
+	b2dinst := newB2dUtils(storepath, opts)
+
+	if err := updateISOCache(storepath, opts); err != nil {
+		return "", err
+	}
+
 	isoPath := filepath.Join(b2dinst.ImgCachePath, isoFilename)
 	if isoStat, err := os.Stat(isoPath); err == nil {
 		if int(isoStat.Sys().(*syscall.Stat_t).Uid) == 0 {
 			log.Debugf("Fix %s file permission...", isoStat.Name())
 			err = os.Chown(isoPath, syscall.Getuid(), syscall.Getegid())
 			if err != nil {
-				return err
+				return "", err
 			}
 		}
 	}
@@ -88,23 +250,68 @@ func copyIsoToMachineDir(storepath string, isoURL, machineName string) error {
 
 	// By default just copy the existing "cached" iso to the machine's directory...
 	defaultISO := filepath.Join(b2dinst.ImgCachePath, defaultISOFilename)
-	if isoURL == "" {
-		log.Infof("Copying %s to %s...", defaultISO, machineIsoPath)
-		_, err := copyFile(defaultISO, machineIsoPath)
-		return err
+	if opts.url == "" {
+		version := opts.version
+		sourceISO := b2dinst.VersionedISOPath(version)
+		if version == "" {
+			var err error
+			if version, err = b2dinst.StoreVersion(); err != nil {
+				return "", err
+			}
+			sourceISO = defaultISO
+		}
+
+		sum, err := cachedISOChecksum(sourceISO)
+		if err != nil {
+			return "", err
+		}
+		if opts.sha256 != "" && !strings.EqualFold(sum, opts.sha256) {
+			return "", fmt.Errorf("checksum mismatch for %s: expected %s, got %s", sourceISO, opts.sha256, sum)
+		}
+
+		log.Infof("Copying %s to %s...", sourceISO, machineIsoPath)
+		if _, err := copyFile(sourceISO, machineIsoPath); err != nil {
+			return "", err
+		}
+		if err := b2d.VerifySHA256(machineIsoPath, sum); err != nil {
+			return "", err
+		}
+
+		return sum, b2dinst.AddReference(version, machineName)
+	}
+
+	if opts.offline && !strings.HasPrefix(opts.url, "file://") {
+		return "", fmt.Errorf("offline mode can't download %s, use a file:// URL", opts.url)
 	}
 
 	// if ISO is specified, check if it matches a github releases url or fallback to a direct download
-	downloadURL, err := b2dinst.GetReleaseURL(isoURL)
+	downloadURL, err := b2dinst.GetReleaseURL(opts.url)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	expectedSum := opts.sha256
+	if expectedSum == "" {
+		expectedSum, err = b2dinst.GetChecksum(downloadURL)
+		if err == b2d.ErrNoChecksum && opts.skipChecksum {
+			log.Warnf("No checksum known for %s, use --bhyve-boot2docker-sha256 to verify it", downloadURL)
+		} else if err == b2d.ErrNoChecksum {
+			return "", fmt.Errorf("no checksum known for %s, give it with --bhyve-boot2docker-sha256 "+
+				"or use --bhyve-skip-checksum", downloadURL)
+		} else if err != nil {
+			return "", err
+		}
 	}
 
-	return mcnutilsinstance.DownloadISO(machineDir, b2dinst.Filename(), downloadURL)
+	if err := b2dinst.DownloadISO(machineDir, b2dinst.Filename(), downloadURL); err != nil {
+		return "", err
+	}
+
+	return verifyDownload(machineIsoPath, expectedSum)
 }
 
 // Make a boot2docker userdata.tar key bundle
-func generateKeyBundle(keypath string) (*bytes.Buffer, error) {
+func generateKeyBundle(keypath string, opts userdataOptions) (*bytes.Buffer, error) {
 	magicString := "boot2docker, please format-me"
 
 	log.Infof("Creating SSH key...")
@@ -116,34 +323,24 @@ func generateKeyBundle(keypath string) (*bytes.Buffer, error) {
 	tw := tar.NewWriter(buf)
 
 	// magicString first so the automount script knows to format the disk
-	file := &tar.Header{Name: magicString, Size: int64(len(magicString))}
-	if err := tw.WriteHeader(file); err != nil {
-		return nil, err
-	}
-	if _, err := tw.Write([]byte(magicString)); err != nil {
+	if err := addTarFile(tw, magicString, 0, []byte(magicString)); err != nil {
 		return nil, err
 	}
 	// .ssh/key.pub => authorized_keys
-	file = &tar.Header{Name: ".ssh", Typeflag: tar.TypeDir, Mode: 0700}
-	if err := tw.WriteHeader(file); err != nil {
+	if err := addTarDir(tw, ".ssh", 0700); err != nil {
 		return nil, err
 	}
 	pubKey, err := ioutil.ReadFile(keypath + ".pub")
 	if err != nil {
 		return nil, err
 	}
-	file = &tar.Header{Name: ".ssh/authorized_keys", Size: int64(len(pubKey)), Mode: 0644}
-	if err := tw.WriteHeader(file); err != nil {
-		return nil, err
-	}
-	if _, err := tw.Write([]byte(pubKey)); err != nil {
+	if err := addTarFile(tw, ".ssh/authorized_keys", 0644, pubKey); err != nil {
 		return nil, err
 	}
-	file = &tar.Header{Name: ".ssh/authorized_keys2", Size: int64(len(pubKey)), Mode: 0644}
-	if err := tw.WriteHeader(file); err != nil {
+	if err := addTarFile(tw, ".ssh/authorized_keys2", 0644, pubKey); err != nil {
 		return nil, err
 	}
-	if _, err := tw.Write([]byte(pubKey)); err != nil {
+	if err := addUserdataFiles(tw, opts); err != nil {
 		return nil, err
 	}
 	if err := tw.Close(); err != nil {
@@ -152,7 +349,7 @@ func generateKeyBundle(keypath string) (*bytes.Buffer, error) {
 	return buf, nil
 }
 
-func generateRawDiskImage(sshkeypath string, diskPath string, size int64) error {
+func generateRawDiskImage(sshkeypath string, diskPath string, size int64, opts userdataOptions) error {
 	f, err := os.OpenFile(diskPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
 	if err != nil {
 		if os.IsExist(err) {
@@ -166,7 +363,7 @@ func generateRawDiskImage(sshkeypath string, diskPath string, size int64) error
 		return err
 	}
 
-	tarBuf, err := generateKeyBundle(sshkeypath)
+	tarBuf, err := generateKeyBundle(sshkeypath, opts)
 	if err != nil {
 		return err
 	}
@@ -189,13 +386,13 @@ func generateRawDiskImage(sshkeypath string, diskPath string, size int64) error
 	return nil
 }
 
-func waitForIP(storepath string, macaddress string) (string, error) {
+func waitForIP(lookup func() (string, error)) (string, error) {
 	var ip string
 	var err error
 
 	log.Infof("Waiting for VM to come online...")
 	for i := 1; i <= 60; i++ {
-		ip, err = getIPfromDHCPLease(filepath.Join(storepath, "bhyve.leases"), macaddress)
+		ip, err = lookup()
 		if err != nil {
 			log.Debugf("Not there yet %d/%d, error: %s", i, 60, err)
 			time.Sleep(2 * time.Second)
@@ -0,0 +1,146 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testStore returns a docker-machine store with a directory for machine
+func testStore(t *testing.T, machine string) string {
+	storepath, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(storepath, "machines", machine), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return storepath
+}
+
+func TestCopyIsoToMachineDirChecksum(t *testing.T) {
+	iso := []byte("not really an ISO")
+	hash := sha256.Sum256(iso)
+	sum := hex.EncodeToString(hash[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(iso)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		opts    isoOptions
+		wantErr string
+	}{
+		{"no checksum", isoOptions{}, "no checksum known"},
+		{"given checksum", isoOptions{sha256: sum}, ""},
+		{"wrong checksum", isoOptions{sha256: strings.Repeat("0", 64)}, "checksum mismatch"},
+		{"skipped", isoOptions{skipChecksum: true}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storepath := testStore(t, "dev")
+			defer os.RemoveAll(storepath)
+
+			tt.opts.url = server.URL + "/custom/boot2docker.iso"
+			got, err := copyIsoToMachineDir(storepath, tt.opts, "dev")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("copyIsoToMachineDir() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != sum {
+				t.Errorf("copyIsoToMachineDir() = %s, %v, want %s", got, err, sum)
+			}
+		})
+	}
+}
+
+func TestUpdateISOCacheIndexVersion(t *testing.T) {
+	iso := []byte("not really an ISO")
+	hash := sha256.Sum256(iso)
+	sum := hex.EncodeToString(hash[:])
+
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.json":
+			_, _ = w.Write([]byte(`{"releases": [
+				{"version": "v19.03.5", "url": "v19.03.5/boot2docker.iso", "sha256": "` + sum + `"},
+				{"version": "v18.09.9", "url": "v18.09.9/boot2docker.iso", "sha256": "` + strings.Repeat("0", 64) + `"},
+				{"version": "v18.06.3", "url": "v18.06.3/boot2docker.iso"}
+			]}`))
+		case "/v19.03.5/boot2docker.iso", "/v18.09.9/boot2docker.iso", "/v18.06.3/boot2docker.iso":
+			downloads++
+			_, _ = w.Write(iso)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		opts    isoOptions
+		wantErr string
+	}{
+		{"listed", isoOptions{version: "v19.03.5"}, ""},
+		{"not listed", isoOptions{version: "v17.06.0"}, "not in the image index"},
+		{"wrong checksum", isoOptions{version: "v18.09.9"}, "checksum mismatch"},
+		{"no checksum", isoOptions{version: "v18.06.3"}, "no checksum published"},
+		{"no checksum skipped", isoOptions{version: "v18.06.3", skipChecksum: true}, ""},
+		{"offline", isoOptions{version: "v19.03.5", offline: true}, "is not cached"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storepath := testStore(t, "dev")
+			defer os.RemoveAll(storepath)
+
+			tt.opts.indexURL = server.URL + "/index.json"
+			err := updateISOCache(storepath, tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("updateISOCache() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the copy into the machine is checked against the recorded checksum
+			got, err := copyIsoToMachineDir(storepath, tt.opts, "dev")
+			if err != nil || got != sum {
+				t.Errorf("copyIsoToMachineDir() = %s, %v, want %s", got, err, sum)
+			}
+		})
+	}
+
+	// a cached version isn't downloaded again
+	storepath := testStore(t, "dev")
+	defer os.RemoveAll(storepath)
+	opts := isoOptions{indexURL: server.URL + "/index.json", version: "v19.03.5"}
+	downloads = 0
+	for i := 0; i < 2; i++ {
+		if err := updateISOCache(storepath, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("downloaded v19.03.5 %d times", downloads)
+	}
+}
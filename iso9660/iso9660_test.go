@@ -0,0 +1,255 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testFiles covers names that need mapping to ISO identifiers, clash once mapped, are
+// as long as Joliet allows and fill more than a sector of directory records
+func testFiles() map[string]File {
+	files := map[string]File{
+		"meta-data":                        {Data: []byte("instance-id: dev\n"), Mode: 0644},
+		"user-data":                        {Data: []byte("#cloud-config\n"), Mode: 0644},
+		"empty":                            {Data: []byte{}, Mode: 0644},
+		"install.sh":                       {Data: []byte("#!/bin/sh\n"), Mode: 0755},
+		"a-b.txt":                          {Data: []byte("dash"), Mode: 0644},
+		"a_b.txt":                          {Data: []byte("underscore"), Mode: 0644},
+		"A-B.txt":                          {Data: []byte("upper"), Mode: 0600},
+		"café.txt":                         {Data: []byte("unicode"), Mode: 0644},
+		"dir.with.dots/file.tar.gz":        {Data: bytes.Repeat([]byte("x"), 3*SectorSize+1), Mode: 0644},
+		"ca-certificates/00-corp.crt":      {Data: []byte("-----BEGIN CERTIFICATE-----\n"), Mode: 0644},
+		"B/nested/deeper/file":             {Data: []byte("deep"), Mode: 0644},
+		"a/file":                           {Data: []byte("lower"), Mode: 0644},
+		strings.Repeat("n", MaxNameLength): {Data: []byte("long"), Mode: 0644},
+		// map to the same 30 character identifier, all extension
+		"a." + strings.Repeat("e", 28): {Data: []byte("long extension"), Mode: 0644},
+		"A." + strings.Repeat("e", 28): {Data: []byte("long extension, upper"), Mode: 0644},
+		strings.Repeat("d", 30) + "/1": {Data: []byte("long directory"), Mode: 0644},
+		strings.Repeat("D", 30) + "/2": {Data: []byte("long directory, upper"), Mode: 0644},
+	}
+	for i := 0; i < 60; i++ {
+		files[fmt.Sprintf("many/a-fairly-long-file-name-to-fill-sectors-%02d", i)] = File{Data: []byte{byte(i)}, Mode: 0644}
+	}
+	return files
+}
+
+func writeTestImage(t *testing.T, files map[string]File) []byte {
+	w := NewWriter("cidata")
+	for name, f := range files {
+		if err := w.AddFile(name, f.Data, f.Mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	files := testFiles()
+	image := writeTestImage(t, files)
+
+	for _, names := range []Names{RockRidge, Joliet} {
+		got, err := ReadFiles(bytes.NewReader(image), names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(files) {
+			t.Errorf("read %d files, want %d", len(got), len(files))
+		}
+		for name, want := range files {
+			f, ok := got[name]
+			if !ok {
+				t.Errorf("%s missing", name)
+				continue
+			}
+			if !bytes.Equal(f.Data, want.Data) {
+				t.Errorf("%s has %d bytes, want %d", name, len(f.Data), len(want.Data))
+			}
+			if names == RockRidge && f.Mode != want.Mode {
+				t.Errorf("%s has mode %o, want %o", name, f.Mode, want.Mode)
+			}
+		}
+	}
+}
+
+// pathTableEntry is a path table entry as read from an image
+type pathTableEntry struct {
+	id     []byte
+	extent uint32
+	parent uint16
+}
+
+func readPathTable(image []byte, location uint32, size uint32, order binary.ByteOrder) []pathTableEntry {
+	table := image[location*SectorSize : location*SectorSize+size]
+	var entries []pathTableEntry
+	for len(table) > 0 {
+		idlen := int(table[0])
+		entries = append(entries, pathTableEntry{
+			id:     table[8 : 8+idlen],
+			extent: order.Uint32(table[2:]),
+			parent: order.Uint16(table[6:]),
+		})
+		table = table[8+idlen+idlen%2:]
+	}
+	return entries
+}
+
+// findRecord returns the directory record named id in the directory at extent
+func findRecord(image []byte, extent uint32, id []byte) []byte {
+	dir := image[extent*SectorSize:]
+	size := binary.LittleEndian.Uint32(dir[10:])
+	for off := 0; off < int(size); {
+		reclen := int(dir[off])
+		if reclen == 0 {
+			off = (off/SectorSize + 1) * SectorSize
+			continue
+		}
+		rec := dir[off : off+reclen]
+		if bytes.Equal(rec[33:33+int(rec[32])], id) {
+			return rec
+		}
+		off += reclen
+	}
+	return nil
+}
+
+// TestPathTables checks each tree's path tables are in their own sort order, with parent
+// numbers and extents matching that tree's directory records
+func TestPathTables(t *testing.T) {
+	image := writeTestImage(t, testFiles())
+
+	for sector := firstDescriptor; sector < firstDescriptor+2; sector++ {
+		d := image[sector*SectorSize : (sector+1)*SectorSize]
+		tree := "primary"
+		if d[0] == 2 {
+			tree = "Joliet"
+		}
+
+		size := binary.LittleEndian.Uint32(d[132:])
+		entries := readPathTable(image, binary.LittleEndian.Uint32(d[140:]), size, binary.LittleEndian)
+		mentries := readPathTable(image, binary.BigEndian.Uint32(d[148:]), size, binary.BigEndian)
+		if fmt.Sprint(entries) != fmt.Sprint(mentries) {
+			t.Errorf("%s L and M path tables differ", tree)
+		}
+
+		// the root, a, B, B/nested, B/nested/deeper, ca-certificates, dir.with.dots, many
+		// and the two long directories
+		if len(entries) != 10 {
+			t.Fatalf("%s path table has %d directories", tree, len(entries))
+		}
+		if root := binary.LittleEndian.Uint32(d[158:]); entries[0].extent != root || entries[0].parent != 1 {
+			t.Errorf("%s path table root is %v, want extent %d", tree, entries[0], root)
+		}
+
+		for i := 1; i < len(entries); i++ {
+			e, prev := entries[i], entries[i-1]
+			if i > 1 && (e.parent < prev.parent || (e.parent == prev.parent && bytes.Compare(e.id, prev.id) <= 0)) {
+				t.Errorf("%s path table out of order: %q after %q", tree, e.id, prev.id)
+			}
+			if int(e.parent) > i {
+				t.Errorf("%s path table entry %q has parent %d after it", tree, e.id, e.parent)
+				continue
+			}
+			rec := findRecord(image, entries[e.parent-1].extent, e.id)
+			if rec == nil {
+				t.Errorf("%s path table entry %q isn't in its parent directory", tree, e.id)
+				continue
+			}
+			if extent := binary.LittleEndian.Uint32(rec[2:]); extent != e.extent || rec[25]&2 == 0 {
+				t.Errorf("%s path table entry %q has extent %d, its record %d", tree, e.id, e.extent, extent)
+			}
+		}
+	}
+}
+
+func TestISOIdentifier(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  bool
+		want string
+	}{
+		{"meta-data", false, "META_DATA."},
+		{"file.tar.gz", false, "FILE_TAR.GZ"},
+		{"dir.with.dots", true, "DIR_WITH_DOTS"},
+		{strings.Repeat("n", 40) + ".crt", false, strings.Repeat("N", 26) + ".CRT"},
+		{strings.Repeat("d", 40), true, strings.Repeat("D", 30)},
+	}
+
+	for _, tt := range tests {
+		if got := isoIdentifier(tt.name, tt.dir); got != tt.want {
+			t.Errorf("isoIdentifier(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueIdentifier(t *testing.T) {
+	tests := []struct {
+		id     string
+		dir    bool
+		suffix string
+		want   string
+	}{
+		{"A_B.TXT", false, "_1", "A_B_1.TXT"},
+		{"META_DATA.", false, "_2", "META_DATA_2."},
+		{"DIR", true, "_1", "DIR_1"},
+		{strings.Repeat("D", 30), true, "_1", strings.Repeat("D", 28) + "_1"},
+		{strings.Repeat("N", 26) + ".CRT", false, "_10", strings.Repeat("N", 23) + "_10.CRT"},
+		{"A." + strings.Repeat("E", 28), false, "_1", "A_1." + strings.Repeat("E", 26)},
+		{"." + strings.Repeat("E", 29), false, "_1", "_1." + strings.Repeat("E", 27)},
+		{"AB" + strings.Repeat("C", 24) + "." + strings.Repeat("E", 3), false, "_12345", "AB" + strings.Repeat("C", 18) + "_12345.EEE"},
+	}
+
+	for _, tt := range tests {
+		got := uniqueIdentifier(tt.id, tt.dir, tt.suffix)
+		if got != tt.want {
+			t.Errorf("uniqueIdentifier(%q, %q) = %s, want %s", tt.id, tt.suffix, got, tt.want)
+		}
+		if len(got) > maxISONameLen {
+			t.Errorf("uniqueIdentifier(%q, %q) is %d characters long", tt.id, tt.suffix, len(got))
+		}
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	w := NewWriter("cidata")
+	if err := w.AddFile("dir/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddFile("dir", nil, 0644); err == nil {
+		t.Error("replaced a directory with a file")
+	}
+	if err := w.AddFile("dir/file/other", nil, 0644); err == nil {
+		t.Error("added a file under a file")
+	}
+	if err := w.AddFile(strings.Repeat("n", MaxNameLength+1), nil, 0644); err == nil {
+		t.Error("added a name longer than Joliet allows")
+	}
+	if err := w.AddDir(strings.Repeat("d", MaxNameLength+1) + "/sub"); err == nil {
+		t.Error("added a directory name longer than Joliet allows")
+	}
+	if err := w.AddFile("/", nil, 0644); err == nil {
+		t.Error("added a file without a name")
+	}
+
+	w.VolumeID = "a-volume-id-too-long"
+	if _, err := w.WriteTo(&bytes.Buffer{}); err == nil {
+		t.Error("wrote a volume ID longer than 16 characters")
+	}
+}
+
+func TestReadFilesNotISO(t *testing.T) {
+	if _, err := ReadFiles(bytes.NewReader(make([]byte, 20*SectorSize)), Joliet); err == nil {
+		t.Error("read an image without volume descriptors")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// File is a regular file read back from an image.
+type File struct {
+	Data []byte
+	Mode uint32 // permissions from Rock Ridge, 0 when reading Joliet names
+}
+
+// Names selects which of the directory trees in an image to read.
+type Names int
+
+const (
+	// Joliet reads the Joliet tree.
+	Joliet Names = iota
+	// RockRidge reads the primary tree using Rock Ridge names and permissions.
+	RockRidge
+)
+
+// ReadFiles returns the regular files in the image, keyed by slash separated path.
+func ReadFiles(r io.ReaderAt, names Names) (map[string]File, error) {
+	var root []byte
+	for sector := int64(firstDescriptor); ; sector++ {
+		d := make([]byte, SectorSize)
+		if _, err := r.ReadAt(d, sector*SectorSize); err != nil {
+			return nil, err
+		}
+		if string(d[1:6]) != "CD001" {
+			return nil, errors.New("not an ISO9660 image")
+		}
+		if d[0] == 255 {
+			break
+		}
+		if (names == RockRidge && d[0] == 1) || (names == Joliet && d[0] == 2 && string(d[88:90]) == "%/") {
+			root = d[156:190]
+		}
+	}
+	if root == nil {
+		return nil, errors.New("no matching volume descriptor")
+	}
+
+	files := map[string]File{}
+	err := readDir(r, names, binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:]), "", files, 0)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func readDir(r io.ReaderAt, names Names, extent uint32, size uint32, dir string, files map[string]File, depth int) error {
+	if depth > 64 {
+		return errors.New("directories nested too deeply")
+	}
+
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, int64(extent)*SectorSize); err != nil {
+		return err
+	}
+
+	for off := 0; off < len(buf); {
+		reclen := int(buf[off])
+		if reclen == 0 {
+			// records don't cross sectors, skip to the next one
+			off = (off/SectorSize + 1) * SectorSize
+			continue
+		}
+		if off+reclen > len(buf) || reclen < 34 {
+			return fmt.Errorf("bad directory record in %s", dir)
+		}
+		rec := buf[off : off+reclen]
+		off += reclen
+
+		idlen := int(rec[32])
+		if 33+idlen > len(rec) {
+			return fmt.Errorf("bad directory record in %s", dir)
+		}
+		id := rec[33 : 33+idlen]
+		if idlen == 1 && (id[0] == 0 || id[0] == 1) {
+			continue
+		}
+
+		name, mode := "", uint32(0)
+		if names == Joliet {
+			name = decodeUCS2(id)
+		} else {
+			name, mode = rockRidge(rec[33+idlen+(1-idlen%2):])
+			if name == "" {
+				name = strings.TrimSuffix(strings.TrimSuffix(string(id), ";1"), ".")
+			}
+		}
+
+		childExtent := binary.LittleEndian.Uint32(rec[2:])
+		childSize := binary.LittleEndian.Uint32(rec[10:])
+		full := path.Join(dir, name)
+		if rec[25]&2 != 0 {
+			if err := readDir(r, names, childExtent, childSize, full, files, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data := make([]byte, childSize)
+		if _, err := r.ReadAt(data, int64(childExtent)*SectorSize); err != nil {
+			return err
+		}
+		files[full] = File{Data: data, Mode: mode}
+	}
+
+	return nil
+}
+
+// rockRidge returns the NM name and PX permissions from a System Use area
+func rockRidge(su []byte) (string, uint32) {
+	name, mode := "", uint32(0)
+	for len(su) >= 4 {
+		entrylen := int(su[2])
+		if entrylen < 4 || entrylen > len(su) {
+			break
+		}
+		switch string(su[:2]) {
+		case "NM":
+			if entrylen > 5 {
+				name += string(su[5:entrylen])
+			}
+		case "PX":
+			if entrylen >= 12 {
+				mode = binary.LittleEndian.Uint32(su[4:]) & 07777
+			}
+		}
+		su = su[entrylen:]
+	}
+	return name, mode
+}
+
+func decodeUCS2(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return strings.TrimSuffix(string(utf16.Decode(u)), ";1")
+}
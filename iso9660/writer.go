@@ -0,0 +1,524 @@
+// Copyright 2019 Steve Wills. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package iso9660 builds ISO9660 images with Joliet and Rock Ridge names from an
+// in-memory file tree, so seed images can be made without mkisofs or makefs.
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	// SectorSize is the logical block size of the images written.
+	SectorSize = 2048
+
+	// MaxNameLength is the longest file name, in characters, that Joliet readers accept.
+	MaxNameLength = 103
+
+	firstDescriptor = 16
+	maxISONameLen   = 30
+)
+
+type node struct {
+	name     string
+	mode     uint32
+	data     []byte
+	children map[string]*node
+
+	isoName    string
+	number     [2]uint16 // directory number in the primary and Joliet path tables
+	parent     *node
+	extent     [2]uint32 // primary and Joliet directory extents, or the file extent
+	dirSize    [2]uint32
+	sortedKids [2][]*node
+}
+
+func (n *node) isDir() bool {
+	return n.children != nil
+}
+
+// Writer holds a file tree to be written as an ISO9660 image.
+type Writer struct {
+	VolumeID string
+	ModTime  time.Time
+	root     *node
+}
+
+// NewWriter returns a Writer for an image labeled volumeID.
+func NewWriter(volumeID string) *Writer {
+	return &Writer{
+		VolumeID: volumeID,
+		ModTime:  time.Now(),
+		root:     &node{mode: 0755, children: map[string]*node{}},
+	}
+}
+
+func (w *Writer) lookup(name string, create bool) (*node, error) {
+	cur := w.root
+	clean := strings.Trim(path.Clean("/"+name), "/")
+	if clean == "" {
+		return cur, nil
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if len(utf16.Encode([]rune(part))) > MaxNameLength {
+			return nil, fmt.Errorf("%s is longer than %d characters", part, MaxNameLength)
+		}
+		next, ok := cur.children[part]
+		if !ok {
+			if !create {
+				return nil, fmt.Errorf("%s not found", name)
+			}
+			next = &node{name: part, mode: 0755, children: map[string]*node{}, parent: cur}
+			cur.children[part] = next
+		}
+		if !next.isDir() {
+			return nil, fmt.Errorf("%s is not a directory", part)
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// AddDir adds a directory, and any missing parents, to the image.
+func (w *Writer) AddDir(name string) error {
+	_, err := w.lookup(name, true)
+	return err
+}
+
+// AddFile adds a file with the given contents and permissions, creating its parent
+// directories. Adding a file twice replaces its contents.
+func (w *Writer) AddFile(name string, data []byte, mode uint32) error {
+	dir, base := path.Split(strings.Trim(path.Clean("/"+name), "/"))
+	if base == "" {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if len(utf16.Encode([]rune(base))) > MaxNameLength {
+		return fmt.Errorf("%s is longer than %d characters", base, MaxNameLength)
+	}
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return err
+	}
+	if existing, ok := parent.children[base]; ok && existing.isDir() {
+		return fmt.Errorf("%s is a directory", name)
+	}
+	parent.children[base] = &node{name: base, mode: mode & 07777, data: data, parent: parent}
+
+	return nil
+}
+
+// WriteFile writes the image to filename.
+func (w *Writer) WriteFile(filename string) error {
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// isoIdentifier maps a name to the restricted ISO9660 character set, Rock Ridge and
+// Joliet carry the real name
+func isoIdentifier(name string, dir bool) string {
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r == '.' && !dir:
+			return r
+		}
+		return '_'
+	}, name)
+
+	if dir {
+		if len(id) > maxISONameLen {
+			id = id[:maxISONameLen]
+		}
+		return id
+	}
+
+	// only one dot is allowed, separating the extension
+	if i := strings.LastIndex(id, "."); i >= 0 {
+		id = strings.Replace(id[:i], ".", "_", -1) + id[i:]
+	} else {
+		id += "."
+	}
+	if len(id) > maxISONameLen {
+		ext := id[strings.LastIndex(id, "."):]
+		if len(ext) > 4 {
+			ext = ext[:4]
+		}
+		id = id[:maxISONameLen-len(ext)] + ext
+	}
+	return id
+}
+
+func ucs2(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return b
+}
+
+func both16(v uint16) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+	return b
+}
+
+func both32(v uint32) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+	return b
+}
+
+func pad(b []byte, n int, c byte) []byte {
+	out := bytes.Repeat([]byte{c}, n)
+	copy(out, b)
+	return out
+}
+
+func sectors(size int) uint32 {
+	return uint32((size + SectorSize - 1) / SectorSize)
+}
+
+func recordingDate(t time.Time) []byte {
+	_, offset := t.Zone()
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()), byte(int8(offset / 900))}
+}
+
+func volumeDate(t time.Time) []byte {
+	return append([]byte(t.UTC().Format("20060102150405")+"00"), 0)
+}
+
+// dirRecord renders a directory record, su is the System Use area holding Rock Ridge entries
+func dirRecord(id []byte, extent uint32, size uint32, dir bool, t time.Time, su []byte) []byte {
+	rec := []byte{0, 0}
+	rec = append(rec, both32(extent)...)
+	rec = append(rec, both32(size)...)
+	rec = append(rec, recordingDate(t)...)
+	flags := byte(0)
+	if dir {
+		flags = 2
+	}
+	rec = append(rec, flags, 0, 0)
+	rec = append(rec, both16(1)...)
+	rec = append(rec, byte(len(id)))
+	rec = append(rec, id...)
+	if len(rec)%2 == 1 {
+		rec = append(rec, 0)
+	}
+	rec = append(rec, su...)
+	if len(rec)%2 == 1 {
+		rec = append(rec, 0)
+	}
+	rec[0] = byte(len(rec))
+	return rec
+}
+
+func susp(sig string, body []byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(body)), 1}, body...)
+}
+
+func rockRidgePX(n *node) []byte {
+	mode := n.mode | 0100000
+	nlink := uint32(1)
+	if n.isDir() {
+		mode = n.mode | 040000
+		nlink = 2
+	}
+	var body []byte
+	body = append(body, both32(mode)...)
+	body = append(body, both32(nlink)...)
+	body = append(body, both32(0)...)
+	body = append(body, both32(0)...)
+	return susp("PX", body)
+}
+
+func rockRidgeNM(name string) []byte {
+	return susp("NM", append([]byte{0}, name...))
+}
+
+// rockRidgeRoot returns the entries identifying Rock Ridge in the root's "." record
+func rockRidgeRoot() []byte {
+	su := susp("SP", []byte{0xbe, 0xef, 0})
+	id := "RRIP_1991A"
+	su = append(su, susp("ER", append([]byte{byte(len(id)), 0, 0, 1}, id...))...)
+	return su
+}
+
+// directories returns the directories in the primary (tree 0) or Joliet (tree 1) path
+// table order, numbering them as it goes. The trees sort names differently, so each has
+// its own numbering.
+func (w *Writer) directories(tree int) []*node {
+	dirs := []*node{w.root}
+	w.root.number[tree] = 1
+	for i := 0; i < len(dirs); i++ {
+		for _, child := range dirs[i].sortedKids[tree] {
+			if child.isDir() {
+				dirs = append(dirs, child)
+				child.number[tree] = uint16(len(dirs))
+			}
+		}
+	}
+	return dirs
+}
+
+// uniqueIdentifier adds suffix to the ISO identifier id, before a file's extension. To
+// stay within maxISONameLen the extension is shortened to three characters first, then
+// the rest of the name.
+func uniqueIdentifier(id string, dir bool, suffix string) string {
+	base, ext := id, ""
+	if !dir {
+		dot := strings.LastIndex(id, ".")
+		base, ext = id[:dot], id[dot:]
+	}
+
+	over := len(base) + len(suffix) + len(ext) - maxISONameLen
+	if over > 0 && len(ext) > 4 {
+		cut := len(ext) - 4
+		if cut > over {
+			cut = over
+		}
+		ext = ext[:len(ext)-cut]
+		over -= cut
+	}
+	if over > len(base) {
+		over = len(base)
+	}
+	if over > 0 {
+		base = base[:len(base)-over]
+	}
+	return base + suffix + ext
+}
+
+// prepare picks unique ISO identifiers and sorts each directory's entries for both trees
+func prepare(n *node) {
+	var kids []*node
+	for _, child := range n.children {
+		kids = append(kids, child)
+	}
+	sort.Slice(kids, func(i, j int) bool { return kids[i].name < kids[j].name })
+
+	used := map[string]bool{}
+	for _, child := range kids {
+		mapped := isoIdentifier(child.name, child.isDir())
+		id := mapped
+		for i := 1; used[id]; i++ {
+			id = uniqueIdentifier(mapped, child.isDir(), "_"+strconv.Itoa(i))
+		}
+		used[id] = true
+		child.isoName = id
+		if !child.isDir() {
+			child.isoName += ";1"
+		}
+	}
+
+	primary := append([]*node(nil), kids...)
+	sort.Slice(primary, func(i, j int) bool { return primary[i].isoName < primary[j].isoName })
+	joliet := append([]*node(nil), kids...)
+	sort.Slice(joliet, func(i, j int) bool { return bytes.Compare(ucs2(joliet[i].name), ucs2(joliet[j].name)) < 0 })
+	n.sortedKids = [2][]*node{primary, joliet}
+
+	for _, child := range kids {
+		if child.isDir() {
+			prepare(child)
+		}
+	}
+}
+
+// records renders a directory's records for the primary (tree 0) or Joliet (tree 1)
+// tree, starting a new sector where a record would cross a sector boundary
+func (w *Writer) records(n *node, tree int) []byte {
+	var dot, dotdot []byte
+	parent := n.parent
+	if parent == nil {
+		parent = n
+	}
+	if tree == 0 {
+		su := rockRidgePX(n)
+		if n == w.root {
+			su = append(rockRidgeRoot(), su...)
+		}
+		dot = dirRecord([]byte{0}, n.extent[0], n.dirSize[0], true, w.ModTime, su)
+		dotdot = dirRecord([]byte{1}, parent.extent[0], parent.dirSize[0], true, w.ModTime, rockRidgePX(parent))
+	} else {
+		dot = dirRecord([]byte{0}, n.extent[1], n.dirSize[1], true, w.ModTime, nil)
+		dotdot = dirRecord([]byte{1}, parent.extent[1], parent.dirSize[1], true, w.ModTime, nil)
+	}
+
+	var out []byte
+	add := func(rec []byte) {
+		used := len(out) % SectorSize
+		if used+len(rec) > SectorSize {
+			out = append(out, make([]byte, SectorSize-used)...)
+		}
+		out = append(out, rec...)
+	}
+	add(dot)
+	add(dotdot)
+	for _, child := range n.sortedKids[tree] {
+		extent, size := child.extent[0], uint32(len(child.data))
+		if child.isDir() {
+			extent, size = child.extent[tree], child.dirSize[tree]
+		}
+		if tree == 0 {
+			su := append(rockRidgePX(child), rockRidgeNM(child.name)...)
+			add(dirRecord([]byte(child.isoName), extent, size, child.isDir(), w.ModTime, su))
+		} else {
+			add(dirRecord(ucs2(child.name), extent, size, child.isDir(), w.ModTime, nil))
+		}
+	}
+	return out
+}
+
+func pathTable(dirs []*node, tree int, bigendian bool) []byte {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigendian {
+		order = binary.BigEndian
+	}
+
+	var t []byte
+	for _, d := range dirs {
+		id := []byte{0}
+		parent := uint16(1)
+		if d.parent != nil {
+			parent = d.parent.number[tree]
+			id = []byte(d.isoName)
+			if tree == 1 {
+				id = ucs2(d.name)
+			}
+		}
+		entry := make([]byte, 8, 8+len(id)+1)
+		entry[0] = byte(len(id))
+		order.PutUint32(entry[2:], d.extent[tree])
+		order.PutUint16(entry[6:], parent)
+		entry = append(entry, id...)
+		if len(id)%2 == 1 {
+			entry = append(entry, 0)
+		}
+		t = append(t, entry...)
+	}
+	return t
+}
+
+func (w *Writer) descriptor(joliet bool, size uint32, pathTableSize int, lpath uint32, mpath uint32) []byte {
+	d := make([]byte, SectorSize)
+	d[0] = 1
+	copy(d[1:], "CD001")
+	d[6] = 1
+	tree := 0
+	if joliet {
+		d[0] = 2
+		tree = 1
+		copy(d[40:], pad(ucs2(w.VolumeID), 32, 0))
+		copy(d[88:], "%/E")
+		for i := 190; i < 813; i += 2 {
+			d[i], d[i+1] = 0, ' '
+		}
+	} else {
+		copy(d[8:], pad(nil, 32, ' '))
+		copy(d[40:], pad([]byte(strings.ToUpper(w.VolumeID)), 32, ' '))
+		copy(d[190:], pad(nil, 813-190, ' '))
+	}
+	copy(d[80:], both32(size))
+	copy(d[120:], both16(1))
+	copy(d[124:], both16(1))
+	copy(d[128:], both16(SectorSize))
+	copy(d[132:], both32(uint32(pathTableSize)))
+	binary.LittleEndian.PutUint32(d[140:], lpath)
+	binary.BigEndian.PutUint32(d[148:], mpath)
+	copy(d[156:], dirRecord([]byte{0}, w.root.extent[tree], w.root.dirSize[tree], true, w.ModTime, nil))
+	copy(d[813:], volumeDate(w.ModTime))
+	copy(d[830:], volumeDate(w.ModTime))
+	copy(d[847:], append(bytes.Repeat([]byte{'0'}, 16), 0))
+	copy(d[864:], volumeDate(w.ModTime))
+	d[881] = 1
+	return d
+}
+
+// WriteTo writes the image to out.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	if len(w.VolumeID) > 16 {
+		return 0, fmt.Errorf("volume ID %s is longer than 16 characters", w.VolumeID)
+	}
+
+	prepare(w.root)
+	dirs := [2][]*node{w.directories(0), w.directories(1)}
+
+	// directory sizes don't depend on extents, so lay them out with placeholders first
+	for tree := 0; tree < 2; tree++ {
+		for _, d := range dirs[tree] {
+			d.dirSize[tree] = sectors(len(w.records(d, tree))) * SectorSize
+		}
+	}
+
+	ptSizes := [2]int{len(pathTable(dirs[0], 0, false)), len(pathTable(dirs[1], 1, false))}
+	next := uint32(firstDescriptor + 3)
+	var ptExtents [2][2]uint32
+	for tree := 0; tree < 2; tree++ {
+		for endian := 0; endian < 2; endian++ {
+			ptExtents[tree][endian] = next
+			next += sectors(ptSizes[tree])
+		}
+	}
+	for tree := 0; tree < 2; tree++ {
+		for _, d := range dirs[tree] {
+			d.extent[tree] = next
+			next += d.dirSize[tree] / SectorSize
+		}
+	}
+	var files []*node
+	for _, d := range dirs[0] {
+		for _, child := range d.sortedKids[0] {
+			if !child.isDir() {
+				files = append(files, child)
+				child.extent[0] = next
+				next += sectors(len(child.data))
+			}
+		}
+	}
+
+	var image bytes.Buffer
+	image.Write(make([]byte, firstDescriptor*SectorSize))
+	image.Write(w.descriptor(false, next, ptSizes[0], ptExtents[0][0], ptExtents[0][1]))
+	image.Write(w.descriptor(true, next, ptSizes[1], ptExtents[1][0], ptExtents[1][1]))
+	terminator := make([]byte, SectorSize)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+	image.Write(terminator)
+	for tree := 0; tree < 2; tree++ {
+		for endian := 0; endian < 2; endian++ {
+			image.Write(pad(pathTable(dirs[tree], tree, endian == 1), int(sectors(ptSizes[tree]))*SectorSize, 0))
+		}
+	}
+	for tree := 0; tree < 2; tree++ {
+		for _, d := range dirs[tree] {
+			image.Write(pad(w.records(d, tree), int(d.dirSize[tree]), 0))
+		}
+	}
+	for _, f := range files {
+		image.Write(pad(f.data, int(sectors(len(f.data)))*SectorSize, 0))
+	}
+
+	return image.WriteTo(out)
+}
@@ -1,10 +1,91 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/docker/machine/commands/mcndirs"
 	"github.com/docker/machine/libmachine/drivers/plugin"
+	"github.com/docker/machine/libmachine/log"
+	"gitlab.mouf.net/swills/docker-machine-driver-bhyve/b2d"
 	"gitlab.mouf.net/swills/docker-machine-driver-bhyve/bhyve"
 )
 
 func main() {
+	if err := bhyve.CheckDoas(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "prune-isos" {
+		pruneISOs(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "helper" {
+		// run as root via sudo or doas, see bhyve/helper.go
+		if err := bhyve.Helper(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		doctor(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dhcp-status" {
+		dhcpStatus(os.Args[2:])
+		return
+	}
+
 	plugin.RegisterDriver(bhyve.NewDriver("", ""))
 }
+
+// pruneISOs removes cached boot2docker ISOs no machine was created from
+func pruneISOs(args []string) {
+	flags := flag.NewFlagSet("prune-isos", flag.ExitOnError)
+	storagePath := flags.String("storage-path", mcndirs.GetBaseDir(), "docker-machine storage path")
+	days := flags.Int("days", 30, "only remove ISOs last used more than this many days ago")
+	_ = flags.Parse(args)
+
+	pruned, err := b2d.NewB2dUtils(*storagePath).Prune(time.Duration(*days) * 24 * time.Hour)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	log.Infof("Removed %d cached ISOs", len(pruned))
+}
+
+// dhcpStatus shows the state of the dnsmasq serving each network
+func dhcpStatus(args []string) {
+	flags := flag.NewFlagSet("dhcp-status", flag.ExitOnError)
+	storagePath := flags.String("storage-path", mcndirs.GetBaseDir(), "docker-machine storage path")
+	_ = flags.Parse(args)
+
+	if err := bhyve.DHCPStatus(os.Stdout, *storagePath); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// doctor checks the host setup, and optionally fixes it
+func doctor(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	storagePath := flags.String("storage-path", mcndirs.GetBaseDir(), "docker-machine storage path")
+	privilege := flags.String("privilege", "auto", "how to get root: auto, none, sudo or doas")
+	fix := flags.Bool("fix", false, "write the sudoers or doas.conf, devfs.rules and rc.conf changes the host needs")
+	yes := flags.Bool("yes", false, "don't ask before changing files")
+	_ = flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if *yes {
+		in = nil
+	}
+
+	if err := bhyve.Doctor(os.Stdout, in, *storagePath, *privilege, *fix); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}